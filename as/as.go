@@ -18,57 +18,112 @@
 package as
 
 import (
-	"bufio"
-	"bytes"
 	"debug/elf"
-	"encoding/binary"
 	"errors"
 	"flag"
-	"io"
 	"os"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/NonerKao/go-binutils/common"
 	"github.com/NonerKao/go-binutils/rvgc"
 )
 
-type sec64 struct {
-	header  elf.Section64
+// a section being assembled into, with what it takes until the object is
+// laid out
+type asSection struct {
+	*common.Section
 	content []string
+	loc     uint64          // the location counter
+	group   string          // the signature of its section group
+	linkTo  string          // the section or symbol of SHF_LINK_ORDER
+	rela    *common.Section // its relocations, once laid out
 }
 
-type elf64 struct {
-	header   elf.Header64
-	sections map[string]*sec64
+// a relocation against a symbol, until the symbol table is laid out
+type reloc struct {
+	off    uint64
+	sym    *symbol
+	addend int64
+	r      elf.R_RISCV
+}
+
+// a branch or jump to a symbol, to be resolved once all labels are known
+type fixup struct {
+	sec string
+	idx int
+	off uint64
+	v   value
+	r   elf.R_RISCV
+	pos pos
+}
+
+// a data value referring to symbols further on, evaluated again once all
+// labels are known
+type dataFixup struct {
+	sec  string
+	idx  int
+	dot  *symbol
+	dire string
+	expr string
+	toks []token // expr, with the numeric labels it refers to resolved
+	pos  pos
 }
 
 type asUtil struct {
-	src     *os.File
-	objFile *os.File
-	obj     *elf64
-	symtab  []*elf.Sym64
-	rela    []*elf.Rela64
-	shOrder []string
+	src          *os.File
+	obj          *common.Object
+	sections     map[string]*asSection
+	rela         map[string][]common.Reloc
+	shOrder      []string
+	curSec       string // the section being assembled into
+	enc          *rvgc.Encoder
+	isa          *rvgc.ISA
+	rvc          bool
+	syms         map[string]*symbol
+	symOrder     []string
+	localLabels  map[string]int // the definitions of each numeric label so far
+	fixups       []fixup
+	dataFixups   []dataFixup
+	relocs       map[string][]reloc
+	pcrelHi      int
+	pending      value
+	filename     string
+	line         int
+	via          []string
+	cols         []int
+	frames       []*frame
+	rec          *recording
+	conds        []cond
+	macros       map[string]*macro
+	macroCount   int
+	previous     string
+	sectionStack [][2]string // the current and previous sections of each .pushsection
+	includeDirs  includeDirs
+	werror       bool
+	errors       int
 }
 
 func New() *asUtil {
 	return &asUtil{
-		src:     nil,
-		objFile: nil,
-		obj: &elf64{
-			sections: make(map[string]*sec64),
-		},
-		symtab:  make([]*elf.Sym64, 0),
-		rela:    make([]*elf.Rela64, 0),
-		shOrder: make([]string, 0),
+		src:         nil,
+		obj:         common.NewObject(elf.ELFCLASS64, elf.ET_REL, elf.EM_RISCV),
+		sections:    make(map[string]*asSection),
+		rela:        make(map[string][]common.Reloc),
+		shOrder:     make([]string, 0),
+		syms:        make(map[string]*symbol),
+		symOrder:    make([]string, 0),
+		localLabels: make(map[string]int),
+		fixups:      make([]fixup, 0),
+		dataFixups:  make([]dataFixup, 0),
+		relocs:      make(map[string][]reloc),
+		macros:      make(map[string]*macro),
 	}
 }
 
-var currentOffsetShStr uint32
-var currentOffsetStr uint32
-var currentOffset uint64
-var currentSection string
-
+// names that are not for the sections of the source: the string and
+// symbol tables are made when the object is written, and "" is no section
 var internalSection = []string{
 	"",
 	".shstrtab",
@@ -76,75 +131,20 @@ var internalSection = []string{
 	".symtab",
 }
 
-func (asu *asUtil) addSection(sec string) error {
-	if asu.obj.sections[sec] != nil {
-		return errors.New("Section " + sec + " already exists!")
-	} else {
-		asu.obj.sections[sec] = new(sec64)
-		asu.obj.sections[sec].content = make([]string, 0)
-	}
-
-	asu.shOrder = append(asu.shOrder, sec)
-
-	thisSec := asu.obj.sections[sec]
-	thisSec.header.Name = currentOffsetShStr
-	switch sec {
-	case "":
-		thisSec.header.Type = uint32(elf.SHT_NULL)
-		asu.symtab = append(asu.symtab, &elf.Sym64{
-			Name:  0,
-			Info:  elf.ST_INFO(elf.STB_LOCAL, elf.STT_NOTYPE),
-			Shndx: 0,
-		})
-		/*asu.rela = append(asu.rela, &elf.Rela64{
-			Off:    0,
-			Info:   elf.R_INFO(0, uint32(elf.R_RISCV_NONE)),
-			Addend: 0,
-		})*/
-	case ".shstrtab":
-		thisSec.header.Type = uint32(elf.SHT_STRTAB)
-		thisSec.header.Addralign = 0x1
-		thisSec.content = append(thisSec.content, "")
-		currentOffsetShStr = 1
-	case ".strtab":
-		thisSec.header.Type = uint32(elf.SHT_STRTAB)
-		thisSec.header.Addralign = 0x1
-		thisSec.content = append(thisSec.content, "")
-		currentOffsetStr = 1
-	case ".symtab":
-		thisSec.header.Type = uint32(elf.SHT_SYMTAB)
-		thisSec.header.Addralign = 0x8
-		thisSec.header.Entsize = 0x18
-	case ".bss":
-		thisSec.header.Type = uint32(elf.SHT_NOBITS)
-		thisSec.header.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
-		thisSec.header.Addralign = 0x1
-	case ".data":
-		thisSec.header.Type = uint32(elf.SHT_PROGBITS)
-		thisSec.header.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
-		thisSec.header.Addralign = 0x1
-	case ".text":
-		thisSec.header.Type = uint32(elf.SHT_PROGBITS)
-		thisSec.header.Flags = uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR)
-		thisSec.header.Addralign = 0x4
-		asu.symtab = append(asu.symtab, &elf.Sym64{
-			Info:  elf.ST_INFO(elf.STB_LOCAL, elf.STT_SECTION),
-			Shndx: asu.obj.header.Shnum,
-		})
-	case ".rela.text":
-		thisSec.header.Type = uint32(elf.SHT_RELA)
-		thisSec.header.Flags = uint64(elf.SHF_INFO_LINK)
-		thisSec.header.Addralign = 0x8
-		thisSec.header.Entsize = 0x18
-	}
-
-	if sec != "" {
-		asu.obj.sections[".shstrtab"].content = append(asu.obj.sections[".shstrtab"].content, sec)
+func (asu *asUtil) addSection(name string) error {
+	if asu.sections[name] != nil {
+		return errors.New("Section " + name + " already exists!")
 	}
-	currentOffsetShStr += uint32(len(sec) + 1)
-	currentSection = sec
-	asu.obj.header.Shnum += 1
 
+	typ, flags := sectionDefaults(name)
+	asu.sections[name] = &asSection{Section: &common.Section{
+		Name:      name,
+		Type:      typ,
+		Flags:     flags,
+		Addralign: asu.minAlign(flags),
+	}}
+	asu.shOrder = append(asu.shOrder, name)
+	asu.curSec = name
 	return nil
 }
 
@@ -155,30 +155,7 @@ func (asu *asUtil) Init(filename string) error {
 	if err != nil {
 		return err
 	}
-
-	asu.obj.header.Ident[0] = '\x7f'
-	asu.obj.header.Ident[1] = 'E'
-	asu.obj.header.Ident[2] = 'L'
-	asu.obj.header.Ident[3] = 'F'
-	asu.obj.header.Ident[4] = byte(elf.ELFCLASS64)
-	asu.obj.header.Ident[5] = byte(elf.ELFDATA2LSB)
-	asu.obj.header.Ident[6] = byte(elf.EV_CURRENT)
-	asu.obj.header.Type = uint16(elf.ET_REL)
-	asu.obj.header.Machine = 243 //elf.EM_RISCV
-	asu.obj.header.Version = uint32(elf.EV_CURRENT)
-	asu.obj.header.Ehsize = 64
-	asu.obj.header.Flags = uint32(0x0005)
-
-	asu.obj.header.Shentsize = 64
-	asu.obj.header.Shnum = 0
-	asu.obj.header.Shstrndx = 1
-
-	for _, sec := range internalSection {
-		err := asu.addSection(sec)
-		if err != nil {
-			return err
-		}
-	}
+	asu.filename = filename
 
 	return nil
 }
@@ -186,197 +163,429 @@ func (asu *asUtil) Init(filename string) error {
 func (asu *asUtil) DefineFlags() map[string]interface{} {
 
 	args := map[string]interface{}{
-		"o": flag.String("o", "a.out", "Output file name"),
+		"o":      flag.String("o", "a.out", "Output file name"),
+		"march":  flag.String("march", rvgc.DefaultISA, "Target ISA, such as rv64imafdc_zba"),
+		"Werror": flag.Bool("Werror", false, "Treat warnings as errors"),
+		"I":      new(includeDirs),
 	}
+	flag.Var(args["I"].(*includeDirs), "I", "Add a directory to search for .include files")
 
 	return args
 }
 
-func (asu *asUtil) addLabel(lab string) {
-	asu.obj.sections[".strtab"].content = append(asu.obj.sections[".strtab"].content, lab)
-	asu.symtab = append(asu.symtab, &elf.Sym64{
-		Name:  currentOffsetStr,
-		Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC),
-		Shndx: asu.obj.header.Shnum - 1,
-	})
-
-	currentOffsetStr += uint32(len(lab) + 1)
-}
+// resolve evaluates the data that had to wait for labels further on,
+// patches the branches and jumps to labels of their own section, and turns
+// the others into relocations.  Errors are reported where they arise.
+func (asu *asUtil) resolve() {
+	for _, f := range asu.dataFixups {
+		v, err := asu.evalTokens(f.expr, f.toks, f.dot, true)
+		if err != nil {
+			asu.fail(f.pos, err)
+			continue
+		}
+		b, err := asu.dataBytes(f.sec, f.dot.value, f.dire, f.expr, v, f.pos)
+		if err != nil {
+			asu.fail(f.pos, err)
+			continue
+		}
+		sec := asu.sections[f.sec]
+		if sec.Type != elf.SHT_NOBITS {
+			sec.content[f.idx] = string(b)
+		} else if strings.Trim(string(b), "\x00") != "" {
+			asu.fail(f.pos, errors.New("Non-zero data in "+f.sec))
+		}
+	}
 
-func preProcessLine(line string) []string {
+	for _, f := range asu.fixups {
+		s := f.v.sym
+		if s.sec != f.sec {
+			if !s.emitted() && s.sec == "" {
+				asu.fail(f.pos, errors.New("Symbol "+s.written()+" is not defined"))
+				continue
+			}
+			asu.addRela(f.sec, f.off, f.v, f.r)
+			continue
+		}
 
-	rePunc := regexp.MustCompile(`[,()]`)
-	reSpace := regexp.MustCompile(`[[:space:]]+`)
-	line = rePunc.ReplaceAllString(line, " ")
-	line = reSpace.ReplaceAllString(line, " ")
-	sa := strings.Split(strings.TrimSpace(string(line)), " ")
+		content := asu.sections[f.sec].content
+		b, err := rvgc.Fixup([]byte(content[f.idx]), f.r, int64(s.value)+f.v.addend-int64(f.off))
+		if err != nil {
+			asu.fail(f.pos, errors.New(s.written()+": "+err.Error()))
+			continue
+		}
+		content[f.idx] = string(b)
+	}
 
-	return sa
+	for _, relocs := range asu.relocs {
+		sort.SliceStable(relocs, func(i, j int) bool {
+			return relocs[i].off < relocs[j].off
+		})
+	}
 }
 
-func (asu *asUtil) Run(args map[string]interface{}) error {
-
-	r := bufio.NewReaderSize(asu.src, 1024)
-	line, _, err := r.ReadLine()
-	end := false
-	for err == nil {
-		sa := preProcessLine(string(line))
+func (asu *asUtil) addRela(sec string, off uint64, v value, r elf.R_RISCV) {
+	s := asu.use(v.sym)
+	if r == elf.R_RISCV_PCREL_LO12_I || r == elf.R_RISCV_PCREL_LO12_S {
+		s.keep = true
+	}
+	asu.relocs[sec] = append(asu.relocs[sec], reloc{off: off, sym: s, addend: v.addend, r: r})
+}
 
-		if sa[0][0] == '.' {
-			end, err = asu.dire(sa)
-			if end {
-				break
+// layoutRela turns the relocations into their ELF form, against the
+// symbols of the symbol table.  Those against temporary labels go against
+// the section symbol instead.
+func (asu *asUtil) layoutRela(index, secSym map[string]*common.Symbol) error {
+	for sec, relocs := range asu.relocs {
+		for _, r := range relocs {
+			s := r.sym
+			sym, ok := index[s.name]
+			addend := r.addend
+			if !ok {
+				if s.sec == "" || s.sec == absSection {
+					return errors.New("Cannot relocate against " + s.written())
+				}
+				sym, addend = secSym[s.sec], addend+int64(s.value)
 			}
-		} else if sa[0][len(sa[0])-1] == ':' {
-			asu.addLabel(sa[0][0 : len(sa[0])-1])
-		} else {
-			asu.inst(sa)
+			asu.rela[sec] = append(asu.rela[sec], common.Reloc{
+				Off:    r.off,
+				Sym:    sym,
+				Type:   uint32(r.r),
+				Addend: addend,
+			})
+		}
+	}
+	return nil
+}
+
+// instOperands turns the operands of an instruction into the words
+// rvgc takes, with the column each of them starts at.  An
+// offset(register) operand is taken as two, and a lone (register) is just
+// the register.
+func instOperands(st *stmt) ([]string, []int) {
+	ops, cols := []string{st.name.text}, []int{st.name.col}
+	for i, op := range st.ops {
+		off, reg := memOperand(op)
+		if reg == nil {
+			ops, cols = append(ops, st.text(op)), append(cols, st.col(i))
+			continue
 		}
+		if len(off) > 0 {
+			ops, cols = append(ops, st.text(off)), append(cols, off[0].col)
+		}
+		ops, cols = append(ops, reg.text), append(cols, reg.col)
+	}
+	return ops, cols
+}
 
-		line, _, err = r.ReadLine()
+// memOperand splits offset(register) in two, or returns a nil register if
+// op is not like that.  The offset may not end with a relocation operator,
+// as in %lo(sym), or with an operator of an expression.
+func memOperand(op []token) ([]token, *token) {
+	n := len(op)
+	if n < 3 || !op[n-1].is(")") || !op[n-3].is("(") ||
+		op[n-2].kind != tokRegister && op[n-2].kind != tokIdent {
+		return nil, nil
+	}
+	off := op[:n-3]
+	if len(off) == 0 {
+		return off, &op[n-2]
 	}
+	last := off[len(off)-1]
+	switch {
+	case last.kind == tokPunct && !last.is(")"):
+	case len(off) >= 2 && off[len(off)-2].is("%"):
+	default:
+		return off, &op[n-2]
+	}
+	return nil, nil
+}
+
+func (asu *asUtil) Run(args map[string]interface{}) error {
 
-	if end == false && err != io.EOF {
+	var err error
+	asu.isa, err = rvgc.ParseISA(*args["march"].(*string))
+	if err != nil {
 		return err
 	}
+	if asu.isa.XLEN == 32 {
+		asu.obj.Class = elf.ELFCLASS32
+	}
+	asu.enc = &rvgc.Encoder{ISA: asu.isa, Eval: asu.immediate}
+	asu.rvc = asu.isa.Has("c")
+	asu.werror = *args["Werror"].(*bool)
+	asu.includeDirs = *args["I"].(*includeDirs)
 
+	err = asu.pushFile(asu.filename, asu.src)
 	asu.src.Close()
-	return nil
-}
+	if err != nil {
+		return err
+	}
 
-func (asu *asUtil) dire(d []string) (bool, error) {
-	var err error
-	switch d[0] {
-	case ".section":
-		if len(d) != 2 {
-			return false, errors.New("Syntax error: section not specified!")
+lines:
+	for {
+		line, ok := asu.nextLine()
+		if !ok {
+			break
 		}
-		for _, sec := range internalSection {
-			if d[1] == sec {
-				return false, errors.New("Syntax error: not allowed section " + d[1])
+		asu.cols = []int{0}
+		if asu.rec != nil {
+			if err := asu.record(line); err != nil {
+				asu.fail(asu.errPos(err), err)
 			}
+			continue
 		}
-		err = asu.addSection(d[1])
-		return false, err
-
-	case ".global":
-		if len(d) != 2 {
-			return false, errors.New("Syntax error: label not specified!")
+		toks, err := lex(line)
+		if err != nil {
+			asu.fail(asu.errPos(err), err)
+			continue
+		}
+		stmts, err := statements(line, toks)
+		if err != nil {
+			asu.fail(asu.errPos(err), err)
+			continue
 		}
-		//asu.symtab["add"].Info = byte(elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE))
 
-	case ".end":
-		return true, nil
-	}
-	return false, nil
-}
+		for k, st := range stmts {
+			asu.cols = []int{st.name.col}
+			for i := range st.ops {
+				asu.cols = append(asu.cols, st.col(i))
+			}
+			skip, err := asu.skip(st)
+			if err != nil {
+				asu.fail(asu.errPos(err), err)
+			}
+			if skip {
+				continue
+			}
 
-func (asu *asUtil) inst(d []string) {
-	b, r := rvgc.InstToBin(d)
+			for _, l := range st.labels {
+				if err := asu.addLabel(l.text); err != nil {
+					asu.fail(asu.here(l.col), err)
+				}
+			}
+			if st.name.text == "" {
+				continue
+			}
 
-	asu.obj.sections[currentSection].content = append(asu.obj.sections[currentSection].content, string(b))
+			done, err := asu.expand(st, stmts[k+1:])
+			if err != nil {
+				asu.fail(asu.errPos(err), err)
+			}
+			if done {
+				break
+			}
 
-	switch r {
-	case elf.R_RISCV_NONE:
-		break
-	case elf.R_RISCV_CALL:
-		asu.obj.sections[".strtab"].content = append(asu.obj.sections[".strtab"].content, d[1])
-		asu.symtab = append(asu.symtab, &elf.Sym64{
-			Name:  currentOffsetStr,
-			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE),
-			Shndx: 0,
-		})
-		asu.rela = append(asu.rela, &elf.Rela64{
-			Off:    currentOffset,
-			Info:   elf.R_INFO(uint32(len(asu.symtab)-1), uint32(elf.R_RISCV_CALL)),
-			Addend: 0,
-		})
-		currentOffsetStr += uint32(len(d[1]) + 1)
+			if st.name.text[0] == '.' {
+				var end bool
+				end, err = asu.dire(st)
+				if end {
+					break lines
+				}
+			} else {
+				err = asu.inst(st)
+			}
+			if err != nil {
+				asu.fail(asu.errPos(err), err)
+			}
+		}
+	}
+	if asu.rec != nil {
+		asu.fail(asu.rec.p, errors.New("Missing end of "+asu.rec.st.name.text))
+	}
+	for _, c := range asu.conds {
+		asu.fail(c.p, errors.New("Missing .endif"))
 	}
 
-	currentOffset += uint64(len(b))
+	asu.resolve()
+	return asu.result()
 }
 
-func (asu *asUtil) write(secname string, align uint64) uint64 {
-	var size uint64
-	switch secname {
-	case ".shstrtab", ".strtab":
-		for _, str := range asu.obj.sections[secname].content {
-			temp, _ := asu.objFile.WriteString(str)
-			asu.objFile.WriteString("\x00")
-			size = size + uint64(temp) + 1
-		}
-	case ".symtab":
-		for _, syment := range asu.symtab {
-			var binbuf bytes.Buffer
-			binary.Write(&binbuf, binary.LittleEndian, syment)
-			temp, _ := asu.objFile.Write(binbuf.Bytes())
-			size = size + uint64(temp)
-		}
-	case ".rela.text":
-		for _, rent := range asu.rela {
-			var binbuf bytes.Buffer
-			binary.Write(&binbuf, binary.LittleEndian, rent)
-			temp, _ := asu.objFile.Write(binbuf.Bytes())
-			size = size + uint64(temp)
+func (asu *asUtil) dire(st *stmt) (bool, error) {
+	switch st.name.text {
+	case ".section", ".pushsection", ".popsection", ".previous", ".text", ".data", ".bss", ".rodata":
+		return false, asu.section(st)
+
+	case ".globl", ".global":
+		return false, asu.bind(st, elf.STB_GLOBAL)
+	case ".local":
+		return false, asu.bind(st, elf.STB_LOCAL)
+	case ".weak":
+		return false, asu.bind(st, elf.STB_WEAK)
+	case ".hidden":
+		return false, asu.visibility(st, elf.STV_HIDDEN)
+	case ".protected":
+		return false, asu.visibility(st, elf.STV_PROTECTED)
+	case ".internal":
+		return false, asu.visibility(st, elf.STV_INTERNAL)
+	case ".type":
+		return false, asu.symType(st)
+	case ".size":
+		return false, asu.symSize(st)
+	case ".set", ".equ":
+		return false, asu.set(st)
+	case ".comm", ".lcomm":
+		return false, asu.comm(st)
+
+	case ".option":
+		if len(st.ops) != 1 {
+			return false, errors.New("Syntax error: option not specified!")
 		}
-	case ".data":
-		for _, data := range asu.obj.sections[secname].content {
-			temp, _ := asu.objFile.WriteString(data)
-			sizeAlign := uint64(temp) / align * align
-			asu.objFile.WriteString(strings.Repeat(" ", int(sizeAlign-size)))
-			size += sizeAlign
+		opt, err := st.symbolName(0)
+		if err != nil {
+			return false, err
 		}
-	case ".text":
-		for _, text := range asu.obj.sections[secname].content {
-			temp, _ := asu.objFile.WriteString(text)
-			size += uint64(temp)
+		switch opt {
+		case "rvc":
+			if !asu.isa.Has("c") {
+				asu.isa = asu.isa.With("c")
+				asu.enc.ISA = asu.isa
+			}
+			asu.rvc = true
+		case "norvc":
+			asu.rvc = false
+		default:
+			return false, &rvgc.OperandError{Index: 0, Err: errors.New("Syntax error: unknown option " + opt)}
 		}
+
+	case ".byte", ".half", ".2byte", ".short", ".word", ".4byte", ".long", ".dword", ".8byte", ".quad":
+		return false, asu.data(st)
+	case ".ascii", ".asciz", ".string":
+		return false, asu.ascii(st)
+	case ".zero", ".space", ".skip":
+		return false, asu.space(st)
+	case ".fill":
+		return false, asu.fill(st)
+	case ".align", ".p2align", ".balign":
+		return false, asu.align(st)
+
+	case ".file", ".ident":
+		// of no use without debugging information or a .comment
+
+	case ".end":
+		return true, nil
+
+	default:
+		return false, errors.New("Unknown directive " + st.name.text)
 	}
-	return size
+	return false, nil
 }
 
-func (asu *asUtil) Output(args map[string]interface{}) error {
+func (asu *asUtil) inst(st *stmt) error {
+	var d []string
+	d, asu.cols = instOperands(st)
 
-	var err error
-	asu.objFile, err = os.Create(*args["o"].(*string))
+	// add rd, rs, tp, %tprel_add(sym) only marks the add for the linker
+	var tprel *value
+	if d[0] == "add" && len(d) == 5 {
+		v, err := asu.evalOp(st, 3, asu.dot(), true)
+		if err != nil {
+			return &rvgc.OperandError{Index: 3, Err: err}
+		}
+		if v.sym == nil || v.op != "tprel_add" {
+			return errors.New("Syntax error: too many operands for add")
+		}
+		tprel = &v
+		d = d[:4]
+	}
+
+	asu.pending = value{}
+	b, r, err := asu.enc.InstToBin(d)
 	if err != nil {
 		return err
 	}
+	if asu.rvc && r == elf.R_RISCV_NONE && tprel == nil {
+		// a pseudo-instruction may have expanded to several
+		var c []byte
+		for i := 0; i < len(b); i += 4 {
+			c = append(c, asu.enc.Compress(b[i:i+4])...)
+		}
+		b = c
+	}
+	if err := asu.inSection(); err != nil {
+		return err
+	}
 
-	err = asu.addSection(".rela.text")
-
-	asu.obj.header.Shoff = uint64(asu.obj.header.Ehsize)
-	var binbuf bytes.Buffer
-	binary.Write(&binbuf, binary.LittleEndian, &asu.obj.header)
-	asu.objFile.Write(binbuf.Bytes())
+	switch {
+	case tprel != nil:
+		asu.addRela(asu.curSec, asu.loc(), *tprel, elf.R_RISCV_TPREL_ADD)
+	case r == elf.R_RISCV_NONE:
+		break
+	case r == elf.R_RISCV_BRANCH, r == elf.R_RISCV_JAL:
+		asu.fixups = append(asu.fixups, fixup{
+			sec: asu.curSec,
+			idx: len(asu.sections[asu.curSec].content),
+			off: asu.loc(),
+			v:   value{sym: asu.use(asu.pending.sym), addend: asu.pending.addend},
+			r:   r,
+			pos: asu.at(len(d) - 2),
+		})
+	case d[0] == "la", d[0] == "lla":
+		// the low half finds the high one through a label on the auipc
+		hi := ".Lpcrel_hi" + strconv.Itoa(asu.pcrelHi)
+		asu.pcrelHi++
+		if err := asu.addLabel(hi); err != nil {
+			return err
+		}
+		asu.addRela(asu.curSec, asu.loc(), asu.pending, elf.R_RISCV_PCREL_HI20)
+		asu.addRela(asu.curSec, asu.loc()+4, value{sym: asu.syms[hi]}, elf.R_RISCV_PCREL_LO12_I)
+	default:
+		asu.addRela(asu.curSec, asu.loc(), asu.pending, r)
+	}
 
-	var contentOffset uint64 = uint64(asu.obj.header.Shnum*asu.obj.header.Shentsize + asu.obj.header.Ehsize)
-	var headerOffset uint64 = uint64(asu.obj.header.Ehsize)
-	for i, name := range asu.shOrder {
-		sec := asu.obj.sections[name]
+	return asu.emit(b)
+}
 
-		asu.objFile.Seek(int64(contentOffset), 0)
-		sec.header.Size += asu.write(name, sec.header.Addralign)
-		sec.header.Off = uint64(contentOffset)
-		contentOffset += sec.header.Size
+func (asu *asUtil) Output(args map[string]interface{}) error {
 
-		if name == ".strtab" {
-			asu.obj.sections[".symtab"].header.Link = uint32(i)
-			asu.obj.sections[".symtab"].header.Info = 2
-		} else if name == ".symtab" {
-			asu.obj.sections[".rela.text"].header.Link = uint32(i)
-		} else if name == ".text" {
-			asu.obj.sections[".rela.text"].header.Info = uint32(i)
+	sections := make([]string, 0)
+	for _, name := range asu.shOrder {
+		if asu.sections[name].Type != elf.SHT_GROUP {
+			sections = append(sections, name)
 		}
+	}
+	asu.groupSignatures()
+	index, secSym := asu.buildSymtab(sections)
+	err := asu.layoutRela(index, secSym)
+	if err != nil {
+		return err
+	}
 
-		asu.objFile.Seek(int64(headerOffset), 0)
-		var binbuf bytes.Buffer
-		binary.Write(&binbuf, binary.LittleEndian, &sec.header)
-		asu.objFile.Write(binbuf.Bytes())
-		headerOffset += uint64(asu.obj.header.Shentsize)
+	for _, name := range asu.shOrder {
+		sec := asu.sections[name]
+		sec.Data = []byte(strings.Join(sec.content, ""))
+		asu.obj.Sections = append(asu.obj.Sections, sec.Section)
 	}
+	for _, name := range asu.shOrder {
+		if len(asu.rela[name]) > 0 {
+			sec := asu.sections[name]
+			sec.rela = &common.Section{
+				Name:   ".rela" + name,
+				Type:   elf.SHT_RELA,
+				Flags:  elf.SHF_INFO_LINK,
+				Info:   sec.Section,
+				Relocs: asu.rela[name],
+			}
+			asu.obj.Sections = append(asu.obj.Sections, sec.rela)
+		}
+	}
+	asu.obj.Sections = append(asu.obj.Sections, &common.Section{
+		Name:      ".riscv.attributes",
+		Type:      elf.SHT_RISCV_ATTRIBUTES,
+		Addralign: 1,
+		Data:      common.RISCVAttributes(asu.isa.String()),
+	})
+	if err := asu.linkSections(index); err != nil {
+		return err
+	}
+	asu.obj.Flags = asu.isa.ELFFlags()
 
-	asu.objFile.Close()
-	return nil
+	f, err := os.Create(*args["o"].(*string))
+	if err != nil {
+		return err
+	}
+	err = asu.obj.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
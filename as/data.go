@@ -0,0 +1,339 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package as
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/NonerKao/go-binutils/rvgc"
+)
+
+// data.go: data and alignment directives
+
+var dataSize = map[string]int{
+	".byte":  1,
+	".half":  2,
+	".2byte": 2,
+	".short": 2,
+	".word":  4,
+	".4byte": 4,
+	".long":  4,
+	".dword": 8,
+	".8byte": 8,
+	".quad":  8,
+}
+
+// inSection tells if there is a section to put code or data in
+func (asu *asUtil) inSection() error {
+	for _, sec := range internalSection {
+		if asu.curSec == sec {
+			return errors.New("Syntax error: no section for data")
+		}
+	}
+	return nil
+}
+
+// emit appends b to the current section
+func (asu *asUtil) emit(b []byte) error {
+	if err := asu.inSection(); err != nil {
+		return err
+	}
+
+	sec := asu.sections[asu.curSec]
+	if sec.Type == elf.SHT_NOBITS {
+		for _, c := range b {
+			if c != 0 {
+				return errors.New("Non-zero data in " + asu.curSec)
+			}
+		}
+		sec.Size += uint64(len(b))
+	} else {
+		sec.content = append(sec.content, string(b))
+	}
+	sec.loc += uint64(len(b))
+	return nil
+}
+
+// escapes of strings and character constants, besides octal and hex ones
+var escapes = map[byte]byte{
+	'b': '\b',
+	'f': '\f',
+	'n': '\n',
+	'r': '\r',
+	't': '\t',
+}
+
+// truncate returns the low size bytes of v, with a warning if that loses
+// anything
+func (asu *asUtil) truncate(p pos, v int64, size int) int64 {
+	if size >= 8 || v >= -1<<uint(8*size-1) && v < 1<<uint(8*size) {
+		return v
+	}
+	t := v & (1<<uint(8*size) - 1)
+	asu.warn(p, "Value 0x"+strconv.FormatUint(uint64(v), 16)+" truncated to 0x"+strconv.FormatInt(t, 16))
+	return t
+}
+
+func (asu *asUtil) data(st *stmt) error {
+	dire := st.name.text
+	if len(st.ops) == 0 {
+		return errors.New("Syntax error: no value for " + dire)
+	}
+
+	for i, op := range st.ops {
+		dot := asu.dot()
+		v, err := asu.evalOp(st, i, dot, false)
+		if err == errForward {
+			if err := asu.inSection(); err != nil {
+				return err
+			}
+			toks, _ := asu.localRefs(op)
+			asu.dataFixups = append(asu.dataFixups, dataFixup{
+				sec:  asu.curSec,
+				idx:  len(asu.sections[asu.curSec].content),
+				dot:  dot,
+				dire: dire,
+				expr: st.text(op),
+				toks: toks,
+				pos:  asu.at(i),
+			})
+			v, err = value{}, nil
+		}
+		if err != nil {
+			return &rvgc.OperandError{Index: i, Err: err}
+		}
+
+		b, err := asu.dataBytes(asu.curSec, dot.value, dire, st.text(op), v, asu.at(i))
+		if err != nil {
+			return &rvgc.OperandError{Index: i, Err: err}
+		}
+		if err := asu.emit(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dataBytes lays out v, the value of expr, for a data directive at off of
+// sec.  p is where expr is, for a warning if it has to be truncated.
+func (asu *asUtil) dataBytes(sec string, off uint64, dire, expr string, v value, p pos) ([]byte, error) {
+	size := dataSize[dire]
+	if v.op != "" {
+		return nil, errors.New("Cannot use %" + v.op + " in " + dire)
+	}
+	if v.sym != nil {
+		// the linker fills in the address
+		switch size {
+		case 4:
+			asu.addRela(sec, off, v, elf.R_RISCV_32)
+		case 8:
+			asu.addRela(sec, off, v, elf.R_RISCV_64)
+		default:
+			return nil, errors.New("Symbolic value " + expr + " does not fit in " + dire)
+		}
+		v.addend = 0
+	}
+
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(asu.truncate(p, v.addend, size)))
+	return b[:size], nil
+}
+
+// unquote resolves the escapes of a string token
+func unquote(s string) string {
+	str := make([]byte, 0)
+	s = s[1 : len(s)-1]
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			str = append(str, s[i])
+			continue
+		}
+		i++
+		if e, ok := escapes[s[i]]; ok {
+			str = append(str, e)
+			continue
+		}
+		switch c := s[i]; c {
+		case 'x', 'X':
+			j := i + 1
+			for j < len(s) && j < i+3 && strings.ContainsRune("0123456789abcdefABCDEF", rune(s[j])) {
+				j++
+			}
+			if j == i+1 {
+				str = append(str, c)
+				continue
+			}
+			v, _ := strconv.ParseUint(s[i+1:j], 16, 8)
+			str = append(str, byte(v))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+				j++
+			}
+			v, _ := strconv.ParseUint(s[i:j], 8, 16)
+			str = append(str, byte(v))
+			i = j - 1
+		default:
+			str = append(str, c)
+		}
+	}
+	return string(str)
+}
+
+// .ascii takes quoted strings; .asciz and .string end each with a zero
+func (asu *asUtil) ascii(st *stmt) error {
+	for i, op := range st.ops {
+		if len(op) != 1 || op[0].kind != tokString {
+			return &rvgc.OperandError{Index: i, Err: errors.New("Syntax error: expected a string, not " + st.text(op))}
+		}
+		str := unquote(op[0].text)
+		if st.name.text != ".ascii" {
+			str += "\x00"
+		}
+		if err := asu.emit([]byte(str)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// args returns the constant operands of a directive, with defaults for the
+// ones left out
+func (asu *asUtil) args(st *stmt, defaults ...int64) ([]int64, error) {
+	if len(st.ops) > len(defaults) {
+		return nil, errors.New("Syntax error: too many operands for " + st.name.text)
+	}
+	ret := append([]int64{}, defaults...)
+	for i := range st.ops {
+		v, err := asu.constant(st, i)
+		if err != nil {
+			return nil, &rvgc.OperandError{Index: i, Err: err}
+		}
+		ret[i] = v
+	}
+	return ret, nil
+}
+
+// .zero size, .space size[, fill]
+func (asu *asUtil) space(st *stmt) error {
+	if len(st.ops) == 0 {
+		return errors.New("Syntax error: no size for " + st.name.text)
+	}
+	a, err := asu.args(st, 0, 0)
+	if err != nil {
+		return err
+	}
+	if a[0] < 0 {
+		return errors.New("Negative size for " + st.name.text)
+	}
+	fill := byte(asu.truncate(asu.at(1), a[1], 1))
+	return asu.emit([]byte(strings.Repeat(string([]byte{fill}), int(a[0]))))
+}
+
+// .fill repeat[, size[, value]]
+func (asu *asUtil) fill(st *stmt) error {
+	if len(st.ops) == 0 {
+		return errors.New("Syntax error: no repeat count for .fill")
+	}
+	a, err := asu.args(st, 0, 1, 0)
+	if err != nil {
+		return err
+	}
+	if a[0] < 0 || a[1] < 0 || a[1] > 8 {
+		return errors.New("Bad repeat count or size for .fill")
+	}
+
+	// the value is four bytes wide; larger sizes get zeroes above it
+	b := make([]byte, 8)
+	size := int(a[1])
+	if size > 4 {
+		size = 4
+	}
+	binary.LittleEndian.PutUint32(b, uint32(asu.truncate(asu.at(2), a[2], size)))
+	for i := int64(0); i < a[0]; i++ {
+		if err := asu.emit(b[:a[1]]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// .align and .p2align take a power of two, .balign a byte count.  Both
+// may be followed by a fill byte and the most padding allowed.
+func (asu *asUtil) align(st *stmt) error {
+	if len(st.ops) == 0 {
+		return errors.New("Syntax error: no alignment for " + st.name.text)
+	}
+	a, err := asu.args(st, 0, -1, 0)
+	if err != nil {
+		return err
+	}
+
+	n := a[0]
+	if st.name.text != ".balign" {
+		if n < 0 || n > 16 {
+			return errors.New("Alignment too large for " + st.name.text)
+		}
+		n = 1 << uint(n)
+	}
+	if n <= 0 || n&(n-1) != 0 {
+		return errors.New("Alignment is not a power of two")
+	}
+
+	pad := (uint64(n) - asu.loc()%uint64(n)) % uint64(n)
+	if a[2] > 0 && pad > uint64(a[2]) {
+		return nil
+	}
+	if err := asu.inSection(); err != nil {
+		return err
+	}
+	sec := asu.sections[asu.curSec]
+	if sec.Addralign < uint64(n) {
+		sec.Addralign = uint64(n)
+	}
+
+	if a[1] >= 0 || sec.Flags&elf.SHF_EXECINSTR == 0 {
+		fill := byte(0)
+		if a[1] >= 0 {
+			fill = byte(asu.truncate(asu.at(1), a[1], 1))
+		}
+		return asu.emit([]byte(strings.Repeat(string([]byte{fill}), int(pad))))
+	}
+
+	// code is padded with nops, after zeroes up to the first halfword
+	b := make([]byte, pad%2)
+	pad -= pad % 2
+	nop, _, _ := asu.enc.InstToBin([]string{"addi", "zero", "zero", "0"})
+	if pad%4 != 0 {
+		if asu.rvc {
+			b = append(b, asu.enc.Compress(nop)...)
+		} else {
+			b = append(b, 0, 0)
+		}
+		pad -= 2
+	}
+	for ; pad > 0; pad -= 4 {
+		b = append(b, nop...)
+	}
+	return asu.emit(b)
+}
@@ -0,0 +1,112 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package as
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/NonerKao/go-binutils/rvgc"
+)
+
+// diag.go: errors and warnings, by place in the source
+
+// pos is a place in the source; col is 0 when it is the whole line.  via
+// lists the macro invocations it was expanded from, the innermost first.
+type pos struct {
+	file string
+	line int
+	col  int
+	via  []string
+}
+
+// errorAt is an error at a column of the current line
+type errorAt struct {
+	col int
+	err error
+}
+
+func (e *errorAt) Error() string {
+	return e.err.Error()
+}
+
+// here returns the place of column col of the current line
+func (asu *asUtil) here(col int) pos {
+	return pos{file: asu.filename, line: asu.line, col: col, via: asu.via}
+}
+
+// at returns the place of operand i of the current line, or of its first
+// word for -1
+func (asu *asUtil) at(i int) pos {
+	if i+1 >= len(asu.cols) {
+		i = -1
+	}
+	return asu.here(asu.cols[i+1])
+}
+
+// errPos returns where err points in the current line: the operand it is
+// about, if it tells, or else the first word
+func (asu *asUtil) errPos(err error) pos {
+	switch e := err.(type) {
+	case *rvgc.OperandError:
+		return asu.at(e.Index)
+	case *errorAt:
+		return asu.here(e.col)
+	}
+	return asu.at(-1)
+}
+
+func (asu *asUtil) report(p pos, kind, msg string) {
+	where := p.file + ":" + strconv.Itoa(p.line)
+	if p.col > 0 {
+		where += ":" + strconv.Itoa(p.col)
+	}
+	fmt.Fprintln(os.Stderr, where+": "+kind+": "+msg)
+	for _, v := range p.via {
+		fmt.Fprintln(os.Stderr, v+": info: macro invoked from here")
+	}
+}
+
+// fail reports an error; assembly goes on to find more of them, but no
+// object is written
+func (asu *asUtil) fail(p pos, err error) {
+	asu.errors++
+	asu.report(p, "error", err.Error())
+}
+
+// warn reports a warning, an error under -Werror
+func (asu *asUtil) warn(p pos, msg string) {
+	if asu.werror {
+		asu.fail(p, errors.New(msg))
+		return
+	}
+	asu.report(p, "warning", msg)
+}
+
+// result tells whether any error has been reported
+func (asu *asUtil) result() error {
+	switch asu.errors {
+	case 0:
+		return nil
+	case 1:
+		return errors.New("1 error")
+	}
+	return errors.New(strconv.Itoa(asu.errors) + " errors")
+}
@@ -0,0 +1,415 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package as
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/NonerKao/go-binutils/rvgc"
+)
+
+// expr.go: expressions in operands and directives
+
+// value is what an expression comes to: a constant, or a symbol plus an
+// addend for the linker to fill in.  op is the relocation operator around
+// it, such as "hi" for %hi(sym).
+type value struct {
+	sym    *symbol // nil for a constant
+	addend int64
+	op     string
+}
+
+var relocOps = map[string]bool{
+	"hi":        true,
+	"lo":        true,
+	"pcrel_hi":  true,
+	"pcrel_lo":  true,
+	"tprel_hi":  true,
+	"tprel_lo":  true,
+	"tprel_add": true,
+}
+
+// binary operators from the loosest to the tightest binding, ranked as GNU
+// as does
+var binaryOps = [][]string{
+	{"||"},
+	{"&&"},
+	{"+", "-", "==", "!=", "<>", "<", ">", "<=", ">="},
+	{"&", "|", "^"},
+	{"*", "/", "%", "<<", ">>"},
+}
+
+// errForward is a difference of symbols not all defined yet
+var errForward = errors.New("forward reference")
+
+type exprParser struct {
+	asu   *asUtil
+	s     string // the source, for messages
+	toks  []token
+	pos   int
+	dot   *symbol
+	final bool
+}
+
+// eval evaluates the expression s, with "." standing for dot.  Unless
+// final, it gives errForward for symbols that may be defined later.
+func (asu *asUtil) eval(s string, dot *symbol, final bool) (value, error) {
+	toks, err := lex(s)
+	if e, ok := err.(*errorAt); ok {
+		return value{}, e.err
+	}
+	return asu.evalTokens(s, toks, dot, final)
+}
+
+// evalOp evaluates operand i of a directive
+func (asu *asUtil) evalOp(st *stmt, i int, dot *symbol, final bool) (value, error) {
+	return asu.evalTokens(st.text(st.ops[i]), st.ops[i], dot, final)
+}
+
+func (asu *asUtil) evalTokens(s string, toks []token, dot *symbol, final bool) (value, error) {
+	toks, err := asu.localRefs(toks)
+	if err != nil {
+		return value{}, err
+	}
+	p := &exprParser{asu: asu, s: s, toks: toks, dot: dot, final: final}
+	v, err := p.binary(0)
+	if err != nil {
+		return value{}, err
+	}
+	if p.pos < len(p.toks) {
+		return value{}, errors.New("Syntax error in expression " + s)
+	}
+	return v, nil
+}
+
+// constant evaluates operand i of a directive, which has to come to a
+// number
+func (asu *asUtil) constant(st *stmt, i int) (int64, error) {
+	v, err := asu.evalOp(st, i, asu.dot(), true)
+	if err != nil {
+		return 0, err
+	}
+	if v.sym != nil || v.op != "" {
+		return 0, errors.New("Expression " + st.text(st.ops[i]) + " is not a constant")
+	}
+	return v.addend, nil
+}
+
+// loc returns the location counter of the current section, 0 outside
+// any section
+func (asu *asUtil) loc() uint64 {
+	if sec, ok := asu.sections[asu.curSec]; ok {
+		return sec.loc
+	}
+	return 0
+}
+
+// dot returns the location counter as a symbol
+func (asu *asUtil) dot() *symbol {
+	return &symbol{name: ".", sec: asu.curSec, value: asu.loc()}
+}
+
+// use enters a symbol an expression refers to into the symbol table
+func (asu *asUtil) use(s *symbol) *symbol {
+	if s.name == "." {
+		return s
+	}
+	return asu.symbol(s.name)
+}
+
+// immediate evaluates an instruction operand for rvgc.  The value of one
+// left to a relocation is kept in pending for inst.
+func (asu *asUtil) immediate(op string) (rvgc.Imm, error) {
+	v, err := asu.eval(op, asu.dot(), true)
+	if err != nil {
+		return rvgc.Imm{}, err
+	}
+	if v.sym == nil {
+		return rvgc.Imm{Value: v.addend, Constant: true}, nil
+	}
+	asu.pending = v
+	return rvgc.Imm{Op: v.op}, nil
+}
+
+// next consumes the punctuation tok if it comes next
+func (p *exprParser) next(tok string) bool {
+	if p.pos < len(p.toks) && p.toks[p.pos].is(tok) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) binary(rank int) (value, error) {
+	if rank == len(binaryOps) {
+		return p.unary()
+	}
+	l, err := p.binary(rank + 1)
+	if err != nil {
+		return value{}, err
+	}
+	for {
+		op := ""
+		for _, o := range binaryOps[rank] {
+			if p.next(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return l, nil
+		}
+
+		r, err := p.binary(rank + 1)
+		if err != nil {
+			return value{}, err
+		}
+		l, err = p.apply(op, l, r)
+		if err != nil {
+			return value{}, err
+		}
+	}
+}
+
+func (p *exprParser) unary() (value, error) {
+	for _, op := range []string{"-", "~", "+"} {
+		if !p.next(op) {
+			continue
+		}
+		v, err := p.unary()
+		if err != nil || op == "+" {
+			return v, err
+		}
+		if v.sym != nil || v.op != "" {
+			return value{}, errors.New("Cannot apply " + op + " to a symbol in " + p.s)
+		}
+		if op == "-" {
+			v.addend = -v.addend
+		} else {
+			v.addend = ^v.addend
+		}
+		return v, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (value, error) {
+	switch {
+	case len(p.toks) == 0:
+		return value{}, errors.New("Syntax error: missing operand")
+	case p.pos == len(p.toks):
+		return value{}, errors.New("Syntax error: missing operand in " + p.s)
+	}
+
+	t := p.toks[p.pos]
+	switch {
+	case t.is("("), t.is("%"):
+		p.pos++
+		op := ""
+		if t.is("%") {
+			if p.pos < len(p.toks) {
+				op = p.toks[p.pos].text
+				p.pos++
+			}
+			if !relocOps[op] {
+				return value{}, errors.New("Unknown relocation operator %" + op)
+			}
+			if !p.next("(") {
+				return value{}, errors.New("Syntax error: missing ( in " + p.s)
+			}
+		}
+		v, err := p.binary(0)
+		if err != nil {
+			return value{}, err
+		}
+		if !p.next(")") {
+			return value{}, errors.New("Syntax error: missing ) in " + p.s)
+		}
+		if op == "" {
+			return v, nil
+		}
+		return p.reloc(op, v)
+
+	case t.kind == tokNumber && t.text[0] == '\'':
+		p.pos++
+		return value{addend: int64(char(t.text))}, nil
+
+	case t.kind == tokNumber:
+		p.pos++
+		n, err := strconv.ParseUint(t.text, 0, 64)
+		if err != nil || strings.Contains(t.text, "_") {
+			return value{}, errors.New("Syntax error: bad number " + t.text)
+		}
+		return value{addend: int64(n)}, nil
+
+	case t.kind != tokIdent && t.kind != tokRegister:
+		return value{}, errors.New("Syntax error in expression " + p.s)
+	}
+
+	p.pos++
+	if t.text == "." {
+		return value{sym: p.dot}, nil
+	}
+	s, ok := p.asu.syms[t.text]
+	if !ok {
+		// entered into the table only once something refers to it
+		s = &symbol{name: t.text}
+	}
+	if s.sec == absSection {
+		return value{addend: int64(s.value)}, nil
+	}
+	return value{sym: s}, nil
+}
+
+// char returns the value of a character constant, 'c' or just 'c as GNU
+// as has it
+func char(text string) byte {
+	c := text[1]
+	if c == '\\' && len(text) > 2 {
+		c = text[2]
+		if e, ok := escapes[c]; ok {
+			c = e
+		}
+	}
+	return c
+}
+
+// reloc applies a relocation operator.  Those of the halves of a constant
+// are worked out at once.
+func (p *exprParser) reloc(op string, v value) (value, error) {
+	if v.op != "" {
+		return value{}, errors.New("Cannot apply %" + op + " to %" + v.op)
+	}
+	if v.sym != nil {
+		v.op = op
+		return v, nil
+	}
+	switch op {
+	case "hi":
+		return value{addend: (v.addend + 0x800) >> 12 & 0xfffff}, nil
+	case "lo":
+		return value{addend: v.addend << 52 >> 52}, nil
+	}
+	return value{}, errors.New("%" + op + " takes a symbol")
+}
+
+func (p *exprParser) apply(op string, l, r value) (value, error) {
+	if l.op != "" || r.op != "" {
+		return value{}, errors.New("Cannot apply " + op + " to a relocation operator in " + p.s)
+	}
+
+	switch {
+	case l.sym == nil && r.sym == nil:
+		v, err := arith(op, l.addend, r.addend)
+		return value{addend: v}, err
+	case op == "+" && r.sym == nil:
+		l.addend += r.addend
+		return l, nil
+	case op == "+" && l.sym == nil:
+		r.addend += l.addend
+		return r, nil
+	case op == "-" && r.sym == nil:
+		l.addend -= r.addend
+		return l, nil
+	case op == "-" && l.sym != nil:
+		return p.difference(l, r)
+	}
+
+	s := l.sym
+	if s == nil {
+		s = r.sym
+	}
+	return value{}, errors.New("Cannot apply " + op + " to symbol " + s.written())
+}
+
+// difference subtracts two symbols, which have to be of the same section
+func (p *exprParser) difference(l, r value) (value, error) {
+	for _, s := range []*symbol{l.sym, r.sym} {
+		if s.sec == "" {
+			if !p.final {
+				return value{}, errForward
+			}
+			return value{}, errors.New("Cannot evaluate " + p.s + ": symbol " + s.written() + " is not defined")
+		}
+	}
+	if l.sym.sec != r.sym.sec || l.sym.sec == commonSection {
+		return value{}, errors.New("Cannot subtract " + r.sym.written() + " from " + l.sym.written() + " of another section")
+	}
+	return value{addend: int64(l.sym.value) - int64(r.sym.value) + l.addend - r.addend}, nil
+}
+
+func arith(op string, l, r int64) (int64, error) {
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/", "%":
+		if r == 0 {
+			return 0, errors.New("Division by zero")
+		}
+		if op == "/" {
+			return l / r, nil
+		}
+		return l % r, nil
+	case "<<", ">>":
+		if r < 0 || r > 63 {
+			return 0, nil
+		}
+		if op == "<<" {
+			return l << uint(r), nil
+		}
+		return int64(uint64(l) >> uint(r)), nil
+	case "&":
+		return l & r, nil
+	case "|":
+		return l | r, nil
+	case "^":
+		return l ^ r, nil
+	case "&&":
+		return truth(l != 0 && r != 0, 1), nil
+	case "||":
+		return truth(l != 0 || r != 0, 1), nil
+	case "==":
+		return truth(l == r, -1), nil
+	case "!=", "<>":
+		return truth(l != r, -1), nil
+	case "<":
+		return truth(l < r, -1), nil
+	case ">":
+		return truth(l > r, -1), nil
+	case "<=":
+		return truth(l <= r, -1), nil
+	case ">=":
+		return truth(l >= r, -1), nil
+	}
+	return 0, errors.New("Unknown operator " + op)
+}
+
+// truth gives t for true and 0 for false; comparisons come to -1 when
+// true, as in GNU as, and logical operators to 1
+func truth(b bool, t int64) int64 {
+	if b {
+		return t
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package as
+
+import (
+	"testing"
+)
+
+// a .text of 8 bytes, with start and a numeric label 1 at 0, and end and 1
+// again at 8; k is a constant and ext undefined
+func evalState(t *testing.T) *asUtil {
+	asu := New()
+	if err := asu.addSection(".text"); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{"start", "1"} {
+		if err := asu.addLabel(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	asu.emit(make([]byte, 8))
+	for _, l := range []string{"end", "1"} {
+		if err := asu.addLabel(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k := asu.symbol("k")
+	k.sec, k.value = absSection, 5
+	return asu
+}
+
+var evalTests = []struct {
+	expr   string
+	sym    string // "" for a constant
+	addend int64
+	op     string
+	err    bool
+}{
+	{expr: "1+2*3", addend: 7},
+	{expr: "(1+2)*3", addend: 9},
+	{expr: "1 << 4 | 1", addend: 17},
+	{expr: "-1 >> 60", addend: 15},
+	{expr: "7 % 4 - ~0", addend: 4},
+	{expr: "3 > 2", addend: -1},
+	{expr: "1 && 0 || 2", addend: 1},
+	{expr: "'a' + 1", addend: 98},
+	{expr: "k * 2", addend: 10},
+	{expr: "end - start", addend: 8},
+	{expr: ". - start", addend: 8},
+	{expr: "1b - start", addend: 8},
+	{expr: "end - 1b", addend: 0},
+	{expr: "%hi(0x12345fff)", addend: 0x12346},
+	{expr: "%lo(0x12345fff)", addend: -1},
+	{expr: "ext + 4", sym: "ext", addend: 4},
+	{expr: "4 + start", sym: "start", addend: 4},
+	{expr: "%pcrel_hi(ext)", sym: "ext", op: "pcrel_hi"},
+	{expr: "1f", sym: ".L1^B3"},
+	{expr: "1 / 0", err: true},
+	{expr: "ext - start", err: true},
+	{expr: "start * 2", err: true},
+	{expr: "%hi(%lo(ext))", err: true},
+	{expr: "2b", err: true},
+	{expr: "(1", err: true},
+}
+
+func TestEval(t *testing.T) {
+	asu := evalState(t)
+	for _, tt := range evalTests {
+		v, err := asu.eval(tt.expr, asu.dot(), true)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		sym := ""
+		if v.sym != nil {
+			sym = v.sym.name
+		}
+		if sym != tt.sym || v.addend != tt.addend || v.op != tt.op {
+			t.Errorf("%s = %s%+d %s, want %s%+d %s", tt.expr, sym, v.addend, v.op, tt.sym, tt.addend, tt.op)
+		}
+	}
+}
+
+// a difference of labels not defined yet waits for them unless final
+func TestEvalForward(t *testing.T) {
+	asu := evalState(t)
+	if _, err := asu.eval("later - start", asu.dot(), false); err != errForward {
+		t.Errorf("later - start: %v, want %v", err, errForward)
+	}
+	if _, err := asu.eval("later - start", asu.dot(), true); err == nil || err == errForward {
+		t.Errorf("later - start: %v, want an error", err)
+	}
+}
@@ -0,0 +1,226 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package as
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/NonerKao/go-binutils/rvgc"
+)
+
+// lex.go: the tokens of a line, and the statements they make up
+
+type tokKind int
+
+const (
+	tokIdent tokKind = iota
+	tokRegister
+	tokNumber
+	tokString
+	tokPunct
+)
+
+// token is a piece of a line, with the column it starts at
+type token struct {
+	kind tokKind
+	text string
+	col  int
+}
+
+// is reports whether t is the punctuation p
+func (t token) is(p string) bool {
+	return t.kind == tokPunct && t.text == p
+}
+
+// the punctuation of more than one character
+var operators = []string{"<<", ">>", "==", "!=", "<>", "<=", ">=", "&&", "||"}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '.' || c == '$' || c >= '0' && c <= '9' ||
+		c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// lex splits a line into tokens.  A comment, from # or // on, is dropped.
+func lex(line string) ([]token, error) {
+	toks := make([]token, 0)
+	for i := 0; i < len(line); {
+		c := line[i]
+		start := i
+		var kind tokKind
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			continue
+
+		case c == '#' || strings.HasPrefix(line[i:], "//"):
+			return toks, nil
+
+		case c == '"':
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(line) {
+				return nil, &errorAt{col: start + 1, err: errors.New("Unterminated string")}
+			}
+			i++
+			kind = tokString
+
+		case c == '\'':
+			// 'c', or 'c without the closing quote as GNU as has it
+			i++
+			if i < len(line) && line[i] == '\\' {
+				i++
+			}
+			if i >= len(line) {
+				return nil, &errorAt{col: start + 1, err: errors.New("Missing character after '")}
+			}
+			i++
+			if i < len(line) && line[i] == '\'' {
+				i++
+			}
+			kind = tokNumber
+
+		case c >= '0' && c <= '9':
+			for i < len(line) && isNameChar(line[i]) && line[i] != '.' && line[i] != '$' {
+				i++
+			}
+			kind = tokNumber
+
+		case isNameChar(c):
+			for i < len(line) && isNameChar(line[i]) {
+				i++
+			}
+			kind = tokIdent
+			if rvgc.IsRegister(line[start:i]) {
+				kind = tokRegister
+			}
+
+		default:
+			i++
+			for _, op := range operators {
+				if strings.HasPrefix(line[start:], op) {
+					i = start + len(op)
+					break
+				}
+			}
+			kind = tokPunct
+		}
+		toks = append(toks, token{kind: kind, text: line[start:i], col: start + 1})
+	}
+	return toks, nil
+}
+
+// stmt is a statement: the labels in front, then a directive or an
+// instruction with its operands, each a run of tokens.  name is empty for
+// a statement of labels only.
+type stmt struct {
+	line   string
+	labels []token
+	name   token
+	ops    [][]token
+}
+
+// statements splits the tokens of line at semicolons into statements
+func statements(line string, toks []token) ([]*stmt, error) {
+	ret := make([]*stmt, 0)
+	for len(toks) > 0 {
+		end := len(toks)
+		for i, t := range toks {
+			if t.is(";") {
+				end = i
+				break
+			}
+		}
+		seg := toks[:end]
+		if end < len(toks) {
+			end++
+		}
+		toks = toks[end:]
+
+		st := &stmt{line: line}
+		for len(seg) >= 2 && seg[0].kind != tokPunct && seg[0].kind != tokString && seg[1].is(":") {
+			st.labels = append(st.labels, seg[0])
+			seg = seg[2:]
+		}
+		if len(seg) > 0 {
+			if seg[0].kind != tokIdent {
+				return nil, &errorAt{col: seg[0].col, err: errors.New("Syntax error: unexpected " + seg[0].text)}
+			}
+			st.name = seg[0]
+			st.ops = operands(seg[1:])
+		}
+		if len(st.labels) > 0 || st.name.text != "" {
+			ret = append(ret, st)
+		}
+	}
+	return ret, nil
+}
+
+// operands splits tokens at the commas outside parentheses
+func operands(toks []token) [][]token {
+	ops := make([][]token, 0)
+	if len(toks) == 0 {
+		return ops
+	}
+	depth, start := 0, 0
+	for i, t := range toks {
+		switch {
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		case t.is(",") && depth == 0:
+			ops = append(ops, toks[start:i])
+			start = i + 1
+		}
+	}
+	return append(ops, toks[start:])
+}
+
+// text returns the source of an operand, as written
+func (st *stmt) text(op []token) string {
+	if len(op) == 0 {
+		return ""
+	}
+	last := op[len(op)-1]
+	return st.line[op[0].col-1 : last.col-1+len(last.text)]
+}
+
+// col returns where operand i starts, or the statement for -1 or an
+// operand left empty
+func (st *stmt) col(i int) int {
+	if i < 0 || i >= len(st.ops) || len(st.ops[i]) == 0 {
+		return st.name.col
+	}
+	return st.ops[i][0].col
+}
+
+// symbolName returns operand i, which has to be a single name
+func (st *stmt) symbolName(i int) (string, error) {
+	if i >= len(st.ops) {
+		return "", errors.New("Syntax error: too few operands for " + st.name.text)
+	}
+	op := st.ops[i]
+	if len(op) != 1 || op[0].kind != tokIdent && op[0].kind != tokRegister {
+		return "", &rvgc.OperandError{Index: i, Err: errors.New("Syntax error: expected a name, not " + st.text(op))}
+	}
+	return op[0].text, nil
+}
@@ -0,0 +1,117 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package as
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NonerKao/go-binutils/ld"
+)
+
+// assemble assembles src into an object of dir, as as -march=rv64g does
+func assemble(t *testing.T, src, dir string) string {
+	obj := filepath.Join(dir, strings.TrimSuffix(filepath.Base(src), ".s")+".o")
+	march, werror := "rv64g", false
+	args := map[string]interface{}{
+		"o":      &obj,
+		"march":  &march,
+		"Werror": &werror,
+		"I":      new(includeDirs),
+	}
+
+	asu := New()
+	if err := asu.Init(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := asu.Run(args); err != nil {
+		t.Fatal(src, err)
+	}
+	if err := asu.Output(args); err != nil {
+		t.Fatal(src, err)
+	}
+	return obj
+}
+
+// TestLink assembles and links tests/add, then follows what ld made of the
+// relocations: the call of add in the other object, and the la of buf in
+// .data
+func TestLink(t *testing.T) {
+	dir := t.TempDir()
+	objs := []string{
+		assemble(t, "../tests/add/start.s", dir),
+		assemble(t, "../tests/add/add.s", dir),
+	}
+
+	// ld takes its inputs from the command line
+	if err := flag.CommandLine.Parse(objs); err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(dir, "add")
+	base, entry := "0x10000", "_start"
+	args := map[string]interface{}{"o": &exe, "Ttext": &base, "e": &entry}
+	ldu := ld.New()
+	if err := ldu.Init(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := ldu.Run(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := ldu.Output(args); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	syms, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := make(map[string]uint64)
+	for _, s := range syms {
+		addr[s.Name] = s.Value
+	}
+	if f.Entry != addr["_start"] || f.Entry != 0x10000 {
+		t.Errorf("entry 0x%x, _start at 0x%x", f.Entry, addr["_start"])
+	}
+
+	text := f.Section(".text")
+	code, err := text.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the address an auipc at a and the instruction after it come to
+	pcrel := func(a uint64) uint64 {
+		hi := binary.LittleEndian.Uint32(code[a-text.Addr:])
+		lo := binary.LittleEndian.Uint32(code[a-text.Addr+4:])
+		return a + uint64(int64(int32(hi&0xfffff000))+int64(int32(lo)>>20))
+	}
+	if got := pcrel(addr["_start"] + 8); got != addr["add"] {
+		t.Errorf("call add goes to 0x%x, add is at 0x%x", got, addr["add"])
+	}
+	if got := pcrel(addr["_start"] + 20); got != addr["buf"] || f.Section(".data").Addr != got {
+		t.Errorf("la t0, buf loads 0x%x, buf is at 0x%x", got, addr["buf"])
+	}
+}
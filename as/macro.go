@@ -0,0 +1,600 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package as
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// macro.go: macros, repetitions, conditionals and .include, all worked
+// out on the lines in front of the statements
+
+// how deep macros and included files may nest
+const maxFrames = 100
+
+// frame is a source of lines: a file, or the expansion of a macro or a
+// repetition.  The lines of an expansion keep the numbers they had where
+// they were written.
+type frame struct {
+	file  string
+	lines []string
+	nums  []int
+	next  int
+	via   []string
+	macro bool // ends early at .exitm
+	conds int  // how many conditionals were open when it began
+}
+
+// includeDirs are the directories of -I, to look for .include files in
+type includeDirs []string
+
+func (d *includeDirs) String() string {
+	return strings.Join(*d, ":")
+}
+
+func (d *includeDirs) Set(s string) error {
+	*d = append(*d, s)
+	return nil
+}
+
+type macroParam struct {
+	name   string
+	def    string
+	req    bool
+	vararg bool
+}
+
+type macro struct {
+	name   string
+	params []macroParam
+	file   string
+	lines  []string
+	nums   []int
+}
+
+// recording collects the body of a .macro, .rept, .irp or .irpc up to the
+// .endm or .endr that closes it
+type recording struct {
+	st     *stmt
+	p      pos
+	depth  int
+	macro  *macro
+	count  int64
+	param  string
+	values []string
+	lines  []string
+	nums   []int
+}
+
+// cond is an open conditional
+type cond struct {
+	p       pos
+	outer   bool // the enclosing lines are assembled
+	active  bool // the lines of the current branch are assembled
+	taken   bool // some branch has been assembled
+	sawElse bool
+}
+
+var conditionals = map[string]bool{
+	".if": true, ".ifne": true, ".ifeq": true,
+	".ifgt": true, ".ifge": true, ".iflt": true, ".ifle": true,
+	".ifdef": true, ".ifndef": true, ".ifnotdef": true,
+	".ifb": true, ".ifnb": true, ".ifc": true, ".ifnc": true,
+	".elseif": true, ".else": true, ".endif": true,
+}
+
+func readLines(r io.Reader) ([]string, error) {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// pushFile makes the lines of a file the next ones to assemble
+func (asu *asUtil) pushFile(name string, r io.Reader) error {
+	lines, err := readLines(r)
+	if err != nil {
+		return err
+	}
+	nums := make([]int, len(lines))
+	for i := range nums {
+		nums[i] = i + 1
+	}
+	return asu.push(&frame{file: name, lines: lines, nums: nums, via: asu.via})
+}
+
+func (asu *asUtil) push(f *frame) error {
+	if len(asu.frames) >= maxFrames {
+		return errors.New("Macros or .include nested too deeply")
+	}
+	f.conds = len(asu.conds)
+	asu.frames = append(asu.frames, f)
+	return nil
+}
+
+// nextLine returns the next line to assemble, and makes it the current one
+// for diagnostics
+func (asu *asUtil) nextLine() (string, bool) {
+	for len(asu.frames) > 0 {
+		f := asu.frames[len(asu.frames)-1]
+		if f.next < len(f.lines) {
+			asu.filename, asu.line, asu.via = f.file, f.nums[f.next], f.via
+			f.next++
+			return f.lines[f.next-1], true
+		}
+		asu.frames = asu.frames[:len(asu.frames)-1]
+	}
+	return "", false
+}
+
+// pushRest puts back the statements of the current line after those that
+// start an expansion, so that they come after it
+func (asu *asUtil) pushRest(rest []*stmt) {
+	if len(rest) == 0 {
+		return
+	}
+	start := rest[0].name.col
+	if len(rest[0].labels) > 0 {
+		start = rest[0].labels[0].col
+	}
+	// blanked rather than cut, to keep the columns
+	line := rest[0].line
+	line = strings.Repeat(" ", start-1) + line[start-1:]
+	asu.frames = append(asu.frames, &frame{
+		file:  asu.filename,
+		lines: []string{line},
+		nums:  []int{asu.line},
+		via:   asu.via,
+		conds: len(asu.conds),
+	})
+}
+
+// skip works out the conditionals, and tells whether st is not to be
+// assembled: a conditional itself, or a statement of a branch not taken
+func (asu *asUtil) skip(st *stmt) (bool, error) {
+	name := st.name.text
+	active := len(asu.conds) == 0 || asu.conds[len(asu.conds)-1].active
+	if !conditionals[name] {
+		return !active, nil
+	}
+
+	switch name {
+	case ".elseif", ".else", ".endif":
+		if len(asu.conds) == 0 {
+			return true, errors.New("Syntax error: " + name + " without .if")
+		}
+		c := &asu.conds[len(asu.conds)-1]
+		switch {
+		case name == ".endif":
+			asu.conds = asu.conds[:len(asu.conds)-1]
+		case c.sawElse:
+			return true, errors.New("Syntax error: " + name + " after .else")
+		case name == ".else":
+			c.sawElse = true
+			c.active = c.outer && !c.taken
+			c.taken = true
+		case c.outer && !c.taken:
+			v, err := asu.condition(".if", st)
+			c.active, c.taken = v, v || err != nil
+			return true, err
+		default:
+			c.active = false
+		}
+		return true, nil
+	}
+
+	c := cond{p: asu.at(-1), outer: active}
+	var err error
+	if active {
+		c.active, err = asu.condition(name, st)
+		c.taken = c.active || err != nil
+	}
+	asu.conds = append(asu.conds, c)
+	return true, err
+}
+
+// condition evaluates the operands of a conditional
+func (asu *asUtil) condition(name string, st *stmt) (bool, error) {
+	switch name {
+	case ".ifdef", ".ifndef", ".ifnotdef":
+		if len(st.ops) != 1 {
+			return false, errors.New("Syntax error: " + name + " takes a symbol")
+		}
+		n, err := st.symbolName(0)
+		if err != nil {
+			return false, err
+		}
+		s, ok := asu.syms[n]
+		return (ok && s.sec != "") == (name == ".ifdef"), nil
+
+	case ".ifb", ".ifnb":
+		return (len(st.ops) == 0) == (name == ".ifb"), nil
+
+	case ".ifc", ".ifnc":
+		if len(st.ops) != 2 {
+			return false, errors.New("Syntax error: " + name + " takes two strings")
+		}
+		a, b := st.text(st.ops[0]), st.text(st.ops[1])
+		return (strings.Trim(a, "\"") == strings.Trim(b, "\"")) == (name == ".ifc"), nil
+	}
+
+	if len(st.ops) != 1 {
+		return false, errors.New("Syntax error: " + name + " takes an expression")
+	}
+	v, err := asu.constant(st, 0)
+	if err != nil {
+		return false, err
+	}
+	switch name {
+	case ".ifeq":
+		return v == 0, nil
+	case ".ifgt":
+		return v > 0, nil
+	case ".ifge":
+		return v >= 0, nil
+	case ".iflt":
+		return v < 0, nil
+	case ".ifle":
+		return v <= 0, nil
+	}
+	return v != 0, nil
+}
+
+// expand deals with the directives that start a macro or a repetition or
+// take lines from elsewhere, and with macro invocations.  It tells whether
+// st was one of those; the rest of the line is then put back to come
+// after what st brings in.
+func (asu *asUtil) expand(st *stmt, rest []*stmt) (bool, error) {
+	name := st.name.text
+	switch name {
+	case ".macro", ".rept", ".irp", ".irpc":
+		rec := &recording{st: st, p: asu.at(-1)}
+		var err error
+		switch name {
+		case ".macro":
+			rec.macro, err = asu.defineMacro(st)
+		case ".rept":
+			rec.count, err = asu.reptCount(st)
+		default:
+			rec.param, rec.values, err = irpValues(st)
+		}
+		asu.rec = rec
+		asu.pushRest(rest)
+		return true, err
+
+	case ".endm", ".endr":
+		asu.pushRest(rest)
+		return true, errors.New("Syntax error: " + name + " without a start")
+
+	case ".purgem":
+		asu.pushRest(rest)
+		n, err := st.symbolName(0)
+		if err != nil {
+			return true, err
+		}
+		if _, ok := asu.macros[strings.ToLower(n)]; !ok {
+			return true, errors.New("Macro " + n + " is not defined")
+		}
+		delete(asu.macros, strings.ToLower(n))
+		return true, nil
+
+	case ".exitm":
+		for i := len(asu.frames) - 1; i >= 0; i-- {
+			if asu.frames[i].macro {
+				asu.conds = asu.conds[:asu.frames[i].conds]
+				asu.frames = asu.frames[:i]
+				return true, nil
+			}
+		}
+		return true, errors.New("Syntax error: .exitm outside a macro")
+
+	case ".include":
+		if len(st.ops) != 1 || len(st.ops[0]) != 1 || st.ops[0][0].kind != tokString {
+			return true, errors.New("Syntax error: .include takes a quoted file name")
+		}
+		asu.pushRest(rest)
+		return true, asu.include(unquote(st.ops[0][0].text))
+	}
+
+	m, ok := asu.macros[strings.ToLower(name)]
+	if !ok {
+		return false, nil
+	}
+	asu.pushRest(rest)
+	args, err := m.bind(st)
+	if err != nil {
+		return true, err
+	}
+	asu.macroCount++
+	lines := make([]string, len(m.lines))
+	for i, l := range m.lines {
+		lines[i] = substitute(l, args, strconv.Itoa(asu.macroCount-1))
+	}
+	via := asu.filename + ":" + strconv.Itoa(asu.line)
+	return true, asu.push(&frame{
+		file:  m.file,
+		lines: lines,
+		nums:  m.nums,
+		via:   append([]string{via}, asu.via...),
+		macro: true,
+	})
+}
+
+// include assembles the lines of a file, found as it is named or in one
+// of the -I directories
+func (asu *asUtil) include(name string) error {
+	tries := []string{name}
+	if !filepath.IsAbs(name) {
+		for _, dir := range asu.includeDirs {
+			tries = append(tries, filepath.Join(dir, name))
+		}
+	}
+	for _, path := range tries {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		return asu.pushFile(path, f)
+	}
+	return errors.New("Cannot find include file " + name)
+}
+
+// record takes a line into the body being recorded, and expands the body
+// once it is complete
+func (asu *asUtil) record(line string) error {
+	rec := asu.rec
+	name := ""
+	if toks, err := lex(line); err == nil {
+		if stmts, err := statements(line, toks); err == nil && len(stmts) > 0 {
+			name = stmts[0].name.text
+		}
+	}
+	switch name {
+	case ".macro", ".rept", ".irp", ".irpc":
+		rec.depth++
+	case ".endm", ".endr":
+		if rec.depth == 0 {
+			asu.rec = nil
+			return asu.finish(rec, name)
+		}
+		rec.depth--
+	}
+	rec.lines = append(rec.lines, line)
+	rec.nums = append(rec.nums, asu.line)
+	return nil
+}
+
+// finish defines the macro recorded, or pushes the repetition
+func (asu *asUtil) finish(rec *recording, end string) error {
+	start := rec.st.name.text
+	if (start == ".macro") != (end == ".endm") {
+		return errors.New("Syntax error: " + end + " does not close " + start)
+	}
+
+	switch start {
+	case ".macro":
+		if rec.macro == nil {
+			return nil
+		}
+		rec.macro.lines, rec.macro.nums = rec.lines, rec.nums
+		asu.macros[strings.ToLower(rec.macro.name)] = rec.macro
+		return nil
+	case ".rept":
+		for i := int64(0); i < rec.count; i++ {
+			if err := asu.pushBody(rec, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// pushed last first, as the last pushed comes first
+	for i := len(rec.values) - 1; i >= 0; i-- {
+		args := map[string]string{rec.param: rec.values[i]}
+		if err := asu.pushBody(rec, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (asu *asUtil) pushBody(rec *recording, args map[string]string) error {
+	lines := rec.lines
+	if args != nil {
+		lines = make([]string, len(rec.lines))
+		for i, l := range rec.lines {
+			lines[i] = substitute(l, args, "")
+		}
+	}
+	return asu.push(&frame{file: rec.p.file, lines: lines, nums: rec.nums, via: rec.p.via})
+}
+
+// defineMacro reads .macro name [param[=default][:req|:vararg]]..., the
+// parameters separated by commas or spaces
+func (asu *asUtil) defineMacro(st *stmt) (*macro, error) {
+	if len(st.ops) == 0 || len(st.ops[0]) == 0 || st.ops[0][0].kind != tokIdent && st.ops[0][0].kind != tokRegister {
+		return nil, errors.New("Syntax error: .macro takes a name")
+	}
+	m := &macro{name: st.ops[0][0].text, file: asu.filename}
+	if _, ok := asu.macros[strings.ToLower(m.name)]; ok {
+		return nil, &errorAt{col: st.ops[0][0].col, err: errors.New("Macro " + m.name + " is already defined")}
+	}
+
+	for i, op := range st.ops {
+		if i == 0 {
+			op = op[1:]
+		}
+		for len(op) > 0 {
+			if op[0].kind != tokIdent && op[0].kind != tokRegister {
+				return nil, &errorAt{col: op[0].col, err: errors.New("Syntax error: bad macro parameter " + op[0].text)}
+			}
+			p := macroParam{name: op[0].text}
+			op = op[1:]
+			if len(op) >= 2 && op[0].is(":") {
+				switch op[1].text {
+				case "req":
+					p.req = true
+				case "vararg":
+					p.vararg = true
+				default:
+					return nil, &errorAt{col: op[1].col, err: errors.New("Syntax error: bad qualifier " + op[1].text)}
+				}
+				op = op[2:]
+			}
+			if len(op) > 0 && op[0].is("=") {
+				p.def = st.text(op[1:])
+				op = nil
+			}
+			m.params = append(m.params, p)
+		}
+	}
+	return m, nil
+}
+
+// bind gives each parameter of a macro its argument, by position or as
+// name=value, or else its default
+func (m *macro) bind(st *stmt) (map[string]string, error) {
+	args := make(map[string]string)
+	for _, p := range m.params {
+		args[p.name] = p.def
+	}
+
+	next := 0
+	for i, op := range st.ops {
+		if len(op) >= 2 && op[1].is("=") {
+			found := false
+			for _, p := range m.params {
+				found = found || p.name == op[0].text
+			}
+			if found {
+				args[op[0].text] = st.text(op[2:])
+				continue
+			}
+		}
+		if next >= len(m.params) {
+			return nil, &errorAt{col: st.col(i), err: errors.New("Too many arguments for macro " + m.name)}
+		}
+		p := m.params[next]
+		next++
+		if p.vararg {
+			last := st.ops[len(st.ops)-1]
+			if len(op) > 0 && len(last) > 0 {
+				args[p.name] = st.text([]token{op[0], last[len(last)-1]})
+			}
+			break
+		}
+		if len(op) > 0 {
+			args[p.name] = st.text(op)
+		}
+	}
+
+	for _, p := range m.params {
+		if p.req && args[p.name] == "" {
+			return nil, errors.New("Missing value for required parameter " + p.name + " of macro " + m.name)
+		}
+	}
+	return args, nil
+}
+
+// substitute replaces \name by the argument of the name, \@ by count,
+// unless it is empty, and drops \() that separates a name from what
+// follows
+func substitute(line string, args map[string]string, count string) string {
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] != '\\' || i+1 == len(line) {
+			b.WriteByte(line[i])
+			continue
+		}
+		switch c := line[i+1]; {
+		case c == '@' && count != "":
+			b.WriteString(count)
+			i++
+			continue
+		case strings.HasPrefix(line[i+1:], "()"):
+			i += 2
+			continue
+		case !isNameChar(c):
+			b.WriteByte('\\')
+			continue
+		}
+		j := i + 1
+		for j < len(line) && isNameChar(line[j]) {
+			j++
+		}
+		if v, ok := args[line[i+1:j]]; ok {
+			b.WriteString(v)
+			i = j - 1
+			continue
+		}
+		b.WriteByte('\\')
+	}
+	return b.String()
+}
+
+// reptCount reads .rept count
+func (asu *asUtil) reptCount(st *stmt) (int64, error) {
+	if len(st.ops) != 1 {
+		return 0, errors.New("Syntax error: .rept takes a count")
+	}
+	n, err := asu.constant(st, 0)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("Negative count for .rept")
+	}
+	return n, nil
+}
+
+// irpValues reads .irp param, value... and .irpc param, chars.  With no
+// values, the body is taken once with the parameter empty.
+func irpValues(st *stmt) (string, []string, error) {
+	if len(st.ops) == 0 {
+		return "", nil, errors.New("Syntax error: " + st.name.text + " takes a parameter")
+	}
+	param, err := st.symbolName(0)
+	if err != nil {
+		return "", nil, err
+	}
+
+	values := make([]string, 0)
+	for _, op := range st.ops[1:] {
+		values = append(values, st.text(op))
+	}
+	if st.name.text == ".irpc" {
+		chars := strings.Trim(strings.Join(values, ","), "\"")
+		values = make([]string, len(chars))
+		for i := range chars {
+			values[i] = chars[i : i+1]
+		}
+	}
+	if len(values) == 0 {
+		values = []string{""}
+	}
+	return param, values, nil
+}
@@ -0,0 +1,346 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package as
+
+import (
+	"debug/elf"
+	"errors"
+	"strings"
+
+	"github.com/NonerKao/go-binutils/common"
+	"github.com/NonerKao/go-binutils/rvgc"
+)
+
+// section.go: sections, their attributes, and the directives that switch
+// between them
+
+// the attributes of the sections known by name; .text.foo is taken as
+// .text, and so on
+var knownSections = []struct {
+	name  string
+	typ   elf.SectionType
+	flags elf.SectionFlag
+}{
+	{".text", elf.SHT_PROGBITS, elf.SHF_ALLOC | elf.SHF_EXECINSTR},
+	{".data", elf.SHT_PROGBITS, elf.SHF_ALLOC | elf.SHF_WRITE},
+	{".sdata", elf.SHT_PROGBITS, elf.SHF_ALLOC | elf.SHF_WRITE},
+	{".bss", elf.SHT_NOBITS, elf.SHF_ALLOC | elf.SHF_WRITE},
+	{".sbss", elf.SHT_NOBITS, elf.SHF_ALLOC | elf.SHF_WRITE},
+	{".rodata", elf.SHT_PROGBITS, elf.SHF_ALLOC},
+	{".srodata", elf.SHT_PROGBITS, elf.SHF_ALLOC},
+	{".tdata", elf.SHT_PROGBITS, elf.SHF_ALLOC | elf.SHF_WRITE | elf.SHF_TLS},
+	{".tbss", elf.SHT_NOBITS, elf.SHF_ALLOC | elf.SHF_WRITE | elf.SHF_TLS},
+	{".init_array", elf.SHT_INIT_ARRAY, elf.SHF_ALLOC | elf.SHF_WRITE},
+	{".fini_array", elf.SHT_FINI_ARRAY, elf.SHF_ALLOC | elf.SHF_WRITE},
+	{".preinit_array", elf.SHT_PREINIT_ARRAY, elf.SHF_ALLOC | elf.SHF_WRITE},
+	{".note", elf.SHT_NOTE, 0},
+}
+
+var sectionFlags = map[byte]elf.SectionFlag{
+	'a': elf.SHF_ALLOC,
+	'w': elf.SHF_WRITE,
+	'x': elf.SHF_EXECINSTR,
+	'M': elf.SHF_MERGE,
+	'S': elf.SHF_STRINGS,
+	'G': elf.SHF_GROUP,
+	'T': elf.SHF_TLS,
+	'o': elf.SHF_LINK_ORDER,
+}
+
+var sectionTypes = map[string]elf.SectionType{
+	"progbits":      elf.SHT_PROGBITS,
+	"nobits":        elf.SHT_NOBITS,
+	"note":          elf.SHT_NOTE,
+	"init_array":    elf.SHT_INIT_ARRAY,
+	"fini_array":    elf.SHT_FINI_ARRAY,
+	"preinit_array": elf.SHT_PREINIT_ARRAY,
+}
+
+// secAttrs are what .section says of a section besides its name
+type secAttrs struct {
+	flags   elf.SectionFlag
+	typ     elf.SectionType
+	entsize uint64
+	group   string
+	comdat  bool
+	linkTo  string
+}
+
+// sectionDefaults returns the type and flags of a section by its name;
+// others are PROGBITS with no flags
+func sectionDefaults(name string) (elf.SectionType, elf.SectionFlag) {
+	for _, k := range knownSections {
+		if name == k.name || strings.HasPrefix(name, k.name+".") {
+			return k.typ, k.flags
+		}
+	}
+	return elf.SHT_PROGBITS, 0
+}
+
+// minAlign is the alignment a section starts with: that of instructions
+// for code
+func (asu *asUtil) minAlign(flags elf.SectionFlag) uint64 {
+	switch {
+	case flags&elf.SHF_EXECINSTR == 0:
+		return 1
+	case asu.rvc:
+		return 2
+	}
+	return 4
+}
+
+// .section name[, "flags"[, @type[, entsize][, linked][, group[, comdat]]]]
+func (asu *asUtil) parseSection(st *stmt) (string, *secAttrs, error) {
+	if len(st.ops) == 0 || len(st.ops[0]) == 0 {
+		return "", nil, errors.New("Syntax error: section not specified!")
+	}
+	name := st.text(st.ops[0])
+	if len(st.ops[0]) == 1 && st.ops[0][0].kind == tokString {
+		name = unquote(name)
+	}
+	if len(st.ops) == 1 {
+		return name, nil, nil
+	}
+
+	op := st.ops[1]
+	if len(op) != 1 || op[0].kind != tokString {
+		return "", nil, &rvgc.OperandError{Index: 1, Err: errors.New("Syntax error: section flags have to be quoted")}
+	}
+	a := &secAttrs{}
+	for _, c := range []byte(unquote(op[0].text)) {
+		f, ok := sectionFlags[c]
+		if !ok {
+			return "", nil, &rvgc.OperandError{Index: 1, Err: errors.New("Unknown section flag " + string(c))}
+		}
+		a.flags |= f
+	}
+
+	i := 2
+	a.typ, _ = sectionDefaults(name)
+	if i < len(st.ops) {
+		t := strings.Trim(strings.TrimLeft(st.text(st.ops[i]), "@%"), "\"")
+		typ, ok := sectionTypes[t]
+		if !ok {
+			return "", nil, &rvgc.OperandError{Index: i, Err: errors.New("Unknown section type " + st.text(st.ops[i]))}
+		}
+		a.typ = typ
+		i++
+	} else if a.flags&(elf.SHF_MERGE|elf.SHF_GROUP|elf.SHF_LINK_ORDER) != 0 {
+		return "", nil, errors.New("Syntax error: missing section type for " + name)
+	}
+
+	// the operands the flags call for, in the order GNU as takes them
+	missing := func(what string) error {
+		return errors.New("Syntax error: missing " + what + " for section " + name)
+	}
+	if a.flags&elf.SHF_MERGE != 0 {
+		if i == len(st.ops) {
+			return "", nil, missing("entity size")
+		}
+		n, err := asu.constant(st, i)
+		if err != nil {
+			return "", nil, &rvgc.OperandError{Index: i, Err: err}
+		}
+		a.entsize = uint64(n)
+		i++
+	}
+	if a.flags&elf.SHF_LINK_ORDER != 0 {
+		if i == len(st.ops) {
+			return "", nil, missing("linked section")
+		}
+		a.linkTo = st.text(st.ops[i])
+		i++
+	}
+	if a.flags&elf.SHF_GROUP != 0 {
+		if i == len(st.ops) {
+			return "", nil, missing("group name")
+		}
+		g, err := st.symbolName(i)
+		if err != nil {
+			return "", nil, err
+		}
+		a.group = g
+		i++
+		if i < len(st.ops) && st.text(st.ops[i]) == "comdat" {
+			a.comdat = true
+			i++
+		}
+	}
+	if i < len(st.ops) {
+		return "", nil, &rvgc.OperandError{Index: i, Err: errors.New("Syntax error: too many operands for .section")}
+	}
+	return name, a, nil
+}
+
+// switchSection makes name the current section, adding it if it is new
+func (asu *asUtil) switchSection(name string, a *secAttrs) error {
+	for _, s := range internalSection {
+		if name == s {
+			return errors.New("Syntax error: not allowed section " + name)
+		}
+	}
+
+	prev := asu.curSec
+	if sec, ok := asu.sections[name]; ok {
+		if a != nil && (a.flags != sec.Flags || a.typ != sec.Type || a.group != sec.group) {
+			asu.warn(asu.at(-1), "Ignoring changed section attributes for "+name)
+		}
+		asu.curSec = name
+		asu.previous = prev
+		return nil
+	}
+
+	if a != nil && a.group != "" {
+		if err := asu.addGroup(a.group, a.comdat); err != nil {
+			return err
+		}
+	}
+	if err := asu.addSection(name); err != nil {
+		return err
+	}
+	asu.previous = prev
+	if a == nil {
+		return nil
+	}
+	sec := asu.sections[name]
+	sec.Flags = a.flags
+	sec.Type = a.typ
+	sec.Entsize = a.entsize
+	sec.Addralign = asu.minAlign(a.flags)
+	sec.group = a.group
+	sec.linkTo = a.linkTo
+	return nil
+}
+
+// the section of a group is known by its signature; each is called .group
+func groupKey(sig string) string {
+	return ".group " + sig
+}
+
+// addGroup adds the section of a group, ahead of its first member
+func (asu *asUtil) addGroup(sig string, comdat bool) error {
+	key := groupKey(sig)
+	if _, ok := asu.sections[key]; ok {
+		return nil
+	}
+	if err := asu.addSection(key); err != nil {
+		return err
+	}
+	sec := asu.sections[key]
+	sec.Name = ".group"
+	sec.Type = elf.SHT_GROUP
+	sec.Flags = 0
+	sec.Addralign = 4
+	sec.Entsize = 4
+	sec.group = sig
+	if comdat {
+		sec.GroupFlags = 1 // GRP_COMDAT
+	}
+	return nil
+}
+
+// groupSignatures has the signature of each group in the symbol table;
+// one not defined is taken to be the start of the first member
+func (asu *asUtil) groupSignatures() {
+	for _, name := range asu.shOrder {
+		sec := asu.sections[name]
+		if sec.group == "" || sec.Type == elf.SHT_GROUP {
+			continue
+		}
+		s := asu.symbol(sec.group)
+		if s.sec == "" {
+			s.sec, s.value = name, 0
+		}
+	}
+}
+
+// linkSections fills in the section groups, now that the symbols and the
+// relocation sections are laid out, and the links of SHF_LINK_ORDER
+func (asu *asUtil) linkSections(index map[string]*common.Symbol) error {
+	for _, name := range asu.shOrder {
+		sec := asu.sections[name]
+		switch {
+		case sec.Type == elf.SHT_GROUP:
+			sec.Signature = index[sec.group]
+
+		case sec.group != "":
+			g := asu.sections[groupKey(sec.group)]
+			g.Members = append(g.Members, sec.Section)
+			if sec.rela != nil {
+				sec.rela.Flags |= elf.SHF_GROUP
+				g.Members = append(g.Members, sec.rela)
+			}
+		}
+
+		if sec.linkTo != "" {
+			target := sec.linkTo
+			if s, ok := asu.syms[target]; ok && s.sec != "" {
+				target = s.sec
+			}
+			t, ok := asu.sections[target]
+			if !ok {
+				return errors.New("Cannot link section " + name + " to " + sec.linkTo)
+			}
+			sec.Link = t.Section
+		}
+	}
+	return nil
+}
+
+// .section and the shorthands for the usual sections
+func (asu *asUtil) section(st *stmt) error {
+	switch st.name.text {
+	case ".section":
+		name, a, err := asu.parseSection(st)
+		if err != nil {
+			return err
+		}
+		return asu.switchSection(name, a)
+
+	case ".pushsection":
+		name, a, err := asu.parseSection(st)
+		if err != nil {
+			return err
+		}
+		asu.sectionStack = append(asu.sectionStack, [2]string{asu.curSec, asu.previous})
+		return asu.switchSection(name, a)
+
+	case ".popsection":
+		n := len(asu.sectionStack)
+		if n == 0 {
+			return errors.New(".popsection without .pushsection")
+		}
+		top := asu.sectionStack[n-1]
+		asu.sectionStack = asu.sectionStack[:n-1]
+		asu.curSec = top[0]
+		asu.previous = top[1]
+		return nil
+
+	case ".previous":
+		if asu.previous == "" {
+			return errors.New("No section to go back to with .previous")
+		}
+		return asu.switchSection(asu.previous, nil)
+	}
+
+	// .text, .data, .bss and .rodata
+	if len(st.ops) > 0 {
+		return errors.New("Subsections are not supported")
+	}
+	return asu.switchSection(st.name.text, nil)
+}
@@ -0,0 +1,381 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package as
+
+import (
+	"debug/elf"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/NonerKao/go-binutils/common"
+	"github.com/NonerKao/go-binutils/rvgc"
+)
+
+// symbol.go: the symbol table and the directives that shape it
+
+type symbol struct {
+	name  string
+	sec   string // "" while undefined
+	value uint64
+	size  uint64
+	bind  elf.SymBind
+	bound bool // bind was given by a directive
+	typ   elf.SymType
+	vis   elf.SymVis
+	keep  bool // a temporary label that a relocation needs
+}
+
+// section indexes of their own for constants from .set, and for the
+// common symbols of .comm, which the linker allocates
+const (
+	absSection    = "*ABS*"
+	commonSection = "*COM*"
+)
+
+// symbol returns the symbol of the name, adding it as undefined if it has
+// not been seen before
+func (asu *asUtil) symbol(name string) *symbol {
+	if s, ok := asu.syms[name]; ok {
+		return s
+	}
+	s := &symbol{name: name, bind: elf.STB_LOCAL, typ: elf.STT_NOTYPE}
+	asu.syms[name] = s
+	asu.symOrder = append(asu.symOrder, name)
+	return s
+}
+
+// a numeric label, such as 1:, may be defined any number of times.  Each
+// definition is a temporary label of its own, named as GNU as shows it,
+// which 1b refers to until the next one and 1f until it is defined.
+func isNumeric(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// localName returns the name of definition k of numeric label n
+func localName(n string, k int) string {
+	return ".L" + n + "^B" + strconv.Itoa(k)
+}
+
+// written returns the name of s as the source has it, N: for a numeric
+// label
+func (s *symbol) written() string {
+	if i := strings.Index(s.name, "^B"); i > 0 && strings.HasPrefix(s.name, ".L") {
+		return s.name[2:i] + ":"
+	}
+	return s.name
+}
+
+// localRefs replaces the references to numeric labels in toks, Nb and Nf,
+// with the names of the definitions they stand for at this point
+func (asu *asUtil) localRefs(toks []token) ([]token, error) {
+	ret := make([]token, len(toks))
+	for i, t := range toks {
+		ret[i] = t
+		n, dir := t.text[:len(t.text)-1], t.text[len(t.text)-1]
+		if t.kind != tokNumber || !isNumeric(n) || dir != 'b' && dir != 'f' {
+			continue
+		}
+		k := asu.localLabels[n]
+		if dir == 'f' {
+			k++
+		} else if k == 0 {
+			return nil, errors.New("Backward reference to unknown label " + n + ":")
+		}
+		ret[i] = token{kind: tokIdent, text: localName(n, k), col: t.col}
+	}
+	return ret, nil
+}
+
+func (asu *asUtil) addLabel(lab string) error {
+	if isNumeric(lab) {
+		asu.localLabels[lab]++
+		lab = localName(lab, asu.localLabels[lab])
+	}
+	s := asu.symbol(lab)
+	if s.sec != "" {
+		return errors.New("Symbol " + lab + " is already defined")
+	}
+	s.sec = asu.curSec
+	s.value = asu.loc()
+	return nil
+}
+
+// temporary labels stay out of the symbol table, unless the linker has to
+// find the auipc of a %pcrel_lo through one
+func (s *symbol) emitted() bool {
+	return !strings.HasPrefix(s.name, ".L") || s.keep
+}
+
+// names returns the comma-separated symbol names of a directive
+func names(st *stmt) ([]string, error) {
+	if len(st.ops) == 0 {
+		return nil, errors.New("Syntax error: no symbol for " + st.name.text)
+	}
+	ret := make([]string, len(st.ops))
+	for i := range st.ops {
+		n, err := st.symbolName(i)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = n
+	}
+	return ret, nil
+}
+
+func (asu *asUtil) bind(st *stmt, bind elf.SymBind) error {
+	ns, err := names(st)
+	if err != nil {
+		return err
+	}
+	for _, n := range ns {
+		s := asu.symbol(n)
+		s.bind = bind
+		s.bound = true
+	}
+	return nil
+}
+
+func (asu *asUtil) visibility(st *stmt, vis elf.SymVis) error {
+	ns, err := names(st)
+	if err != nil {
+		return err
+	}
+	for _, n := range ns {
+		asu.symbol(n).vis = vis
+	}
+	return nil
+}
+
+var symTypes = map[string]elf.SymType{
+	"function":   elf.STT_FUNC,
+	"object":     elf.STT_OBJECT,
+	"notype":     elf.STT_NOTYPE,
+	"tls_object": elf.STT_TLS,
+}
+
+// .type sym, @function; "%function", "function" and "STT_FUNC" do as well
+func (asu *asUtil) symType(st *stmt) error {
+	if len(st.ops) != 2 {
+		return errors.New("Syntax error: .type takes a symbol and a type")
+	}
+	name, err := st.symbolName(0)
+	if err != nil {
+		return err
+	}
+	text := st.text(st.ops[1])
+	t := strings.TrimLeft(text, "@%")
+	t = strings.ToLower(strings.TrimPrefix(t, "STT_"))
+	if t == "tls" {
+		t = "tls_object"
+	}
+	typ, ok := symTypes[strings.Trim(t, "\"")]
+	if !ok {
+		return &rvgc.OperandError{Index: 1, Err: errors.New("Unknown symbol type " + text)}
+	}
+	asu.symbol(name).typ = typ
+	return nil
+}
+
+func (asu *asUtil) symSize(st *stmt) error {
+	if len(st.ops) != 2 {
+		return errors.New("Syntax error: .size takes a symbol and a size")
+	}
+	name, err := st.symbolName(0)
+	if err != nil {
+		return err
+	}
+	v, err := asu.constant(st, 1)
+	if err != nil {
+		return &rvgc.OperandError{Index: 1, Err: err}
+	}
+	asu.symbol(name).size = uint64(v)
+	return nil
+}
+
+// .set sym, expr and .equ sym, expr; the expression comes to a constant,
+// or to a place in a section, defined before
+func (asu *asUtil) set(st *stmt) error {
+	dire := st.name.text
+	if len(st.ops) != 2 {
+		return errors.New("Syntax error: " + dire + " takes a symbol and a value")
+	}
+	name, err := st.symbolName(0)
+	if err != nil {
+		return err
+	}
+	v, err := asu.evalOp(st, 1, asu.dot(), true)
+	if err != nil {
+		return &rvgc.OperandError{Index: 1, Err: err}
+	}
+
+	s := asu.symbol(name)
+	switch {
+	case v.op != "":
+		return errors.New("Cannot use %" + v.op + " in " + dire)
+	case v.sym != nil && v.sym.sec == commonSection:
+		return &rvgc.OperandError{Index: 1, Err: errors.New("Cannot use common symbol " + v.sym.written() + " in " + dire)}
+	case v.sym == nil:
+		s.sec, s.value = absSection, uint64(v.addend)
+	case v.sym.sec != "":
+		s.sec, s.value = v.sym.sec, v.sym.value+uint64(v.addend)
+	default:
+		return &rvgc.OperandError{Index: 1, Err: errors.New("Symbol " + v.sym.written() + " is not defined")}
+	}
+	return nil
+}
+
+// .comm sym, size[, align] leaves sym for the linker to allocate, as one
+// with the common symbols of the name in other objects; .lcomm, or .comm of
+// a symbol made local first, allocates it in .bss here.  The alignment is
+// in bytes; without one, it is the largest power of two up to the size, at
+// most 16, as GNU as has it.
+func (asu *asUtil) comm(st *stmt) error {
+	dire := st.name.text
+	if len(st.ops) != 2 && len(st.ops) != 3 {
+		return errors.New("Syntax error: " + dire + " takes a symbol, a size and an alignment")
+	}
+	name, err := st.symbolName(0)
+	if err != nil {
+		return err
+	}
+	size, err := asu.constant(st, 1)
+	if err == nil && size < 0 {
+		err = errors.New("Negative size for " + dire)
+	}
+	if err != nil {
+		return &rvgc.OperandError{Index: 1, Err: err}
+	}
+	align := int64(1)
+	for align < 16 && align*2 <= size {
+		align *= 2
+	}
+	if len(st.ops) == 3 {
+		align, err = asu.constant(st, 2)
+		if err == nil && (align <= 0 || align&(align-1) != 0) {
+			err = errors.New("Alignment is not a power of two")
+		}
+		if err != nil {
+			return &rvgc.OperandError{Index: 2, Err: err}
+		}
+	}
+
+	s := asu.symbol(name)
+	local := dire == ".lcomm" || s.bound && s.bind == elf.STB_LOCAL
+	if s.sec != "" && (local || s.sec != commonSection) {
+		return errors.New("Symbol " + name + " is already defined")
+	}
+	s.typ = elf.STT_OBJECT
+	if local {
+		return asu.allocate(s, uint64(size), uint64(align))
+	}
+
+	// commons of the same name in one source merge too
+	if s.sec == commonSection {
+		if s.value > uint64(align) {
+			align = int64(s.value)
+		}
+		if s.size > uint64(size) {
+			size = int64(s.size)
+		}
+	}
+	s.sec, s.value, s.size = commonSection, uint64(align), uint64(size)
+	if !s.bound {
+		s.bind = elf.STB_GLOBAL
+	}
+	return nil
+}
+
+// allocate places s in .bss at the alignment, size bytes long, and goes
+// back to the section it was in
+func (asu *asUtil) allocate(s *symbol, size, align uint64) error {
+	cur, prev := asu.curSec, asu.previous
+	defer func() {
+		asu.curSec, asu.previous = cur, prev
+	}()
+	if err := asu.switchSection(".bss", nil); err != nil {
+		return err
+	}
+	sec := asu.sections[".bss"]
+	if sec.Addralign < align {
+		sec.Addralign = align
+	}
+	if err := asu.emit(make([]byte, (align-asu.loc()%align)%align)); err != nil {
+		return err
+	}
+	s.sec, s.value, s.size = ".bss", asu.loc(), size
+	return asu.emit(make([]byte, size))
+}
+
+// buildSymtab lays out the symbol table: one symbol for each section
+// first, then the other locals, then the rest.  It returns the symbols by
+// name, and the section symbols.
+func (asu *asUtil) buildSymtab(sections []string) (map[string]*common.Symbol, map[string]*common.Symbol) {
+	index := make(map[string]*common.Symbol)
+	secSym := make(map[string]*common.Symbol)
+
+	for _, sec := range sections {
+		secSym[sec] = &common.Symbol{
+			Bind:    elf.STB_LOCAL,
+			Type:    elf.STT_SECTION,
+			Section: asu.sections[sec].Section,
+		}
+		asu.obj.Symbols = append(asu.obj.Symbols, secSym[sec])
+	}
+
+	for _, local := range []bool{true, false} {
+		for _, name := range asu.symOrder {
+			s := asu.syms[name]
+
+			// undefined symbols are global unless told otherwise
+			bind := s.bind
+			if s.sec == "" && !s.bound {
+				bind = elf.STB_GLOBAL
+			}
+			if (bind == elf.STB_LOCAL) != local || !s.emitted() {
+				continue
+			}
+
+			sym := &common.Symbol{
+				Name:  name,
+				Bind:  bind,
+				Type:  s.typ,
+				Other: byte(s.vis),
+				Value: s.value,
+				Size:  s.size,
+			}
+			switch s.sec {
+			case "":
+			case absSection:
+				sym.Shndx = elf.SHN_ABS
+			case commonSection:
+				sym.Shndx = elf.SHN_COMMON
+			default:
+				sym.Section = asu.sections[s.sec].Section
+			}
+			index[name] = sym
+			asu.obj.Symbols = append(asu.obj.Symbols, sym)
+		}
+	}
+	return index, secSym
+}
@@ -0,0 +1,139 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package common
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+)
+
+// attributes.go: the .riscv.attributes section
+
+const (
+	tagFile       = 1
+	tagRISCVArch  = 5
+	attrVersion   = 'A'
+	attrVendor    = "riscv"
+	attrMalformed = "Malformed .riscv.attributes"
+)
+
+func uleb128(b []byte) (uint64, int) {
+	var v uint64
+	for i, c := range b {
+		v |= uint64(c&0x7f) << (7 * uint(i))
+		if c&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// RISCVArch returns the Tag_RISCV_arch attribute of f, the ISA string it
+// was built for, or "" if f does not record one.
+func RISCVArch(f *elf.File) (string, error) {
+	sec := f.Section(".riscv.attributes")
+	if sec == nil {
+		return "", nil
+	}
+	b, err := sec.Data()
+	if err != nil {
+		return "", err
+	}
+	if len(b) == 0 || b[0] != attrVersion {
+		return "", errors.New(attrMalformed)
+	}
+
+	// subsections, one per vendor
+	for b = b[1:]; len(b) >= 4; {
+		size := f.ByteOrder.Uint32(b)
+		if size < 4 || int(size) > len(b) {
+			return "", errors.New(attrMalformed)
+		}
+		sub := b[4:size]
+		b = b[size:]
+
+		n := bytes.IndexByte(sub, 0)
+		if n < 0 || string(sub[:n]) != attrVendor {
+			continue
+		}
+
+		// only the attributes of the whole file matter
+		for sub = sub[n+1:]; len(sub) > 0; {
+			tag, n := uleb128(sub)
+			if n == 0 || len(sub) < n+4 {
+				return "", errors.New(attrMalformed)
+			}
+			size := f.ByteOrder.Uint32(sub[n:])
+			if int(size) > len(sub) || size < uint32(n+4) {
+				return "", errors.New(attrMalformed)
+			}
+			attrs := sub[n+4 : size]
+			sub = sub[size:]
+			if tag != tagFile {
+				continue
+			}
+
+			for len(attrs) > 0 {
+				tag, n := uleb128(attrs)
+				if n == 0 {
+					return "", errors.New(attrMalformed)
+				}
+				attrs = attrs[n:]
+
+				// odd tags take a string, even ones a number
+				if tag%2 == 0 {
+					if _, n = uleb128(attrs); n == 0 {
+						return "", errors.New(attrMalformed)
+					}
+					attrs = attrs[n:]
+					continue
+				}
+				end := bytes.IndexByte(attrs, 0)
+				if end < 0 {
+					return "", errors.New(attrMalformed)
+				}
+				if tag == tagRISCVArch {
+					return string(attrs[:end]), nil
+				}
+				attrs = attrs[end+1:]
+			}
+		}
+	}
+	return "", nil
+}
+
+// RISCVAttributes returns the content of a .riscv.attributes section
+// recording arch as the ISA string.
+func RISCVAttributes(arch string) []byte {
+	attrs := append([]byte{tagRISCVArch}, arch...)
+	attrs = append(attrs, 0)
+
+	file := []byte{tagFile, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(file[1:], uint32(len(file)+len(attrs)))
+	file = append(file, attrs...)
+
+	sub := make([]byte, 4)
+	sub = append(sub, attrVendor...)
+	sub = append(sub, 0)
+	sub = append(sub, file...)
+	binary.LittleEndian.PutUint32(sub, uint32(len(sub)))
+
+	return append([]byte{attrVersion}, sub...)
+}
@@ -0,0 +1,842 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package common
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// object.go: an ELF file held in memory, to be built or edited and then
+// written out again.  Sections, symbols and relocations refer to each other
+// by pointer; indexes, string table offsets and file offsets are only
+// worked out when the object is written.
+
+// A StringTable is the content of a string table section.  Each string is
+// kept once, and its offset is known as soon as it is added.
+type StringTable struct {
+	data []byte
+	off  map[string]uint32
+}
+
+func NewStringTable() *StringTable {
+	return &StringTable{data: []byte{0}, off: map[string]uint32{"": 0}}
+}
+
+// Add returns the offset of s, adding it if it is new
+func (t *StringTable) Add(s string) uint32 {
+	if off, ok := t.off[s]; ok {
+		return off
+	}
+	off := uint32(len(t.data))
+	t.data = append(append(t.data, s...), 0)
+	t.off[s] = off
+	return off
+}
+
+func (t *StringTable) Bytes() []byte {
+	return t.data
+}
+
+// A Section is a section of an Object, without the null one.  Link and
+// Info name other sections where the ELF header would give their indexes;
+// a SHT_GROUP has its signature and members instead, and RawInfo holds an
+// sh_info that is neither.
+type Section struct {
+	Name      string
+	Type      elf.SectionType
+	Flags     elf.SectionFlag
+	Addr      uint64
+	Addralign uint64
+	Entsize   uint64
+	Data      []byte
+	Size      uint64 // of a SHT_NOBITS section, which has no Data
+	Link      *Section
+	Info      *Section
+	RawInfo   uint32
+
+	Signature  *Symbol
+	Members    []*Section
+	GroupFlags uint32
+
+	// the entries of a relocation section against the symbol table, which
+	// Data is built from; a new one may leave Link to the writer
+	Relocs []Reloc
+
+	Offset uint64 // in the file, as laid out by Layout
+}
+
+// Len is the size of s in memory
+func (s *Section) Len() uint64 {
+	if s.Type == elf.SHT_NOBITS {
+		return s.Size
+	}
+	return uint64(len(s.Data))
+}
+
+// fileLen is the size of s in the file
+func (s *Section) fileLen() uint64 {
+	if s.Type == elf.SHT_NOBITS {
+		return 0
+	}
+	return uint64(len(s.Data))
+}
+
+// A Symbol is an entry of the symbol table, without the null one.  One
+// defined in a section has it in Section; the others are told by Shndx:
+// SHN_UNDEF, SHN_ABS or SHN_COMMON.
+type Symbol struct {
+	Name    string
+	Bind    elf.SymBind
+	Type    elf.SymType
+	Other   byte
+	Section *Section
+	Shndx   elf.SectionIndex
+	Value   uint64
+	Size    uint64
+}
+
+// A Reloc is a relocation against a symbol, or against none if Sym is nil
+type Reloc struct {
+	Off    uint64
+	Sym    *Symbol
+	Type   uint32
+	Addend int64
+}
+
+// A Segment is a program header.  A PT_LOAD with Sections is laid out
+// around them and sized to them; another segment with Sections moves with
+// them but keeps its size, unless it loses one.  The rest are written as
+// they are, but a PT_PHDR, which always covers the program headers.
+type Segment struct {
+	Type     elf.ProgType
+	Flags    elf.ProgFlag
+	Off      uint64
+	Vaddr    uint64
+	Paddr    uint64
+	Filesz   uint64
+	Memsz    uint64
+	Align    uint64
+	Sections []*Section // in the order of their addresses
+}
+
+// An Object is an ELF file in memory.  SymTab, built from Symbols, and the
+// string tables are among Sections once the object has been written or
+// loaded from a file.
+type Object struct {
+	Class      elf.Class
+	Data       elf.Data
+	OSABI      elf.OSABI
+	ABIVersion uint8
+	Type       elf.Type
+	Machine    elf.Machine
+	Entry      uint64
+	Flags      uint32
+
+	Sections []*Section
+	Segments []*Segment
+	Symbols  []*Symbol
+
+	SymTab   *Section
+	StrTab   *Section
+	ShStrTab *Section
+
+	names *StringTable // the content of ShStrTab, as build lays it out
+}
+
+func NewObject(class elf.Class, typ elf.Type, machine elf.Machine) *Object {
+	return &Object{Class: class, Data: elf.ELFDATA2LSB, Type: typ, Machine: machine}
+}
+
+// Open loads the ELF file of the name
+func Open(name string) (*Object, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Load reads an ELF file into an Object
+func Load(r io.ReaderAt) (*Object, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	o := &Object{
+		Class:      f.Class,
+		Data:       f.Data,
+		OSABI:      f.OSABI,
+		ABIVersion: f.ABIVersion,
+		Type:       f.Type,
+		Machine:    f.Machine,
+		Entry:      f.Entry,
+	}
+
+	// the flags and the index of .shstrtab are not in elf.FileHeader
+	var shstrndx uint16
+	hdr := io.NewSectionReader(r, 0, 64)
+	if f.Class == elf.ELFCLASS32 {
+		var h elf.Header32
+		err = binary.Read(hdr, f.ByteOrder, &h)
+		o.Flags, shstrndx = h.Flags, h.Shstrndx
+	} else {
+		var h elf.Header64
+		err = binary.Read(hdr, f.ByteOrder, &h)
+		o.Flags, shstrndx = h.Flags, h.Shstrndx
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// byIndex has nil for the null section
+	byIndex := make([]*Section, len(f.Sections))
+	for i, s := range f.Sections[1:] {
+		sec := &Section{
+			Name:      s.Name,
+			Type:      s.Type,
+			Flags:     s.Flags,
+			Addr:      s.Addr,
+			Addralign: s.Addralign,
+			Entsize:   s.Entsize,
+			Size:      s.Size,
+			Offset:    s.Offset,
+		}
+		if s.Type != elf.SHT_NOBITS {
+			// as it is in the file, compressed or not
+			sec.Data = make([]byte, s.FileSize)
+			if _, err := r.ReadAt(sec.Data, int64(s.Offset)); err != nil {
+				return nil, errors.New("Cannot read section " + s.Name + ": " + err.Error())
+			}
+		}
+		byIndex[i+1] = sec
+		o.Sections = append(o.Sections, sec)
+	}
+	section := func(i uint32) *Section {
+		if int(i) < len(byIndex) {
+			return byIndex[i]
+		}
+		return nil
+	}
+	for i, s := range f.Sections[1:] {
+		sec := byIndex[i+1]
+		sec.Link = section(s.Link)
+		switch {
+		case s.Type == elf.SHT_SYMTAB && o.SymTab == nil:
+			o.SymTab, o.StrTab = sec, sec.Link
+		case s.Type == elf.SHT_REL || s.Type == elf.SHT_RELA || s.Flags&elf.SHF_INFO_LINK != 0:
+			sec.Info = section(s.Info)
+		default:
+			sec.RawInfo = s.Info
+		}
+	}
+	if shstrndx != uint16(elf.SHN_UNDEF) {
+		o.ShStrTab = section(uint32(shstrndx))
+	}
+
+	if o.SymTab != nil {
+		syms, err := f.Symbols()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range syms {
+			sym := &Symbol{
+				Name:  s.Name,
+				Bind:  elf.ST_BIND(s.Info),
+				Type:  elf.ST_TYPE(s.Info),
+				Other: s.Other,
+				Value: s.Value,
+				Size:  s.Size,
+			}
+			switch {
+			case s.Section == elf.SHN_XINDEX:
+				return nil, errors.New("Extended section indexes are not supported")
+			case s.Section > elf.SHN_UNDEF && s.Section < elf.SHN_LORESERVE:
+				sym.Section = section(uint32(s.Section))
+				if sym.Section == nil {
+					return nil, errors.New("Symbol " + s.Name + " has a bad section index")
+				}
+			default:
+				sym.Shndx = s.Section
+			}
+			o.Symbols = append(o.Symbols, sym)
+		}
+	}
+	symbol := func(i uint32) *Symbol {
+		if i > 0 && int(i) <= len(o.Symbols) {
+			return o.Symbols[i-1]
+		}
+		return nil
+	}
+
+	for i, s := range f.Sections[1:] {
+		sec := byIndex[i+1]
+		switch {
+		case s.Type == elf.SHT_GROUP && sec.Link == o.SymTab && o.SymTab != nil:
+			sec.Signature = symbol(s.Info)
+			if len(sec.Data) >= 4 {
+				sec.GroupFlags = f.ByteOrder.Uint32(sec.Data)
+				for j := 4; j+4 <= len(sec.Data); j += 4 {
+					if m := section(f.ByteOrder.Uint32(sec.Data[j:])); m != nil {
+						sec.Members = append(sec.Members, m)
+					}
+				}
+			}
+
+		case (s.Type == elf.SHT_RELA || s.Type == elf.SHT_REL) && sec.Link == o.SymTab && o.SymTab != nil:
+			relas, err := Relocations(f, s)
+			if err != nil {
+				return nil, err
+			}
+			sec.Relocs = make([]Reloc, 0, len(relas))
+			for _, r := range relas {
+				sec.Relocs = append(sec.Relocs, Reloc{
+					Off:    r.Off,
+					Sym:    symbol(elf.R_SYM64(r.Info)),
+					Type:   elf.R_TYPE64(r.Info),
+					Addend: r.Addend,
+				})
+			}
+		}
+	}
+
+	for _, p := range f.Progs {
+		seg := &Segment{
+			Type:   p.Type,
+			Flags:  p.Flags,
+			Off:    p.Off,
+			Vaddr:  p.Vaddr,
+			Paddr:  p.Paddr,
+			Filesz: p.Filesz,
+			Memsz:  p.Memsz,
+			Align:  p.Align,
+		}
+		for _, sec := range o.Sections {
+			if seg.contains(sec) {
+				seg.Sections = append(seg.Sections, sec)
+			}
+		}
+		sort.SliceStable(seg.Sections, func(i, j int) bool {
+			return seg.Sections[i].Addr < seg.Sections[j].Addr
+		})
+		o.Segments = append(o.Segments, seg)
+	}
+	return o, nil
+}
+
+// contains tells if a section loaded from a file lies in p.  A .tbss takes
+// no room in the PT_LOAD holding the TLS template, and PT_TLS holds the
+// TLS sections only.
+func (p *Segment) contains(s *Section) bool {
+	if s.Flags&elf.SHF_ALLOC == 0 || p.Type == elf.PT_PHDR || p.Type == elf.PT_GNU_STACK {
+		return false
+	}
+	tls := s.Flags&elf.SHF_TLS != 0
+	switch {
+	case p.Type == elf.PT_TLS && !tls:
+		return false
+	case p.Type != elf.PT_TLS && tls && s.Type == elf.SHT_NOBITS:
+		return false
+	}
+	end := p.Vaddr + p.Memsz
+	return s.Addr >= p.Vaddr && s.Addr+s.Len() <= end && (s.Len() > 0 || s.Addr < end)
+}
+
+// fit sizes p to its sections, at the offsets they have
+func (p *Segment) fit() {
+	p.Filesz, p.Memsz = 0, 0
+	for _, m := range p.Sections {
+		if m.Type != elf.SHT_NOBITS && m.Offset+m.fileLen()-p.Off > p.Filesz {
+			p.Filesz = m.Offset + m.fileLen() - p.Off
+		}
+		if m.Addr+m.Len()-p.Vaddr > p.Memsz {
+			p.Memsz = m.Addr + m.Len() - p.Vaddr
+		}
+	}
+}
+
+// Section returns the first section of the name, or nil
+func (o *Object) Section(name string) *Section {
+	for _, s := range o.Sections {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Index returns the index s has in the section header table, or 0 if s is
+// not among the sections of o
+func (o *Object) Index(s *Section) int {
+	for i, sec := range o.Sections {
+		if sec == s {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// RemoveSection takes s out of o, with the relocation sections applying
+// to it and its section symbol.  Other symbols defined in s are left for
+// the caller to deal with; Write fails while any remains.
+func (o *Object) RemoveSection(s *Section) {
+	secs := o.Sections[:0]
+	removed := make([]*Section, 0)
+	for _, sec := range o.Sections {
+		switch {
+		case sec == s:
+		case sec.Info == s && (sec.Type == elf.SHT_RELA || sec.Type == elf.SHT_REL):
+			removed = append(removed, sec)
+		default:
+			secs = append(secs, sec)
+		}
+	}
+	o.Sections = secs
+
+	for _, sec := range o.Sections {
+		if sec.Link == s {
+			sec.Link = nil
+		}
+		if sec.Info == s {
+			sec.Info = nil
+		}
+		sec.Members = without(sec.Members, s)
+	}
+	for _, p := range o.Segments {
+		if n := len(p.Sections); n > 0 {
+			if p.Sections = without(p.Sections, s); len(p.Sections) < n {
+				p.fit()
+			}
+		}
+	}
+	o.RemoveSymbols(func(sym *Symbol) bool {
+		return sym.Section == s && sym.Type == elf.STT_SECTION
+	})
+
+	switch s {
+	case o.SymTab:
+		o.SymTab, o.Symbols = nil, nil
+	case o.StrTab:
+		o.StrTab = nil
+	case o.ShStrTab:
+		o.ShStrTab = nil
+	}
+	for _, sec := range removed {
+		o.RemoveSection(sec)
+	}
+}
+
+func without(secs []*Section, s *Section) []*Section {
+	ret := secs[:0]
+	for _, sec := range secs {
+		if sec != s {
+			ret = append(ret, sec)
+		}
+	}
+	return ret
+}
+
+// RemoveSymbols takes the symbols drop tells out of o
+func (o *Object) RemoveSymbols(drop func(*Symbol) bool) {
+	syms := o.Symbols[:0]
+	for _, sym := range o.Symbols {
+		if !drop(sym) {
+			syms = append(syms, sym)
+		}
+	}
+	o.Symbols = syms
+}
+
+// the sizes of the headers and table entries of each class
+type classSizes struct {
+	ehdr, phdr, shdr, sym, rel, rela, align uint64
+}
+
+func (o *Object) sizes() classSizes {
+	if o.Class == elf.ELFCLASS32 {
+		return classSizes{ehdr: 52, phdr: 32, shdr: 40, sym: 16, rel: 8, rela: 12, align: 4}
+	}
+	return classSizes{ehdr: 64, phdr: 56, shdr: 64, sym: 24, rel: 16, rela: 24, align: 8}
+}
+
+func (o *Object) byteOrder() binary.ByteOrder {
+	if o.Data == elf.ELFDATA2MSB {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func alignUp(v, align uint64) uint64 {
+	if align <= 1 {
+		return v
+	}
+	return (v + align - 1) / align * align
+}
+
+// tables adds the symbol and string tables o is missing, after the other
+// sections, as GNU tools place them
+func (o *Object) tables() {
+	relocs := false
+	for _, s := range o.Sections {
+		for _, r := range s.Relocs {
+			relocs = relocs || r.Sym != nil
+		}
+	}
+	if o.SymTab == nil && (len(o.Symbols) > 0 || relocs) {
+		o.SymTab = &Section{Name: ".symtab", Type: elf.SHT_SYMTAB}
+		o.Sections = append(o.Sections, o.SymTab)
+	}
+	if o.SymTab != nil && o.StrTab == nil {
+		o.StrTab = &Section{Name: ".strtab", Type: elf.SHT_STRTAB, Addralign: 1}
+		o.Sections = append(o.Sections, o.StrTab)
+	}
+	if o.ShStrTab == nil {
+		o.ShStrTab = &Section{Name: ".shstrtab", Type: elf.SHT_STRTAB, Addralign: 1}
+		o.Sections = append(o.Sections, o.ShStrTab)
+	}
+}
+
+// build fills in the tables that are made from the rest of the object:
+// the symbol table and its strings, the relocations and groups against
+// it, and the section names
+func (o *Object) build() error {
+	o.tables()
+	z := o.sizes()
+	order := o.byteOrder()
+
+	index := make(map[*Section]uint32)
+	for i, s := range o.Sections {
+		index[s] = uint32(i + 1)
+	}
+	if len(o.Sections)+1 >= int(elf.SHN_LORESERVE) {
+		return errors.New("Too many sections")
+	}
+
+	// the locals come first, which is all sh_info of the symbol table
+	// tells about them
+	syms := make([]*Symbol, 0, len(o.Symbols))
+	for _, local := range []bool{true, false} {
+		for _, sym := range o.Symbols {
+			if (sym.Bind == elf.STB_LOCAL) == local {
+				syms = append(syms, sym)
+			}
+		}
+	}
+	symIndex := make(map[*Symbol]uint32)
+	strtab := NewStringTable()
+	shstrtab := strtab
+	if o.StrTab != o.ShStrTab {
+		shstrtab = NewStringTable()
+	}
+
+	if o.SymTab != nil {
+		o.SymTab.Type = elf.SHT_SYMTAB
+		o.SymTab.Link = o.StrTab
+		o.SymTab.Addralign, o.SymTab.Entsize = z.align, z.sym
+		o.SymTab.RawInfo = 1
+		data := make([]byte, z.sym)
+		for i, sym := range syms {
+			symIndex[sym] = uint32(i + 1)
+			if sym.Bind == elf.STB_LOCAL {
+				o.SymTab.RawInfo = uint32(i + 2)
+			}
+
+			shndx := uint16(sym.Shndx)
+			if sym.Section != nil {
+				i, ok := index[sym.Section]
+				if !ok {
+					return errors.New("Symbol " + sym.Name + " is defined in removed section " + sym.Section.Name)
+				}
+				shndx = uint16(i)
+			}
+			info := elf.ST_INFO(sym.Bind, sym.Type)
+			name := strtab.Add(sym.Name)
+			if o.Class == elf.ELFCLASS32 {
+				data = appendStruct(data, order, &elf.Sym32{
+					Name: name, Value: uint32(sym.Value), Size: uint32(sym.Size),
+					Info: info, Other: sym.Other, Shndx: shndx,
+				})
+			} else {
+				data = appendStruct(data, order, &elf.Sym64{
+					Name: name, Info: info, Other: sym.Other, Shndx: shndx,
+					Value: sym.Value, Size: sym.Size,
+				})
+			}
+		}
+		o.SymTab.Data = data
+	}
+
+	for _, s := range o.Sections {
+		if s.Link != nil {
+			if _, ok := index[s.Link]; !ok {
+				s.Link = nil
+			}
+		}
+		switch {
+		case (s.Type == elf.SHT_RELA || s.Type == elf.SHT_REL) && s.Relocs != nil && (s.Link == nil || s.Link == o.SymTab):
+			s.Link = o.SymTab
+			s.Addralign, s.Entsize = z.align, z.rela
+			if s.Type == elf.SHT_REL {
+				s.Entsize = z.rel
+			}
+			data := make([]byte, 0, uint64(len(s.Relocs))*s.Entsize)
+			for _, r := range s.Relocs {
+				sym := uint32(0)
+				if r.Sym != nil {
+					i, ok := symIndex[r.Sym]
+					if !ok {
+						return errors.New("Relocation in " + s.Name + " against removed symbol " + r.Sym.Name)
+					}
+					sym = i
+				}
+				switch {
+				case o.Class == elf.ELFCLASS32 && s.Type == elf.SHT_REL:
+					data = appendStruct(data, order, &elf.Rel32{Off: uint32(r.Off), Info: elf.R_INFO32(sym, r.Type)})
+				case o.Class == elf.ELFCLASS32:
+					data = appendStruct(data, order, &elf.Rela32{
+						Off: uint32(r.Off), Info: elf.R_INFO32(sym, r.Type), Addend: int32(r.Addend),
+					})
+				case s.Type == elf.SHT_REL:
+					data = appendStruct(data, order, &elf.Rel64{Off: r.Off, Info: elf.R_INFO(sym, r.Type)})
+				default:
+					data = appendStruct(data, order, &elf.Rela64{
+						Off: r.Off, Info: elf.R_INFO(sym, r.Type), Addend: r.Addend,
+					})
+				}
+			}
+			s.Data = data
+
+		case s.Type == elf.SHT_GROUP && o.SymTab != nil:
+			s.Link = o.SymTab
+			s.Addralign, s.Entsize = 4, 4
+			s.RawInfo = symIndex[s.Signature]
+			data := appendStruct(nil, order, s.GroupFlags)
+			for _, m := range s.Members {
+				if i, ok := index[m]; ok {
+					data = appendStruct(data, order, i)
+				}
+			}
+			s.Data = data
+		}
+	}
+
+	for _, s := range o.Sections {
+		shstrtab.Add(s.Name)
+	}
+	if o.StrTab != nil {
+		o.StrTab.Type = elf.SHT_STRTAB
+		o.StrTab.Data = strtab.Bytes()
+	}
+	o.ShStrTab.Type = elf.SHT_STRTAB
+	o.ShStrTab.Data = shstrtab.Bytes()
+	o.names = shstrtab
+	return nil
+}
+
+// appendStruct appends the encoding of an ELF structure to b
+func appendStruct(b []byte, order binary.ByteOrder, v interface{}) []byte {
+	ret, _ := binary.Append(b, order, v)
+	return ret
+}
+
+// Layout places the sections and the program headers in the file, and
+// returns the offsets of the program and section header tables.  The
+// sections of a PT_LOAD segment keep their distances from each other, at
+// offsets that map to their addresses page by page; the others follow one
+// another.
+func (o *Object) Layout() (phoff, shoff uint64) {
+	z := o.sizes()
+	off := z.ehdr
+	if len(o.Segments) > 0 {
+		phoff = off
+		off += uint64(len(o.Segments)) * z.phdr
+	}
+
+	load := make(map[*Section]*Segment)
+	for _, p := range o.Segments {
+		if p.Type == elf.PT_LOAD {
+			for _, s := range p.Sections {
+				load[s] = p
+			}
+		}
+	}
+
+	placed := make(map[*Segment]bool)
+	for _, s := range o.Sections {
+		p := load[s]
+		if p == nil {
+			off = alignUp(off, s.Addralign)
+			s.Offset = off
+			off += s.fileLen()
+			continue
+		}
+		if placed[p] {
+			continue
+		}
+		placed[p] = true
+
+		// the lowest offset at or after off that maps to the address
+		// of the segment
+		first := p.Sections[0]
+		start := int64(off) - int64(first.Addr-p.Vaddr)
+		if start < 0 {
+			start = 0
+		}
+		p.Off = uint64(start)
+		if p.Align > 1 {
+			p.Off = p.Off - p.Off%p.Align + p.Vaddr%p.Align
+			if p.Off < uint64(start) {
+				p.Off += p.Align
+			}
+		}
+		for _, m := range p.Sections {
+			m.Offset = p.Off + (m.Addr - p.Vaddr)
+			if end := m.Offset + m.fileLen(); end > off {
+				off = end
+			}
+		}
+	}
+
+	for _, p := range o.Segments {
+		switch {
+		case p.Type == elf.PT_PHDR:
+			p.Off = phoff
+			p.Filesz = uint64(len(o.Segments)) * z.phdr
+			p.Memsz = p.Filesz
+
+		case p.Type == elf.PT_LOAD && len(p.Sections) > 0:
+			p.fit()
+
+		case len(p.Sections) > 0:
+			// the others keep their sizes, which may run past their
+			// sections, as that of PT_GNU_RELRO does to a page boundary
+			first := p.Sections[0]
+			p.Off = first.Offset - (first.Addr - p.Vaddr)
+		}
+	}
+
+	shoff = alignUp(off, z.align)
+	return phoff, shoff
+}
+
+// Bytes returns the ELF file of o, building its tables and laying it out
+// first
+func (o *Object) Bytes() ([]byte, error) {
+	if err := o.build(); err != nil {
+		return nil, err
+	}
+	phoff, shoff := o.Layout()
+	z := o.sizes()
+	order := o.byteOrder()
+	shnum := uint64(len(o.Sections) + 1)
+
+	out := make([]byte, shoff+shnum*z.shdr)
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(o.Class), byte(o.Data), byte(elf.EV_CURRENT), byte(o.OSABI), o.ABIVersion}
+	phnum := uint16(len(o.Segments))
+	phentsize := uint16(0)
+	if phnum > 0 {
+		phentsize = uint16(z.phdr)
+	}
+	shstrndx := uint16(o.Index(o.ShStrTab))
+
+	var hdr interface{}
+	if o.Class == elf.ELFCLASS32 {
+		hdr = &elf.Header32{
+			Ident: ident, Type: uint16(o.Type), Machine: uint16(o.Machine), Version: uint32(elf.EV_CURRENT),
+			Entry: uint32(o.Entry), Phoff: uint32(phoff), Shoff: uint32(shoff), Flags: o.Flags,
+			Ehsize: uint16(z.ehdr), Phentsize: phentsize, Phnum: phnum,
+			Shentsize: uint16(z.shdr), Shnum: uint16(shnum), Shstrndx: shstrndx,
+		}
+	} else {
+		hdr = &elf.Header64{
+			Ident: ident, Type: uint16(o.Type), Machine: uint16(o.Machine), Version: uint32(elf.EV_CURRENT),
+			Entry: o.Entry, Phoff: phoff, Shoff: shoff, Flags: o.Flags,
+			Ehsize: uint16(z.ehdr), Phentsize: phentsize, Phnum: phnum,
+			Shentsize: uint16(z.shdr), Shnum: uint16(shnum), Shstrndx: shstrndx,
+		}
+	}
+	copy(out, appendStruct(nil, order, hdr))
+
+	for i, p := range o.Segments {
+		var ph interface{}
+		if o.Class == elf.ELFCLASS32 {
+			ph = &elf.Prog32{
+				Type: uint32(p.Type), Off: uint32(p.Off), Vaddr: uint32(p.Vaddr), Paddr: uint32(p.Paddr),
+				Filesz: uint32(p.Filesz), Memsz: uint32(p.Memsz), Flags: uint32(p.Flags), Align: uint32(p.Align),
+			}
+		} else {
+			ph = &elf.Prog64{
+				Type: uint32(p.Type), Flags: uint32(p.Flags), Off: p.Off, Vaddr: p.Vaddr, Paddr: p.Paddr,
+				Filesz: p.Filesz, Memsz: p.Memsz, Align: p.Align,
+			}
+		}
+		copy(out[phoff+uint64(i)*z.phdr:], appendStruct(nil, order, ph))
+	}
+
+	for i, s := range o.Sections {
+		copy(out[s.Offset:], s.Data[:s.fileLen()])
+
+		link, info := uint32(o.Index(s.Link)), s.RawInfo
+		if s.Info != nil {
+			info = uint32(o.Index(s.Info))
+		}
+		name := o.names.Add(s.Name)
+		size := s.Len()
+		var sh interface{}
+		if o.Class == elf.ELFCLASS32 {
+			sh = &elf.Section32{
+				Name: name, Type: uint32(s.Type), Flags: uint32(s.Flags), Addr: uint32(s.Addr),
+				Off: uint32(s.Offset), Size: uint32(size), Link: link, Info: info,
+				Addralign: uint32(s.Addralign), Entsize: uint32(s.Entsize),
+			}
+		} else {
+			sh = &elf.Section64{
+				Name: name, Type: uint32(s.Type), Flags: uint64(s.Flags), Addr: s.Addr,
+				Off: s.Offset, Size: size, Link: link, Info: info,
+				Addralign: s.Addralign, Entsize: s.Entsize,
+			}
+		}
+		copy(out[shoff+uint64(i+1)*z.shdr:], appendStruct(nil, order, sh))
+	}
+	return out, nil
+}
+
+// Write writes the ELF file of o to w
+func (o *Object) Write(w io.Writer) error {
+	b, err := o.Bytes()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// WriteFile writes the ELF file of o to the file of the name, with the
+// permissions given
+func (o *Object) WriteFile(name string, perm os.FileMode) error {
+	b, err := o.Bytes()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, b, perm)
+}
@@ -0,0 +1,80 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package common
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+)
+
+// reloc.go: relocation sections
+
+// Relocations returns the entries of a SHT_RELA or SHT_REL section of f,
+// the latter with no addends.  Those of an ELFCLASS32 file are widened, so
+// that either class reads the same way: elf.R_SYM64 and elf.R_TYPE64 take
+// apart the Info of both.
+func Relocations(f *elf.File, sec *elf.Section) ([]elf.Rela64, error) {
+	if sec.Type != elf.SHT_RELA && sec.Type != elf.SHT_REL {
+		return nil, errors.New("Not a relocation section: " + sec.Name)
+	}
+	b, err := sec.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(b)
+	ret := make([]elf.Rela64, 0)
+	switch {
+	case f.Class == elf.ELFCLASS32 && sec.Type == elf.SHT_REL:
+		var rel elf.Rel32
+		for r.Len() >= binary.Size(rel) {
+			binary.Read(r, f.ByteOrder, &rel)
+			ret = append(ret, elf.Rela64{
+				Off:  uint64(rel.Off),
+				Info: elf.R_INFO(elf.R_SYM32(rel.Info), elf.R_TYPE32(rel.Info)),
+			})
+		}
+	case f.Class == elf.ELFCLASS32:
+		var rela elf.Rela32
+		for r.Len() >= binary.Size(rela) {
+			binary.Read(r, f.ByteOrder, &rela)
+			ret = append(ret, elf.Rela64{
+				Off:    uint64(rela.Off),
+				Info:   elf.R_INFO(elf.R_SYM32(rela.Info), elf.R_TYPE32(rela.Info)),
+				Addend: int64(rela.Addend),
+			})
+		}
+	case f.Class == elf.ELFCLASS64 && sec.Type == elf.SHT_REL:
+		var rel elf.Rel64
+		for r.Len() >= binary.Size(rel) {
+			binary.Read(r, f.ByteOrder, &rel)
+			ret = append(ret, elf.Rela64{Off: rel.Off, Info: rel.Info})
+		}
+	case f.Class == elf.ELFCLASS64:
+		var rela elf.Rela64
+		for r.Len() >= binary.Size(rela) {
+			binary.Read(r, f.ByteOrder, &rela)
+			ret = append(ret, rela)
+		}
+	default:
+		return nil, errors.New("Unknown ELF class " + f.Class.String())
+	}
+	return ret, nil
+}
@@ -19,6 +19,7 @@ package common
 
 import (
 	"debug/elf"
+	"strings"
 )
 
 // util.go: Common utilities and the Util interface
@@ -33,3 +34,26 @@ type Util interface {
 	Run(args map[string]interface{}) error
 	Output(args map[string]interface{}) error
 }
+
+// Names are the values of an option given once for each, such as the
+// sections of -R
+type Names []string
+
+func (n *Names) String() string {
+	return strings.Join(*n, ",")
+}
+
+func (n *Names) Set(s string) error {
+	*n = append(*n, s)
+	return nil
+}
+
+// Has tells if name is among n
+func (n *Names) Has(name string) bool {
+	for _, s := range *n {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,356 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package ld
+
+import (
+	"debug/elf"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NonerKao/go-binutils/common"
+)
+
+// ld.go: link RISC-V relocatable objects into a static executable
+
+// the page size the segments are aligned to
+const pageSize = 0x1000
+
+// float ABI and RVE in e_flags, on which all the inputs have to agree
+const (
+	efRISCVRVC  = 0x1
+	efRISCVABIs = 0xe
+)
+
+type input struct {
+	name string
+	obj  *common.Object
+}
+
+// where an input section goes: an output section, at an offset in it
+type placement struct {
+	out *common.Section
+	off uint64
+}
+
+type ldUtil struct {
+	inputs []*input
+	out    *common.Object
+
+	placed    map[*common.Section]placement
+	discarded map[*common.Section]bool
+	commons   []*common.Section // made for the common symbols, in .bss
+
+	globals map[string]*definition
+	order   []string // of the global names, as first seen
+}
+
+func New() *ldUtil {
+	return &ldUtil{inputs: make([]*input, 0)}
+}
+
+func (ldu *ldUtil) Init(filename string) error {
+
+	for _, name := range flag.Args() {
+		obj, err := common.Open(name)
+		if err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+		ldu.inputs = append(ldu.inputs, &input{name: name, obj: obj})
+	}
+
+	return nil
+}
+
+func (ldu *ldUtil) DefineFlags() map[string]interface{} {
+
+	args := map[string]interface{}{
+		"o":     flag.String("o", "a.out", "Output file name"),
+		"Ttext": flag.String("Ttext", "0x10000", "Address of the .text section"),
+		"e":     flag.String("e", "_start", "Entry symbol, or address"),
+	}
+
+	return args
+}
+
+// check tells if the inputs can be linked together: RISC-V relocatable
+// objects all of the same class and ABI
+func (ldu *ldUtil) check() error {
+	first := ldu.inputs[0]
+	for _, in := range ldu.inputs {
+		o := in.obj
+		switch {
+		case o.Type != elf.ET_REL:
+			return errors.New(in.name + ": not a relocatable object")
+		case o.Machine != elf.EM_RISCV:
+			return errors.New(in.name + ": not a RISC-V object")
+		case o.Class != first.obj.Class:
+			return errors.New(in.name + ": " + o.Class.String() + " cannot be linked with " + first.obj.Class.String() + " " + first.name)
+		case o.Flags&efRISCVABIs != first.obj.Flags&efRISCVABIs:
+			return errors.New(in.name + ": ABI differs from that of " + first.name)
+		}
+		for _, s := range o.Sections {
+			if s.Flags&elf.SHF_ALLOC != 0 && s.Flags&elf.SHF_TLS != 0 {
+				return errors.New(in.name + ": TLS section " + s.Name + " is not supported")
+			}
+		}
+	}
+	return nil
+}
+
+// discard marks the members of a COMDAT group that another input has
+// already brought in
+func (ldu *ldUtil) discard() {
+	seen := make(map[string]bool)
+	for _, in := range ldu.inputs {
+		for _, s := range in.obj.Sections {
+			if s.Type != elf.SHT_GROUP || s.Signature == nil || s.GroupFlags&1 == 0 {
+				continue
+			}
+			if !seen[s.Signature.Name] {
+				seen[s.Signature.Name] = true
+				continue
+			}
+			for _, m := range s.Members {
+				ldu.discarded[m] = true
+			}
+		}
+	}
+}
+
+// outNames are the output sections whose names take in those of the input
+// sections after a dot, as in the default linker script of GNU ld
+var outNames = []string{".text", ".rodata", ".srodata", ".data", ".sdata", ".sbss", ".bss"}
+
+func outName(name string) string {
+	for _, n := range outNames {
+		if name == n || strings.HasPrefix(name, n+".") {
+			return n
+		}
+	}
+	return name
+}
+
+// rank orders the output sections: code, read-only data, data, small data
+// and then the zero-filled ones, small first
+func rank(s *common.Section) int {
+	small := strings.HasPrefix(s.Name, ".s")
+	switch {
+	case s.Flags&elf.SHF_EXECINSTR != 0:
+		return 0
+	case s.Flags&elf.SHF_WRITE == 0:
+		return 1
+	case s.Type != elf.SHT_NOBITS && !small:
+		return 2
+	case s.Type != elf.SHT_NOBITS:
+		return 3
+	case small:
+		return 4
+	}
+	return 5
+}
+
+// merge gathers the allocated input sections into output sections by
+// name, each input at its alignment after those before it
+func (ldu *ldUtil) merge() []*common.Section {
+	byName := make(map[string]*common.Section)
+	outs := make([]*common.Section, 0)
+	add := func(s *common.Section) {
+		name := outName(s.Name)
+		out, ok := byName[name]
+		if !ok {
+			out = &common.Section{Name: name, Type: s.Type, Addralign: 1}
+			byName[name] = out
+			outs = append(outs, out)
+		}
+		if s.Type != elf.SHT_NOBITS {
+			out.Type = s.Type
+		}
+		out.Flags |= s.Flags &^ elf.SHF_GROUP
+		align := s.Addralign
+		if align == 0 {
+			align = 1
+		}
+		if align > out.Addralign {
+			out.Addralign = align
+		}
+		off := alignUp(out.Size, align)
+		ldu.placed[s] = placement{out: out, off: off}
+		out.Size = off + s.Len()
+	}
+
+	for _, in := range ldu.inputs {
+		for _, s := range in.obj.Sections {
+			if s.Flags&elf.SHF_ALLOC != 0 && !ldu.discarded[s] && s.Type != elf.SHT_GROUP {
+				add(s)
+			}
+		}
+	}
+	for _, s := range ldu.commons {
+		add(s)
+	}
+
+	// only now is it known whether an output section has contents
+	for _, out := range outs {
+		if out.Type != elf.SHT_NOBITS {
+			out.Data = make([]byte, out.Size)
+			out.Size = 0
+		}
+	}
+	for s, p := range ldu.placed {
+		if p.out.Data != nil && s.Type != elf.SHT_NOBITS {
+			copy(p.out.Data[p.off:], s.Data)
+		}
+	}
+
+	sort.SliceStable(outs, func(i, j int) bool {
+		return rank(outs[i]) < rank(outs[j])
+	})
+	return outs
+}
+
+func alignUp(v, align uint64) uint64 {
+	if align <= 1 {
+		return v
+	}
+	return (v + align - 1) / align * align
+}
+
+// layout gives the output sections their addresses from base on, the
+// writable ones on a page of their own, and returns the PT_LOAD segments
+// that load them.  An empty section only gets an address, for the symbols
+// in it; GNU ld leaves it out of the file too.
+func layout(outs []*common.Section, base uint64) []*common.Segment {
+	var text, data *common.Segment
+	addr := base
+	for _, s := range outs {
+		if s.Len() == 0 {
+			s.Addr = addr
+			continue
+		}
+		seg := text
+		if s.Flags&elf.SHF_WRITE != 0 {
+			if data == nil {
+				// a page after, at the same offset in it, as GNU ld
+				// does, so the file needs no padding
+				addr = alignUp(addr, pageSize) + addr%pageSize
+				data = &common.Segment{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_W, Align: pageSize}
+			}
+			seg = data
+		} else if text == nil {
+			text = &common.Segment{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_X, Align: pageSize}
+			seg = text
+		}
+
+		addr = alignUp(addr, s.Addralign)
+		s.Addr = addr
+		addr += s.Len()
+		if len(seg.Sections) == 0 {
+			seg.Vaddr, seg.Paddr = s.Addr, s.Addr
+		}
+		seg.Sections = append(seg.Sections, s)
+	}
+
+	ret := make([]*common.Segment, 0, 2)
+	for _, p := range []*common.Segment{text, data} {
+		if p != nil {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// entry returns the address of the entry symbol, or the number given
+// instead.  Without either, GNU ld starts at .text, and so does this.
+func (ldu *ldUtil) entry(name string) uint64 {
+	if d, ok := ldu.globals[name]; ok && ldu.defines(d.sym) {
+		return ldu.address(d.sym)
+	}
+	if v, err := strconv.ParseUint(name, 0, 64); err == nil {
+		return v
+	}
+	start := uint64(0)
+	if text := ldu.out.Section(".text"); text != nil {
+		start = text.Addr
+	}
+	fmt.Fprintf(os.Stderr, "Warning: cannot find entry symbol %s; defaulting to 0x%x\n", name, start)
+	return start
+}
+
+func (ldu *ldUtil) Run(args map[string]interface{}) error {
+
+	base, err := strconv.ParseUint(*args["Ttext"].(*string), 0, 64)
+	if err != nil {
+		return errors.New("Bad -Ttext " + *args["Ttext"].(*string))
+	}
+	if err := ldu.check(); err != nil {
+		return err
+	}
+	first := ldu.inputs[0].obj
+
+	ldu.placed = make(map[*common.Section]placement)
+	ldu.discarded = make(map[*common.Section]bool)
+	ldu.discard()
+	if err := ldu.resolve(); err != nil {
+		return err
+	}
+	outs := ldu.merge()
+
+	o := common.NewObject(first.Class, elf.ET_EXEC, elf.EM_RISCV)
+	o.Data = first.Data
+	for _, in := range ldu.inputs {
+		o.Flags |= in.obj.Flags
+	}
+	o.Flags = o.Flags&efRISCVRVC | first.Flags&^efRISCVRVC
+	o.Segments = layout(outs, base)
+	for _, s := range outs {
+		if s.Len() > 0 {
+			o.Sections = append(o.Sections, s)
+		}
+	}
+	ldu.out = o
+
+	ldu.provide()
+	if err := ldu.undefined(); err != nil {
+		return err
+	}
+	if err := ldu.relocate(); err != nil {
+		return err
+	}
+
+	// the attributes of the first input stand for all
+	for _, s := range first.Sections {
+		if s.Type == elf.SHT_RISCV_ATTRIBUTES {
+			o.Sections = append(o.Sections, &common.Section{Name: s.Name, Type: s.Type, Addralign: 1, Data: s.Data})
+			break
+		}
+	}
+	o.Symbols = ldu.symbols()
+	o.Entry = ldu.entry(*args["e"].(*string))
+
+	return nil
+}
+
+func (ldu *ldUtil) Output(args map[string]interface{}) error {
+
+	return ldu.out.WriteFile(*args["o"].(*string), 0755)
+}
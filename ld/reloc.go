@@ -0,0 +1,141 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package ld
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/NonerKao/go-binutils/common"
+	"github.com/NonerKao/go-binutils/rvgc"
+)
+
+// reloc.go: apply the relocations of the inputs to the output sections
+
+// a relocation of an input, and where its section went
+type fixup struct {
+	in *input
+	at placement
+	r  common.Reloc
+}
+
+// where returns the address the relocation applies to, and its offset in
+// the output section
+func (f *fixup) where() (uint64, uint64) {
+	off := f.at.off + f.r.Off
+	return f.at.out.Addr + off, off
+}
+
+// relocate applies the relocations to what the inputs have in the output.
+// A %pcrel_lo refers to the auipc of its %pcrel_hi instead of to the
+// symbol, so the values of the %pcrel_hi come first, by their addresses.
+func (ldu *ldUtil) relocate() error {
+	fixups := make([]*fixup, 0)
+	for _, in := range ldu.inputs {
+		for _, s := range in.obj.Sections {
+			p, ok := ldu.placed[s.Info]
+			if s.Relocs == nil || !ok || p.out.Data == nil {
+				continue
+			}
+			for _, r := range s.Relocs {
+				fixups = append(fixups, &fixup{in: in, at: p, r: r})
+			}
+		}
+	}
+
+	hi := make(map[uint64]int64)
+	for _, f := range fixups {
+		if elf.R_RISCV(f.r.Type) == elf.R_RISCV_PCREL_HI20 {
+			p, _ := f.where()
+			hi[p] = ldu.value(f) - int64(p)
+		}
+	}
+	for _, f := range fixups {
+		if err := ldu.apply(f, hi); err != nil {
+			p, _ := f.where()
+			return errors.New(f.in.name + ": at 0x" + strconv.FormatUint(p, 16) + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// value returns S + A of the relocation
+func (ldu *ldUtil) value(f *fixup) int64 {
+	s := uint64(0)
+	if f.r.Sym != nil {
+		s = ldu.address(f.r.Sym)
+	}
+	return int64(s) + f.r.Addend
+}
+
+func (ldu *ldUtil) apply(f *fixup, hi map[uint64]int64) error {
+	typ := elf.R_RISCV(f.r.Type)
+	p, off := f.where()
+	data := f.at.out.Data
+	v := ldu.value(f)
+
+	n := uint64(4)
+	switch typ {
+	case elf.R_RISCV_NONE, elf.R_RISCV_RELAX:
+		return nil
+	case elf.R_RISCV_64:
+		n = 8
+	case elf.R_RISCV_32, elf.R_RISCV_HI20, elf.R_RISCV_LO12_I, elf.R_RISCV_LO12_S:
+	case elf.R_RISCV_BRANCH, elf.R_RISCV_JAL, elf.R_RISCV_PCREL_HI20:
+		v -= int64(p)
+	case elf.R_RISCV_CALL, elf.R_RISCV_CALL_PLT:
+		n = 8
+		v -= int64(p)
+	case elf.R_RISCV_PCREL_LO12_I, elf.R_RISCV_PCREL_LO12_S:
+		// the symbol is the auipc
+		var ok bool
+		if v, ok = hi[uint64(v)]; !ok {
+			return errors.New(typ.String() + " has no R_RISCV_PCREL_HI20 to go with")
+		}
+	default:
+		return errors.New("Unsupported relocation " + typ.String())
+	}
+	if off+n > uint64(len(data)) {
+		return errors.New(typ.String() + " runs past the end of " + f.at.out.Name)
+	}
+
+	switch typ {
+	case elf.R_RISCV_32:
+		// either signed or unsigned 32 bits
+		if v < -1<<31 || v >= 1<<32 {
+			return errors.New("Value out of range for " + typ.String())
+		}
+		binary.LittleEndian.PutUint32(data[off:], uint32(v))
+		return nil
+	case elf.R_RISCV_64:
+		binary.LittleEndian.PutUint64(data[off:], uint64(v))
+		return nil
+	}
+	// addresses wrap around in 32 bits
+	if ldu.out.Class == elf.ELFCLASS32 {
+		v = int64(int32(v))
+	}
+	b, err := rvgc.Fixup(data[off:off+n], typ, v)
+	if err != nil {
+		return err
+	}
+	copy(data[off:], b)
+	return nil
+}
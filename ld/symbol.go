@@ -0,0 +1,233 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package ld
+
+import (
+	"debug/elf"
+	"errors"
+
+	"github.com/NonerKao/go-binutils/common"
+)
+
+// symbol.go: resolve the global symbols across the inputs
+
+// the symbol a global name stands for, and the input it comes from; the
+// input is nil for a symbol the linker provides
+type definition struct {
+	sym *common.Symbol
+	in  *input
+}
+
+// defines tells if sym is defined in what goes into the output; one in a
+// discarded group is as good as undefined
+func (ldu *ldUtil) defines(sym *common.Symbol) bool {
+	if sym.Section != nil {
+		return !ldu.discarded[sym.Section]
+	}
+	return sym.Shndx == elf.SHN_ABS || sym.Shndx == elf.SHN_COMMON
+}
+
+// resolve picks a definition for each global name: a strong one over a
+// weak one, and either over a common one.  Two strong ones are an error.
+// The common symbols that are left get room in .bss.
+func (ldu *ldUtil) resolve() error {
+	ldu.globals = make(map[string]*definition)
+	ldu.order = make([]string, 0)
+
+	for _, in := range ldu.inputs {
+		for _, sym := range in.obj.Symbols {
+			if sym.Bind == elf.STB_LOCAL || sym.Name == "" {
+				continue
+			}
+			d, ok := ldu.globals[sym.Name]
+			if !ok {
+				ldu.globals[sym.Name] = &definition{sym: sym, in: in}
+				ldu.order = append(ldu.order, sym.Name)
+				continue
+			}
+
+			replace := false
+			switch {
+			case !ldu.defines(sym):
+				// a strong reference is kept, as it needs a definition
+				replace = !ldu.defines(d.sym) && sym.Bind == elf.STB_GLOBAL
+			case !ldu.defines(d.sym):
+				replace = true
+			case sym.Shndx == elf.SHN_COMMON && d.sym.Shndx == elf.SHN_COMMON:
+				replace = sym.Size > d.sym.Size
+			case sym.Shndx == elf.SHN_COMMON:
+			case d.sym.Shndx == elf.SHN_COMMON:
+				replace = true
+			case sym.Bind == elf.STB_WEAK:
+			case d.sym.Bind == elf.STB_WEAK:
+				replace = true
+			default:
+				return errors.New("Multiple definitions of " + sym.Name + ", in " + d.in.name + " and " + in.name)
+			}
+			if replace {
+				d.sym, d.in = sym, in
+			}
+		}
+	}
+
+	for _, name := range ldu.order {
+		sym := ldu.globals[name].sym
+		if sym.Shndx != elf.SHN_COMMON {
+			continue
+		}
+		// the value of a common symbol is its alignment
+		sec := &common.Section{
+			Name:      ".bss",
+			Type:      elf.SHT_NOBITS,
+			Flags:     elf.SHF_ALLOC | elf.SHF_WRITE,
+			Addralign: sym.Value,
+			Size:      sym.Size,
+		}
+		ldu.commons = append(ldu.commons, sec)
+		sym.Section, sym.Shndx, sym.Value = sec, elf.SHN_UNDEF, 0
+	}
+	return nil
+}
+
+// address returns the value of sym in the output, that of the definition
+// for a global one; an undefined weak symbol comes to 0
+func (ldu *ldUtil) address(sym *common.Symbol) uint64 {
+	if sym.Bind != elf.STB_LOCAL {
+		if d, ok := ldu.globals[sym.Name]; ok {
+			sym = d.sym
+		}
+	}
+	if p, ok := ldu.placed[sym.Section]; ok {
+		return p.out.Addr + p.off + sym.Value
+	}
+	if sym.Shndx == elf.SHN_ABS {
+		return sym.Value
+	}
+	return 0
+}
+
+// provide defines the symbols of the default linker script of GNU ld that
+// the inputs refer to but do not define
+func (ldu *ldUtil) provide() {
+	var textEnd, dataEnd, end uint64
+	var bss, sdata *common.Section
+	for _, s := range ldu.out.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+		last := s.Addr + s.Len()
+		if s.Flags&elf.SHF_EXECINSTR != 0 {
+			textEnd = last
+		}
+		if s.Type != elf.SHT_NOBITS {
+			dataEnd = last
+		} else if bss == nil {
+			bss = s
+		}
+		if s.Name == ".sdata" {
+			sdata = s
+		}
+		end = last
+	}
+	// with nothing there, where they would be
+	bssStart, gp := dataEnd, dataEnd
+	if bss != nil {
+		bssStart = bss.Addr
+	}
+	if sdata != nil {
+		gp = sdata.Addr
+	}
+
+	provided := map[string]uint64{
+		"_etext":            textEnd,
+		"etext":             textEnd,
+		"_edata":            dataEnd,
+		"edata":             dataEnd,
+		"__bss_start":       bssStart,
+		"_end":              end,
+		"end":               end,
+		"__global_pointer$": gp + 0x800,
+	}
+	for _, name := range ldu.order {
+		d := ldu.globals[name]
+		if v, ok := provided[name]; ok && !ldu.defines(d.sym) {
+			d.sym = &common.Symbol{Name: name, Bind: elf.STB_GLOBAL, Shndx: elf.SHN_ABS, Value: v}
+			d.in = nil
+		}
+	}
+}
+
+// undefined tells of the first symbol that nothing defines but something
+// needs
+func (ldu *ldUtil) undefined() error {
+	for _, name := range ldu.order {
+		d := ldu.globals[name]
+		if !ldu.defines(d.sym) && d.sym.Bind != elf.STB_WEAK {
+			return errors.New("Undefined symbol " + name + ", referred to in " + d.in.name)
+		}
+	}
+	return nil
+}
+
+// symbols returns the symbol table of the output: the locals of each input,
+// then the globals, with their values as addresses.  Those of hidden
+// visibility become local, as they are of no use outside anymore.
+func (ldu *ldUtil) symbols() []*common.Symbol {
+	ret := make([]*common.Symbol, 0)
+	add := func(sym *common.Symbol, bind elf.SymBind) {
+		out := &common.Symbol{
+			Name:  sym.Name,
+			Bind:  bind,
+			Type:  sym.Type,
+			Other: sym.Other,
+			Shndx: sym.Shndx,
+			Value: sym.Value,
+			Size:  sym.Size,
+		}
+		if p, ok := ldu.placed[sym.Section]; ok {
+			out.Value = p.out.Addr + p.off + sym.Value
+			if p.out.Len() > 0 {
+				out.Section = p.out
+			} else {
+				out.Shndx = elf.SHN_ABS
+			}
+		}
+		ret = append(ret, out)
+	}
+
+	for _, in := range ldu.inputs {
+		for _, sym := range in.obj.Symbols {
+			if sym.Bind != elf.STB_LOCAL || sym.Type == elf.STT_SECTION {
+				continue
+			}
+			if _, ok := ldu.placed[sym.Section]; ok || sym.Section == nil {
+				add(sym, elf.STB_LOCAL)
+			}
+		}
+	}
+	for _, name := range ldu.order {
+		sym := ldu.globals[name].sym
+		bind := sym.Bind
+		switch elf.SymVis(sym.Other & 3) {
+		case elf.STV_HIDDEN, elf.STV_INTERNAL:
+			bind = elf.STB_LOCAL
+		}
+		add(sym, bind)
+	}
+	return ret
+}
@@ -28,19 +28,22 @@ import (
 
 	"github.com/NonerKao/go-binutils/as"
 	"github.com/NonerKao/go-binutils/common"
+	"github.com/NonerKao/go-binutils/ld"
 	"github.com/NonerKao/go-binutils/nm"
+	"github.com/NonerKao/go-binutils/objcopy"
 	"github.com/NonerKao/go-binutils/objdump"
 	"github.com/NonerKao/go-binutils/readelf"
 	"github.com/NonerKao/go-binutils/size"
+	"github.com/NonerKao/go-binutils/strip"
 )
 
 func main() {
 
 	util, err := route()
 	if err != nil {
-		fmt.Println(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
 		printUsage()
-		return
+		os.Exit(1)
 	}
 
 	args := util.DefineFlags()
@@ -50,20 +53,20 @@ func main() {
 	tail := flag.Args()
 	err1 := util.Init(tail[len(tail)-1])
 	if err1 != nil {
-		fmt.Println(err1.Error())
-		return
+		fmt.Fprintln(os.Stderr, err1.Error())
+		os.Exit(1)
 	}
 
 	err2 := util.Run(args)
 	if err2 != nil {
-		fmt.Println(err2.Error())
-		return
+		fmt.Fprintln(os.Stderr, err2.Error())
+		os.Exit(1)
 	}
 
 	err3 := util.Output(args)
 	if err3 != nil {
-		fmt.Println(err3.Error())
-		return
+		fmt.Fprintln(os.Stderr, err3.Error())
+		os.Exit(1)
 	}
 
 }
@@ -74,14 +77,20 @@ func route() (common.Util, error) {
 	switch {
 	case strings.HasSuffix(os.Args[0], "as"):
 		util = as.New()
+	case strings.HasSuffix(os.Args[0], "ld"):
+		util = ld.New()
 	case strings.HasSuffix(os.Args[0], "nm"):
 		util = nm.New()
+	case strings.HasSuffix(os.Args[0], "objcopy"):
+		util = objcopy.New()
 	case strings.HasSuffix(os.Args[0], "objdump"):
 		util = objdump.New()
 	case strings.HasSuffix(os.Args[0], "readelf"):
 		util = readelf.New()
 	case strings.HasSuffix(os.Args[0], "size"):
 		util = size.New()
+	case strings.HasSuffix(os.Args[0], "strip"):
+		util = strip.New()
 	default:
 		return nil, errors.New("No such usage!")
 	}
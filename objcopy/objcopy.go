@@ -0,0 +1,435 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package objcopy
+
+import (
+	"debug/elf"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/NonerKao/go-binutils/common"
+)
+
+// objcopy.go: copy an ELF file with its sections changed, or into a raw
+// binary, Intel HEX or S-records
+
+type objcopyUtil struct {
+	in, out string
+	mode    os.FileMode
+	obj     *common.Object
+	format  string // of the output
+	raw     []byte // the output, unless it is ELF
+}
+
+func New() *objcopyUtil {
+	return &objcopyUtil{obj: nil, raw: make([]byte, 0)}
+}
+
+// Init takes the output file, which main hands over; the input comes
+// before it, or is replaced if there is none
+func (ocu *objcopyUtil) Init(filename string) error {
+
+	ocu.in, ocu.out = filename, filename
+	if files := flag.Args(); len(files) > 1 {
+		ocu.in = files[len(files)-2]
+	}
+	info, err := os.Stat(ocu.in)
+	if err != nil {
+		return err
+	}
+	ocu.mode = info.Mode().Perm()
+
+	return nil
+}
+
+func (ocu *objcopyUtil) DefineFlags() map[string]interface{} {
+
+	args := map[string]interface{}{
+		"I":                 flag.String("I", "", "Input format: binary, or ELF if not given"),
+		"O":                 flag.String("O", "", "Output format: binary, ihex, srec, elf32-littleriscv or elf64-littleriscv; that of the input if not given"),
+		"gap-fill":          flag.String("gap-fill", "", "Fill the gaps between sections in binary, ihex and srec output with the byte"),
+		"pad-to":            flag.String("pad-to", "", "Pad binary, ihex and srec output up to the load address"),
+		"change-addresses":  flag.String("change-addresses", "0", "Add the value to the addresses of the sections and the start address"),
+		"j":                 new(common.Names),
+		"R":                 new(common.Names),
+		"set-section-flags": new(common.Names),
+		"add-section":       new(common.Names),
+		"rename-section":    new(common.Names),
+	}
+	flag.Var(args["j"].(*common.Names), "j", "Copy only the section of the name")
+	flag.Var(args["j"].(*common.Names), "only-section", "Same as -j")
+	flag.Var(args["R"].(*common.Names), "R", "Remove the section of the name")
+	flag.Var(args["R"].(*common.Names), "remove-section", "Same as -R")
+	flag.Var(args["set-section-flags"].(*common.Names), "set-section-flags", "name=flags: Set the flags of the section, such as alloc,contents,load,readonly,code")
+	flag.Var(args["add-section"].(*common.Names), "add-section", "name=file: Add a section of the content of the file")
+	flag.Var(args["rename-section"].(*common.Names), "rename-section", "old=new[,flags]: Rename the section, and set its flags if given")
+
+	return args
+}
+
+// elfFormats are the -O names of the ELF classes, as GNU objcopy gives
+// them for RISC-V
+var elfFormats = map[string]elf.Class{
+	"elf32-littleriscv": elf.ELFCLASS32,
+	"elf64-littleriscv": elf.ELFCLASS64,
+}
+
+// fromBinary wraps the content of the file in the .data of an object,
+// between the symbols _binary_<name>_start and _end, with its size in
+// _binary_<name>_size; the name is that of the file, with every character
+// but letters and digits turned into an underscore
+func fromBinary(name string, class elf.Class) (*common.Object, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	o := common.NewObject(class, elf.ET_REL, elf.EM_RISCV)
+	data := &common.Section{
+		Name:      ".data",
+		Type:      elf.SHT_PROGBITS,
+		Flags:     elf.SHF_ALLOC | elf.SHF_WRITE,
+		Addralign: 1,
+		Data:      b,
+	}
+	o.Sections = append(o.Sections, data)
+
+	mangled := []byte(name)
+	for i, c := range mangled {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			mangled[i] = '_'
+		}
+	}
+	prefix := "_binary_" + string(mangled)
+	size := uint64(len(b))
+	o.Symbols = append(o.Symbols,
+		&common.Symbol{Name: prefix + "_start", Bind: elf.STB_GLOBAL, Section: data},
+		&common.Symbol{Name: prefix + "_end", Bind: elf.STB_GLOBAL, Section: data, Value: size},
+		&common.Symbol{Name: prefix + "_size", Bind: elf.STB_GLOBAL, Shndx: elf.SHN_ABS, Value: size},
+	)
+	return o, nil
+}
+
+// load reads the input in its format, and checks the output format
+func (ocu *objcopyUtil) load(in, out string) error {
+	var err error
+	class, toELF := elfFormats[out]
+	switch out {
+	case "", "binary", "ihex", "srec":
+	default:
+		if !toELF {
+			return errors.New("Unknown output format " + out)
+		}
+	}
+	ocu.format = out
+
+	switch in {
+	case "binary":
+		if out == "" {
+			ocu.format = "elf64-littleriscv"
+		}
+		if !toELF {
+			class = elf.ELFCLASS64
+		}
+		ocu.obj, err = fromBinary(ocu.in, class)
+		return err
+	case "":
+		ocu.obj, err = common.Open(ocu.in)
+		if err != nil {
+			return err
+		}
+		if toELF && class != ocu.obj.Class {
+			return errors.New("Cannot copy an " + ocu.obj.Class.String() + " file into " + out)
+		}
+		return nil
+	}
+	return errors.New("Unknown input format " + in)
+}
+
+// keyValue splits the name=value of an option
+func keyValue(opt, arg string) (string, string, error) {
+	i := strings.Index(arg, "=")
+	if i <= 0 {
+		return "", "", errors.New("Bad --" + opt + " " + arg + ": name=value expected")
+	}
+	return arg[:i], arg[i+1:], nil
+}
+
+// setFlags gives the section the flags of --set-section-flags, which
+// replace those it has, but for the ones that tell how it relates to
+// others.  A section is writable unless it is readonly, and one without
+// contents becomes one with when given contents.
+func setFlags(s *common.Section, words string) error {
+	flags := elf.SHF_WRITE
+	contents := false
+	for _, w := range strings.Split(words, ",") {
+		switch strings.ToLower(strings.TrimSpace(w)) {
+		case "alloc":
+			flags |= elf.SHF_ALLOC
+		case "readonly":
+			flags &^= elf.SHF_WRITE
+		case "code":
+			flags |= elf.SHF_EXECINSTR
+		case "merge":
+			flags |= elf.SHF_MERGE
+		case "strings":
+			flags |= elf.SHF_STRINGS
+		case "contents", "load":
+			contents = true
+		case "noload", "data", "rom", "share", "debug":
+		default:
+			return errors.New("Unknown section flag " + w)
+		}
+	}
+	if flags&elf.SHF_ALLOC == 0 {
+		flags &^= elf.SHF_WRITE
+	}
+
+	kept := elf.SHF_INFO_LINK | elf.SHF_LINK_ORDER | elf.SHF_OS_NONCONFORMING | elf.SHF_GROUP | elf.SHF_TLS | elf.SHF_COMPRESSED
+	s.Flags = s.Flags&kept | flags
+	if contents && s.Type == elf.SHT_NOBITS {
+		s.Type, s.Data = elf.SHT_PROGBITS, make([]byte, s.Size)
+	}
+	return nil
+}
+
+// removeSection takes s out, and the members of a group out of it
+func (ocu *objcopyUtil) removeSection(s *common.Section) {
+	for _, m := range s.Members {
+		m.Flags &^= elf.SHF_GROUP
+	}
+	ocu.obj.RemoveSection(s)
+}
+
+// kept tells if -j keeps the section: one of those named, the relocations
+// of one, or a table the others need
+func (ocu *objcopyUtil) kept(s *common.Section, only *common.Names) bool {
+	o := ocu.obj
+	switch {
+	case only.Has(s.Name), s == o.SymTab, s == o.StrTab, s == o.ShStrTab:
+		return true
+	case s.Type == elf.SHT_RELA || s.Type == elf.SHT_REL:
+		return s.Info != nil && only.Has(s.Info.Name)
+	}
+	return false
+}
+
+// removeSections carries out -j and -R.  The symbols of the sections go
+// with them; those relocations still need fail when the object is written.
+func (ocu *objcopyUtil) removeSections(only, remove *common.Names) {
+	o := ocu.obj
+	for _, s := range append([]*common.Section(nil), o.Sections...) {
+		if remove.Has(s.Name) || (len(*only) > 0 && !ocu.kept(s, only)) {
+			ocu.removeSection(s)
+		}
+	}
+	// a group that has lost all its members goes as well
+	for _, s := range append([]*common.Section(nil), o.Sections...) {
+		if s.Type == elf.SHT_GROUP && s.Signature != nil && len(s.Members) == 0 {
+			o.RemoveSection(s)
+		}
+	}
+
+	alive := make(map[*common.Section]bool)
+	for _, s := range o.Sections {
+		alive[s] = true
+	}
+	need := make(map[*common.Symbol]bool)
+	for _, s := range o.Sections {
+		for _, r := range s.Relocs {
+			need[r.Sym] = true
+		}
+	}
+	o.RemoveSymbols(func(sym *common.Symbol) bool {
+		return sym.Section != nil && !alive[sym.Section] && !need[sym]
+	})
+}
+
+// renameSection carries out --rename-section old=new[,flags]; the
+// relocations of the section are renamed along with it
+func (ocu *objcopyUtil) renameSection(arg string) error {
+	old, to, err := keyValue("rename-section", arg)
+	if err != nil {
+		return err
+	}
+	flags := ""
+	if i := strings.Index(to, ","); i >= 0 {
+		to, flags = to[:i], to[i+1:]
+	}
+
+	s := ocu.obj.Section(old)
+	if s == nil {
+		fmt.Fprintln(os.Stderr, "Warning: no section "+old+" to rename")
+		return nil
+	}
+	for _, r := range ocu.obj.Sections {
+		if r.Info == s && (r.Name == ".rela"+old || r.Name == ".rel"+old) {
+			r.Name = strings.Replace(r.Name, old, to, 1)
+		}
+	}
+	s.Name = to
+	if flags != "" {
+		return setFlags(s, flags)
+	}
+	return nil
+}
+
+// addSection carries out --add-section name=file with a section of the
+// content of the file, which is not loaded
+func (ocu *objcopyUtil) addSection(arg string) error {
+	name, file, err := keyValue("add-section", arg)
+	if err != nil {
+		return err
+	}
+	if ocu.obj.Section(name) != nil {
+		return errors.New("Section " + name + " already exists!")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	ocu.obj.Sections = append(ocu.obj.Sections, &common.Section{
+		Name:      name,
+		Type:      elf.SHT_PROGBITS,
+		Addralign: 1,
+		Data:      b,
+	})
+	return nil
+}
+
+// changeAddresses adds incr to the addresses of the allocated sections,
+// the segments that hold them and the start address.  The symbols of an executable or
+// shared object move along with their sections; those of a relocatable
+// object are offsets into them.
+func (ocu *objcopyUtil) changeAddresses(incr uint64) {
+	o := ocu.obj
+	for _, s := range o.Sections {
+		if s.Flags&elf.SHF_ALLOC != 0 {
+			s.Addr += incr
+		}
+	}
+	for _, p := range o.Segments {
+		if len(p.Sections) > 0 || p.Type == elf.PT_PHDR {
+			p.Vaddr += incr
+			p.Paddr += incr
+		}
+	}
+	if o.Type != elf.ET_REL {
+		for _, sym := range o.Symbols {
+			if sym.Section != nil && sym.Section.Flags&elf.SHF_ALLOC != 0 {
+				sym.Value += incr
+			}
+		}
+	}
+	o.Entry += incr
+}
+
+func (ocu *objcopyUtil) Run(args map[string]interface{}) error {
+
+	if err := ocu.load(*args["I"].(*string), *args["O"].(*string)); err != nil {
+		return err
+	}
+	ocu.removeSections(args["j"].(*common.Names), args["R"].(*common.Names))
+
+	for _, arg := range *args["rename-section"].(*common.Names) {
+		if err := ocu.renameSection(arg); err != nil {
+			return err
+		}
+	}
+	for _, arg := range *args["set-section-flags"].(*common.Names) {
+		name, flags, err := keyValue("set-section-flags", arg)
+		if err != nil {
+			return err
+		}
+		s := ocu.obj.Section(name)
+		if s == nil {
+			fmt.Fprintln(os.Stderr, "Warning: no section "+name+" to set the flags of")
+			continue
+		}
+		if err := setFlags(s, flags); err != nil {
+			return err
+		}
+	}
+	for _, arg := range *args["add-section"].(*common.Names) {
+		if err := ocu.addSection(arg); err != nil {
+			return err
+		}
+	}
+
+	incr, err := strconv.ParseInt(*args["change-addresses"].(*string), 0, 64)
+	if err != nil {
+		return errors.New("Bad --change-addresses " + *args["change-addresses"].(*string))
+	}
+	if incr != 0 {
+		ocu.changeAddresses(uint64(incr))
+	}
+
+	switch ocu.format {
+	case "binary", "ihex", "srec":
+		return ocu.image(*args["gap-fill"].(*string), *args["pad-to"].(*string))
+	}
+	return nil
+}
+
+// image lays out the memory image of the object for -O binary, ihex or
+// srec.  A binary file starts at the lowest load address, with zeros in
+// the gaps unless --gap-fill tells otherwise.
+func (ocu *objcopyUtil) image(gapFill, pad string) error {
+	chunks := loadChunks(ocu.obj)
+
+	fill := byte(0)
+	if gapFill != "" {
+		v, err := strconv.ParseUint(gapFill, 0, 8)
+		if err != nil {
+			return errors.New("Bad --gap-fill " + gapFill)
+		}
+		fill = byte(v)
+		chunks = fillGaps(chunks, fill)
+	}
+	if pad != "" {
+		v, err := strconv.ParseUint(pad, 0, 64)
+		if err != nil {
+			return errors.New("Bad --pad-to " + pad)
+		}
+		chunks = padTo(chunks, v, fill)
+	}
+
+	var err error
+	switch ocu.format {
+	case "binary":
+		ocu.raw = binary(chunks)
+	case "ihex":
+		ocu.raw, err = ihex(chunks, ocu.obj.Entry)
+	case "srec":
+		ocu.raw, err = srec(chunks, ocu.obj.Entry, ocu.out)
+	}
+	return err
+}
+
+func (ocu *objcopyUtil) Output(args map[string]interface{}) error {
+
+	switch ocu.format {
+	case "binary", "ihex", "srec":
+		return os.WriteFile(ocu.out, ocu.raw, ocu.mode)
+	}
+	return ocu.obj.WriteFile(ocu.out, ocu.mode)
+}
@@ -0,0 +1,251 @@
+//
+// Copyright (C) 2017  Alan (Quey-Liang) Kao  alankao@andestech.com
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package objcopy
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NonerKao/go-binutils/common"
+)
+
+// raw.go: the memory images of -O binary, ihex and srec
+
+// a run of bytes to load at an address
+type chunk struct {
+	addr uint64
+	data []byte
+}
+
+func (c *chunk) end() uint64 {
+	return c.addr + uint64(len(c.data))
+}
+
+// loadChunks returns what the object loads into memory, by load address:
+// the sections of the PT_LOAD segments, or the allocated sections of a
+// file without any
+func loadChunks(o *common.Object) []*chunk {
+	ret := make([]*chunk, 0)
+	add := func(s *common.Section, lma uint64) {
+		if s.Type != elf.SHT_NOBITS && s.Flags&elf.SHF_ALLOC != 0 && len(s.Data) > 0 {
+			ret = append(ret, &chunk{addr: lma, data: s.Data})
+		}
+	}
+
+	loads := false
+	seen := make(map[*common.Section]bool)
+	for _, p := range o.Segments {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		loads = true
+		for _, s := range p.Sections {
+			if !seen[s] {
+				seen[s] = true
+				add(s, p.Paddr+s.Addr-p.Vaddr)
+			}
+		}
+	}
+	if !loads {
+		for _, s := range o.Sections {
+			add(s, s.Addr)
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].addr < ret[j].addr
+	})
+	return ret
+}
+
+// fillGaps fills the gaps between the chunks with the byte.  The fill
+// makes chunks of its own, as GNU objcopy writes it apart from the
+// sections it lengthens, and their records start where it does.
+func fillGaps(chunks []*chunk, b byte) []*chunk {
+	ret := make([]*chunk, 0, 2*len(chunks))
+	for i, c := range chunks {
+		ret = append(ret, c)
+		if i+1 < len(chunks) && chunks[i+1].addr > c.end() {
+			ret = append(ret, filled(c.end(), chunks[i+1].addr, b))
+		}
+	}
+	return ret
+}
+
+// padTo fills from the end of the last chunk up to the address with the
+// byte
+func padTo(chunks []*chunk, addr uint64, b byte) []*chunk {
+	if len(chunks) > 0 && addr > chunks[len(chunks)-1].end() {
+		chunks = append(chunks, filled(chunks[len(chunks)-1].end(), addr, b))
+	}
+	return chunks
+}
+
+// filled returns a chunk from start up to end, of the byte
+func filled(start, end uint64, b byte) *chunk {
+	data := make([]byte, end-start)
+	for i := range data {
+		data[i] = b
+	}
+	return &chunk{addr: start, data: data}
+}
+
+// binary lays the chunks out from the lowest address on, with zeros
+// between them
+func binary(chunks []*chunk) []byte {
+	if len(chunks) == 0 {
+		return []byte{}
+	}
+	start, end := chunks[0].addr, chunks[0].end()
+	for _, c := range chunks {
+		if c.end() > end {
+			end = c.end()
+		}
+	}
+	ret := make([]byte, end-start)
+	for _, c := range chunks {
+		copy(ret[c.addr-start:], c.data)
+	}
+	return ret
+}
+
+// the longest data of an Intel HEX record or an S-record, as GNU objcopy
+// writes them
+const recordLen = 16
+
+// ihexRecord writes a record of the type and address, ending with the
+// two's complement of the sum of its bytes
+func ihexRecord(sb *strings.Builder, typ byte, addr uint16, data []byte) {
+	rec := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), typ}, data...)
+	sum := byte(0)
+	for _, b := range rec {
+		sum += b
+	}
+	fmt.Fprintf(sb, ":%X%02X\r\n", rec, -sum)
+}
+
+// ihex writes the chunks as Intel HEX.  An address past 64K takes an
+// extended segment address record up to 1M, and an extended linear
+// address record beyond; so does the start address.
+func ihex(chunks []*chunk, entry uint64) ([]byte, error) {
+	var sb strings.Builder
+	var segbase, extbase uint64
+	for _, c := range chunks {
+		for off := 0; off < len(c.data); {
+			where := c.addr + uint64(off)
+			if where > 0xffffffff {
+				return nil, errors.New("Address 0x" + strconv.FormatUint(where, 16) + " does not fit in Intel HEX")
+			}
+			if where > segbase+extbase+0xffff {
+				if extbase == 0 && where <= 0xfffff {
+					segbase = where & 0xf0000
+					ihexRecord(&sb, 2, 0, []byte{byte(segbase >> 12), byte(segbase >> 4)})
+				} else {
+					if segbase != 0 {
+						segbase = 0
+						ihexRecord(&sb, 2, 0, []byte{0, 0})
+					}
+					extbase = where & 0xffff0000
+					ihexRecord(&sb, 4, 0, []byte{byte(extbase >> 24), byte(extbase >> 16)})
+				}
+			}
+
+			// no record crosses a 64K boundary
+			addr := where - extbase - segbase
+			n := len(c.data) - off
+			if n > recordLen {
+				n = recordLen
+			}
+			if addr+uint64(n) > 0x10000 {
+				n = int(0x10000 - addr)
+			}
+			ihexRecord(&sb, 0, uint16(addr), c.data[off:off+n])
+			off += n
+		}
+	}
+
+	switch {
+	case entry == 0:
+	case entry <= 0xfffff:
+		ihexRecord(&sb, 3, 0, []byte{byte((entry & 0xf0000) >> 12), 0, byte(entry >> 8), byte(entry)})
+	case entry <= 0xffffffff:
+		ihexRecord(&sb, 5, 0, []byte{byte(entry >> 24), byte(entry >> 16), byte(entry >> 8), byte(entry)})
+	default:
+		return nil, errors.New("Start address 0x" + strconv.FormatUint(entry, 16) + " does not fit in Intel HEX")
+	}
+	ihexRecord(&sb, 1, 0, nil)
+	return []byte(sb.String()), nil
+}
+
+// srecRecord writes an S-record of the type with an address of the width,
+// ending with the one's complement of the sum of its bytes
+func srecRecord(sb *strings.Builder, typ byte, width int, addr uint64, data []byte) {
+	rec := []byte{byte(width + len(data) + 1)}
+	for i := width - 1; i >= 0; i-- {
+		rec = append(rec, byte(addr>>(8*uint(i))))
+	}
+	rec = append(rec, data...)
+	sum := byte(0)
+	for _, b := range rec {
+		sum += b
+	}
+	fmt.Fprintf(sb, "S%d%X%02X\r\n", typ, rec, ^sum)
+}
+
+// srec writes the chunks as S-records, after a header of the name.  The
+// records are S1, S2 or S3, whichever the highest address fits in, and the
+// start address ends them in S9, S8 or S7 to match.
+func srec(chunks []*chunk, entry uint64, name string) ([]byte, error) {
+	typ := byte(1)
+	for _, c := range chunks {
+		last := c.end() - 1
+		switch {
+		case last > 0xffffffff:
+			return nil, errors.New("Address 0x" + strconv.FormatUint(last, 16) + " does not fit in S-records")
+		case last > 0xffffff:
+			typ = 3
+		case last > 0xffff && typ < 2:
+			typ = 2
+		}
+	}
+	if entry > 0xffffffff {
+		return nil, errors.New("Start address 0x" + strconv.FormatUint(entry, 16) + " does not fit in S-records")
+	}
+	width := int(typ) + 1
+
+	var sb strings.Builder
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	srecRecord(&sb, 0, 2, 0, []byte(name))
+	for _, c := range chunks {
+		for off := 0; off < len(c.data); off += recordLen {
+			end := off + recordLen
+			if end > len(c.data) {
+				end = len(c.data)
+			}
+			srecRecord(&sb, typ, width, c.addr+uint64(off), c.data[off:end])
+		}
+	}
+	srecRecord(&sb, 10-typ, width, entry, nil)
+	return []byte(sb.String()), nil
+}
@@ -19,9 +19,11 @@ package objdump
 
 import (
 	"debug/elf"
+	"errors"
 	"flag"
 	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/NonerKao/go-binutils/common"
 	"github.com/NonerKao/go-binutils/rvgc"
@@ -36,10 +38,11 @@ type objdumpUtil struct {
 	file   *elf.File
 	raw    []string
 	labels []label
+	relocs []string
 }
 
 func New() *objdumpUtil {
-	return &objdumpUtil{file: nil, raw: make([]string, 0), labels: make([]label, 0)}
+	return &objdumpUtil{file: nil, raw: make([]string, 0), labels: make([]label, 0), relocs: make([]string, 0)}
 }
 
 func (obu *objdumpUtil) Init(filename string) error {
@@ -57,13 +60,53 @@ func (obu *objdumpUtil) DefineFlags() map[string]interface{} {
 
 	args := map[string]interface{}{
 		"d": flag.Bool("d", false, "disassemble text section"),
+		"r": flag.Bool("r", false, "display relocation entries"),
+		"M": flag.String("M", "", "disassembler options, comma-separated: no-aliases, or an ISA string such as rv64gcv to override the one recorded in the file"),
 	}
 
 	return args
 }
 
+// setOptions applies the -M options.  The ISA to disassemble for is the one
+// given there, or else the one recorded in .riscv.attributes, or else
+// rvgc.DefaultISA, narrowed to RV32 for an ELFCLASS32 file.
+func (obu *objdumpUtil) setOptions(options string) error {
+	arch, err := common.RISCVArch(obu.file)
+	if err != nil {
+		return err
+	}
+	for _, opt := range strings.Split(options, ",") {
+		switch {
+		case opt == "":
+		case opt == "no-aliases":
+			rvgc.SetAliases(false)
+		case strings.HasPrefix(opt, "rv"):
+			arch = opt
+		default:
+			return errors.New("Unknown disassembler option " + opt)
+		}
+	}
+	if arch == "" {
+		arch = rvgc.DefaultISA
+		if obu.file.Class == elf.ELFCLASS32 {
+			arch = "rv32" + strings.TrimPrefix(arch, "rv64")
+		}
+	}
+
+	isa, err := rvgc.ParseISA(arch)
+	if err != nil {
+		return err
+	}
+	rvgc.SetISA(isa)
+	return nil
+}
+
 func (obu *objdumpUtil) Run(args map[string]interface{}) error {
 
+	if err := obu.setOptions(*args["M"].(*string)); err != nil {
+		return err
+	}
+
 	if *args["d"].(*bool) {
 		var text int
 
@@ -92,10 +135,62 @@ func (obu *objdumpUtil) Run(args map[string]interface{}) error {
 		bin, _ := obu.file.Sections[text].Data()
 		for len(bin) > 0 {
 			obu.raw = append(obu.raw, rvgc.BinToInst(bin))
-			bin = bin[4:]
+			n := rvgc.InstLen(bin)
+			if n > len(bin) {
+				n = len(bin)
+			}
+			bin = bin[n:]
 		}
 	}
 
+	if *args["r"].(*bool) {
+		if err := obu.relocations(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// relocations lists the entries of every relocation section, in the
+// layout of GNU objdump -r
+func (obu *objdumpUtil) relocations() error {
+	symtab, _ := obu.file.Symbols()
+	width := 16
+	if obu.file.Class == elf.ELFCLASS32 {
+		width = 8
+	}
+
+	for _, sec := range obu.file.Sections {
+		if sec.Type != elf.SHT_RELA || int(sec.Info) >= len(obu.file.Sections) {
+			continue
+		}
+		relas, err := common.Relocations(obu.file, sec)
+		if err != nil {
+			return err
+		}
+		obu.relocs = append(obu.relocs, "",
+			"RELOCATION RECORDS FOR ["+obu.file.Sections[sec.Info].Name+"]:",
+			fmt.Sprintf("%-*s %-24s %s", width, "OFFSET", "TYPE", "VALUE"))
+		for _, r := range relas {
+			// symbol 0 is the null symbol, which Symbols leaves out
+			value := "*ABS*"
+			if i := int(elf.R_SYM64(r.Info)); i > 0 && i <= len(symtab) {
+				s := symtab[i-1]
+				value = s.Name
+				if elf.ST_TYPE(s.Info) == elf.STT_SECTION && int(s.Section) < len(obu.file.Sections) {
+					value = obu.file.Sections[s.Section].Name
+				}
+			}
+			if r.Addend > 0 {
+				value += fmt.Sprintf("+0x%x", r.Addend)
+			} else if r.Addend < 0 {
+				value += fmt.Sprintf("-0x%x", -r.Addend)
+			}
+			obu.relocs = append(obu.relocs, fmt.Sprintf("%0*x %-24s %s",
+				width, r.Off, strings.TrimPrefix(elf.R_RISCV(elf.R_TYPE64(r.Info)).String(), "elf."), value))
+		}
+	}
 	return nil
 }
 
@@ -109,6 +204,11 @@ func (obu *objdumpUtil) Output(args map[string]interface{}) error {
 			fmt.Println(s)
 		}
 	}
+	if *args["r"].(*bool) {
+		for _, s := range obu.relocs {
+			fmt.Println(s)
+		}
+	}
 
 	return nil
 }
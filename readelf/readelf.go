@@ -19,7 +19,6 @@ package readelf
 
 import (
 	"debug/elf"
-	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -35,6 +34,13 @@ type readelfUtil struct {
 	raw  map[string][]byte
 }
 
+// the relocations of one relocation section, as -r lists them
+type relaSection struct {
+	Name   string
+	Offset uint64
+	Relas  []elf.Rela64
+}
+
 func New() *readelfUtil {
 	return &readelfUtil{file: nil, raw: make(map[string][]byte)}
 }
@@ -106,31 +112,24 @@ func (reu *readelfUtil) Run(args map[string]interface{}) error {
 	}
 
 	if *args["r"].(*bool) {
-		var index int
-		for i, p := range reu.file.Sections {
-			if p.Name == ".rela.text" {
-				index = i
-				break
+		secs := make([]relaSection, 0)
+		for _, sec := range reu.file.Sections {
+			if sec.Type != elf.SHT_RELA && sec.Type != elf.SHT_REL {
+				continue
 			}
-		}
-
-		var rela elf.Rela64
-		str := "]"
-		var end error
-		r := reu.file.Sections[index].Open()
-		for ; end == nil; end = binary.Read(r, binary.LittleEndian, &rela) {
-
-			raw, err := json.Marshal(rela)
+			relas, err := common.Relocations(reu.file, sec)
 			if err != nil {
 				return err
 			}
+			secs = append(secs, relaSection{Name: sec.Name, Offset: sec.Offset, Relas: relas})
+		}
 
-			str = "," + string(raw) + str
+		raw, err := json.Marshal(secs)
+		if err != nil {
+			return err
 		}
-		re, _ := regexp.Compile("^,")
-		str = re.ReplaceAllString(str, "[")
 
-		reu.raw["r"] = []byte(str)
+		reu.raw["r"] = raw
 	}
 
 	return nil
@@ -190,23 +189,26 @@ func (reu *readelfUtil) Output(args map[string]interface{}) error {
 	}
 
 	if *args["r"].(*bool) {
-		var output []elf.Rela64
+		var output []relaSection
 		json.Unmarshal(reu.raw["r"], &output)
 
-		fmt.Fprintln(w, "Relocation:\t\t\t")
-		fmt.Fprintln(w, "Offset\tType\tSymbol\tAppend")
-
 		syms, _ := reu.file.Symbols()
 
-		for _, s := range output {
-			if elf.R_SYM64(s.Info) == 0 {
-				continue
+		for _, sec := range output {
+			fmt.Fprintf(w, "Relocation section %s at offset 0x%x contains %d entries:\n",
+				sec.Name, sec.Offset, len(sec.Relas))
+			fmt.Fprintln(w, "Offset\tType\tSymbol\tAppend")
+			for _, s := range sec.Relas {
+				name := ""
+				if i := elf.R_SYM64(s.Info); i != 0 && int(i) <= len(syms) {
+					name = syms[i-1].Name
+				}
+
+				fmt.Fprintf(w, "%016x\t%s\t%s\t%d\n",
+					s.Off, elf.R_RISCV(elf.R_TYPE64(s.Info)).GoString(), name, s.Addend)
 			}
-
-			fmt.Fprintf(w, "%016x\t%s\t%s\t%d\n",
-				s.Off, elf.R_RISCV(elf.R_TYPE64(s.Info)).GoString(), syms[elf.R_SYM64(s.Info)-1].Name, s.Addend)
+			fmt.Fprintln(w)
 		}
-		fmt.Fprintln(w)
 		w.Flush()
 	}
 
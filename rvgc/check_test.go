@@ -0,0 +1,176 @@
+package rvgc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sample operands used by TestRoundTrip, one per operand letter of instDesc.args
+var sampleOperand = map[rune]string{
+	'd': "a0",
+	's': "a1",
+	't': "a2",
+	'j': "-5",
+	'o': "-5",
+	'q': "-5",
+	'p': "ff4",
+	'a': "ffff4",
+	'u': "12345",
+	'E': "mstatus",
+	'Z': "17",
+	'P': "iorw",
+	'Q': "rw",
+	'D': "fa0",
+	'S': "fa1",
+	'T': "fs2",
+	'R': "ft11",
+	'm': "rtz",
+	'>': "3f",
+	'<': "1f",
+	'v': "v1",
+	'V': "v2",
+	'W': "v3",
+	'i': "-5",
+	'k': "17",
+	'g': "e32,m2,ta,mu",
+	'h': "e16,mf2,tu,ma",
+	'M': "v0.t",
+	'0': "v0",
+}
+
+// TestRoundTrip round-trips every entry of the instruction table: a sample
+// instruction is encoded, the result decoded, and the decoded text encoded
+// once more.  Any mismatch means the encoder and the decoder disagree.
+// Both RV64 and RV32 are checked, each with the instructions it has.
+func TestRoundTrip(t *testing.T) {
+	saved, savedEv := current, evaluate
+	defer SetISA(saved)
+	defer SetEvaluator(savedEv)
+	SetEvaluator(nil)
+	all := &ISA{XLEN: 64, ext: map[string]bool{"c": true}}
+	for _, d := range instTable {
+		all.ext[d.ext] = true
+	}
+	SetISA(all)
+
+	valid := make(map[*rvcDesc]bool)
+	for _, xlen := range []int{64, 32} {
+		all.XLEN = xlen
+		if err := checkTables(valid); err != nil {
+			t.Error("rv" + strconv.Itoa(xlen) + " " + err.Error())
+		}
+	}
+	for i := range rvcTable {
+		if !valid[&rvcTable[i]] {
+			t.Error(rvcTable[i].mnem + ": no valid sample")
+		}
+	}
+}
+
+// checkTables does the checks of TestRoundTrip for the current ISA, noting in
+// valid the compressed instructions it found a valid sample of
+func checkTables(valid map[*rvcDesc]bool) error {
+	for i := range instTable {
+		if !instTable[i].enabled(current) {
+			continue
+		}
+		if err := checkInst(&instTable[i], false); err != nil {
+			return err
+		}
+	}
+
+	for i := range aliasTable {
+		if !aliasTable[i].enabled(current) {
+			continue
+		}
+		if err := checkInst(&aliasTable[i], false); err != nil {
+			return err
+		}
+	}
+
+	// a pseudo-instruction decodes to something else, which has to encode
+	// the same
+	for i := range pseudoTable {
+		if err := checkInst(&pseudoTable[i], true); err != nil {
+			return err
+		}
+	}
+
+	// every compressed instruction must survive an expansion followed by
+	// compression, possibly into another compressed instruction with the
+	// same meaning.  The free bits are filled with a few patterns, at least
+	// one of which has to be valid for the instruction.
+	for i := range rvcTable {
+		c := &rvcTable[i]
+		for _, pattern := range []uint16{0xffff, 0x5555, 0xaaaa, 0x1084} {
+			h := c.match | pattern&^c.mask
+			if found := lookupRVC(h, current); found == nil || found.mnem != c.mnem {
+				continue
+			}
+			valid[c] = true
+
+			bin := make([]byte, 2)
+			binary.LittleEndian.PutUint16(bin, h)
+			again := Compress(Expand(bin))
+			if len(again) != 2 || !bytes.Equal(Expand(bin), Expand(again)) {
+				return errors.New(c.mnem + ": " + BinToInst(bin) + " does not compress back")
+			}
+
+			// so does what the entry stands for; an entry that only
+			// compresses, as c.mv does addi, has to give the same bits
+			own := make([]byte, 4)
+			binary.LittleEndian.PutUint32(own, c.expand(h))
+			again = Compress(own)
+			if lookupRVC(h, current) == c && !bytes.Equal(Expand(again), own) ||
+				lookupRVC(h, current) != c && !bytes.Equal(again, bin) {
+				return errors.New(c.mnem + ": " + BinToInst(own) + " does not compress back")
+			}
+		}
+	}
+	return nil
+}
+
+func checkInst(d *instDesc, alias bool) error {
+	text := d.mnem
+	ops := make([]string, 0)
+	if d.args != "" {
+		text += " "
+	}
+	for _, c := range d.args {
+		if !isOperand(c) {
+			text += string(c)
+			continue
+		}
+		text += sampleOperand[c]
+		ops = append(ops, sampleOperand[c])
+	}
+
+	bits, _, err := encodeArgs(d, ops, nil)
+	if err != nil {
+		return errors.New(d.mnem + ": " + err.Error())
+	}
+	bin := make([]byte, 4)
+	binary.LittleEndian.PutUint32(bin, bits)
+	dis := BinToInst(bin)
+	if !alias && dis != text {
+		return errors.New(d.mnem + ": decoded as " + dis + ", expected " + text)
+	}
+
+	fields := strings.FieldsFunc(dis, func(c rune) bool {
+		return c == ' ' || !isOperand(c)
+	})
+	again, _, err := InstToBin(fields)
+	if err != nil {
+		return errors.New(d.mnem + ": " + err.Error())
+	}
+	// InstToBin takes the first form of a mnemonic, so that one of the
+	// others, such as the mv of add, only has to mean the same
+	if !bytes.Equal(bin, again) && (mnem2inst[d.mnem][0] == d || BinToInst(again) != dis) {
+		return errors.New(d.mnem + ": re-encoding " + dis + " differs")
+	}
+	return nil
+}
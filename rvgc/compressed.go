@@ -0,0 +1,307 @@
+package rvgc
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// compressed.go: the "C" extension.  A compressed instruction is never
+// printed or parsed on its own; it is expanded into the 32-bit instruction it
+// stands for, and Compress goes the other way.
+
+type rvcFormat int
+
+const (
+	rvcCR rvcFormat = iota
+	rvcCI
+	rvcCSS
+	rvcCIW
+	rvcCL
+	rvcCB
+	rvcCJ
+)
+
+// the bits carrying the immediate in each format, from high to low
+var rvcImmPos = map[rvcFormat][]uint{
+	rvcCR:  {},
+	rvcCI:  {12, 6, 5, 4, 3, 2},
+	rvcCSS: {12, 11, 10, 9, 8, 7},
+	rvcCIW: {12, 11, 10, 9, 8, 7, 6, 5},
+	rvcCL:  {12, 11, 10, 6, 5},
+	rvcCB:  {12, 11, 10, 6, 5, 4, 3, 2},
+	rvcCJ:  {12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2},
+}
+
+// rvcDesc describes one compressed instruction.  imm lists the immediate bits
+// held by the format's immediate field, in the notation of the spec, e.g.
+// "5|4:0".  regs tells where rd, rs1 and rs2 of the expanded instruction come
+// from:
+//
+//	d	bits 11:7
+//	t	bits 6:2
+//	D	bits 9:7, one of x8-x15
+//	T	bits 4:2, one of x8-x15
+//	0	x0
+//	1	ra
+//	2	sp
+//	-	unused
+//
+// nz lists what must not be zero: the register fields d and t, or i for the
+// immediate.  A later entry of the same mnem only compresses another
+// instruction of the same meaning; the first one is what it expands to.  xlen, if set, is the only XLEN the encoding means this
+// instruction in; the expanded instruction has to exist for the ISA anyway.
+type rvcDesc struct {
+	mnem   string
+	match  uint16
+	mask   uint16
+	format rvcFormat
+	imm    string
+	signed bool
+	nz     string
+	inst   string
+	regs   string
+	xlen   int
+	bits   []uint
+}
+
+var rvcTable = []rvcDesc{
+	// quadrant 0
+	{mnem: "c.addi4spn", match: 0x0000, mask: 0xe003, format: rvcCIW, imm: "5:4|9:6|2|3", nz: "i", inst: "addi", regs: "T2-"},
+	{mnem: "c.fld", match: 0x2000, mask: 0xe003, format: rvcCL, imm: "5:3|7:6", inst: "fld", regs: "TD-"},
+	{mnem: "c.lw", match: 0x4000, mask: 0xe003, format: rvcCL, imm: "5:3|2|6", inst: "lw", regs: "TD-"},
+	{mnem: "c.ld", match: 0x6000, mask: 0xe003, format: rvcCL, imm: "5:3|7:6", inst: "ld", regs: "TD-"},
+	{mnem: "c.flw", match: 0x6000, mask: 0xe003, format: rvcCL, imm: "5:3|2|6", inst: "flw", regs: "TD-", xlen: 32},
+	{mnem: "c.fsd", match: 0xa000, mask: 0xe003, format: rvcCL, imm: "5:3|7:6", inst: "fsd", regs: "-DT"},
+	{mnem: "c.sw", match: 0xc000, mask: 0xe003, format: rvcCL, imm: "5:3|2|6", inst: "sw", regs: "-DT"},
+	{mnem: "c.sd", match: 0xe000, mask: 0xe003, format: rvcCL, imm: "5:3|7:6", inst: "sd", regs: "-DT"},
+	{mnem: "c.fsw", match: 0xe000, mask: 0xe003, format: rvcCL, imm: "5:3|2|6", inst: "fsw", regs: "-DT", xlen: 32},
+
+	// quadrant 1
+	{mnem: "c.nop", match: 0x0001, mask: 0xffff, format: rvcCI, imm: "5|4:0", signed: true, inst: "addi", regs: "00-"},
+	{mnem: "c.addi", match: 0x0001, mask: 0xe003, format: rvcCI, imm: "5|4:0", signed: true, nz: "di", inst: "addi", regs: "dd-"},
+	{mnem: "c.addiw", match: 0x2001, mask: 0xe003, format: rvcCI, imm: "5|4:0", signed: true, nz: "d", inst: "addiw", regs: "dd-"},
+	{mnem: "c.jal", match: 0x2001, mask: 0xe003, format: rvcCJ, imm: "11|4|9:8|10|6|7|3:1|5", signed: true, inst: "jal", regs: "1--", xlen: 32},
+	{mnem: "c.li", match: 0x4001, mask: 0xe003, format: rvcCI, imm: "5|4:0", signed: true, nz: "d", inst: "addi", regs: "d0-"},
+	{mnem: "c.addi16sp", match: 0x6101, mask: 0xef83, format: rvcCI, imm: "9|4|6|8:7|5", signed: true, nz: "i", inst: "addi", regs: "22-"},
+	{mnem: "c.lui", match: 0x6001, mask: 0xe003, format: rvcCI, imm: "17|16:12", signed: true, nz: "di", inst: "lui", regs: "d--"},
+	{mnem: "c.srli", match: 0x8001, mask: 0xec03, format: rvcCI, imm: "5|4:0", nz: "i", inst: "srli", regs: "DD-"},
+	{mnem: "c.srai", match: 0x8401, mask: 0xec03, format: rvcCI, imm: "5|4:0", nz: "i", inst: "srai", regs: "DD-"},
+	{mnem: "c.andi", match: 0x8801, mask: 0xec03, format: rvcCI, imm: "5|4:0", signed: true, inst: "andi", regs: "DD-"},
+	{mnem: "c.sub", match: 0x8c01, mask: 0xfc63, format: rvcCR, inst: "sub", regs: "DDT"},
+	{mnem: "c.xor", match: 0x8c21, mask: 0xfc63, format: rvcCR, inst: "xor", regs: "DDT"},
+	{mnem: "c.or", match: 0x8c41, mask: 0xfc63, format: rvcCR, inst: "or", regs: "DDT"},
+	{mnem: "c.and", match: 0x8c61, mask: 0xfc63, format: rvcCR, inst: "and", regs: "DDT"},
+	{mnem: "c.subw", match: 0x9c01, mask: 0xfc63, format: rvcCR, inst: "subw", regs: "DDT"},
+	{mnem: "c.addw", match: 0x9c21, mask: 0xfc63, format: rvcCR, inst: "addw", regs: "DDT"},
+	{mnem: "c.j", match: 0xa001, mask: 0xe003, format: rvcCJ, imm: "11|4|9:8|10|6|7|3:1|5", signed: true, inst: "jal", regs: "0--"},
+	{mnem: "c.beqz", match: 0xc001, mask: 0xe003, format: rvcCB, imm: "8|4:3|7:6|2:1|5", signed: true, inst: "beq", regs: "-D0"},
+	{mnem: "c.bnez", match: 0xe001, mask: 0xe003, format: rvcCB, imm: "8|4:3|7:6|2:1|5", signed: true, inst: "bne", regs: "-D0"},
+
+	// quadrant 2
+	{mnem: "c.slli", match: 0x0002, mask: 0xe003, format: rvcCI, imm: "5|4:0", nz: "di", inst: "slli", regs: "dd-"},
+	{mnem: "c.fldsp", match: 0x2002, mask: 0xe003, format: rvcCI, imm: "5|4:3|8:6", inst: "fld", regs: "d2-"},
+	{mnem: "c.lwsp", match: 0x4002, mask: 0xe003, format: rvcCI, imm: "5|4:2|7:6", nz: "d", inst: "lw", regs: "d2-"},
+	{mnem: "c.ldsp", match: 0x6002, mask: 0xe003, format: rvcCI, imm: "5|4:3|8:6", nz: "d", inst: "ld", regs: "d2-"},
+	{mnem: "c.flwsp", match: 0x6002, mask: 0xe003, format: rvcCI, imm: "5|4:2|7:6", inst: "flw", regs: "d2-", xlen: 32},
+	{mnem: "c.jr", match: 0x8002, mask: 0xf07f, format: rvcCR, nz: "d", inst: "jalr", regs: "0d-"},
+	{mnem: "c.mv", match: 0x8002, mask: 0xf003, format: rvcCR, nz: "dt", inst: "add", regs: "d0t"},
+	{mnem: "c.mv", match: 0x8002, mask: 0xf003, format: rvcCR, nz: "dt", inst: "addi", regs: "dt-"},
+	{mnem: "c.ebreak", match: 0x9002, mask: 0xffff, format: rvcCR, inst: "ebreak", regs: "---"},
+	{mnem: "c.jalr", match: 0x9002, mask: 0xf07f, format: rvcCR, nz: "d", inst: "jalr", regs: "1d-"},
+	{mnem: "c.add", match: 0x9002, mask: 0xf003, format: rvcCR, nz: "dt", inst: "add", regs: "ddt"},
+	{mnem: "c.fsdsp", match: 0xa002, mask: 0xe003, format: rvcCSS, imm: "5:3|8:6", inst: "fsd", regs: "-2t"},
+	{mnem: "c.swsp", match: 0xc002, mask: 0xe003, format: rvcCSS, imm: "5:2|7:6", inst: "sw", regs: "-2t"},
+	{mnem: "c.sdsp", match: 0xe002, mask: 0xe003, format: rvcCSS, imm: "5:3|8:6", inst: "sd", regs: "-2t"},
+	{mnem: "c.fswsp", match: 0xe002, mask: 0xe003, format: rvcCSS, imm: "5:2|7:6", inst: "fsw", regs: "-2t", xlen: 32},
+}
+
+var inst2rvc = make(map[string][]*rvcDesc)
+
+func init() {
+	for i := range rvcTable {
+		c := &rvcTable[i]
+		c.bits = parseImmSpec(c.imm)
+		if len(c.bits) != len(rvcImmPos[c.format]) {
+			panic("rvgc: bad immediate of " + c.mnem)
+		}
+		inst2rvc[c.inst] = append(inst2rvc[c.inst], c)
+	}
+}
+
+// parseImmSpec turns "5|4:0" into [5 4 3 2 1 0]
+func parseImmSpec(spec string) []uint {
+	ret := make([]uint, 0)
+	if spec == "" {
+		return ret
+	}
+	for _, part := range strings.Split(spec, "|") {
+		r := strings.Split(part, ":")
+		hi, _ := strconv.Atoi(r[0])
+		lo := hi
+		if len(r) == 2 {
+			lo, _ = strconv.Atoi(r[1])
+		}
+		for b := hi; b >= lo; b-- {
+			ret = append(ret, uint(b))
+		}
+	}
+	return ret
+}
+
+// InstLen returns the length in bytes of the instruction bin starts with.
+func InstLen(bin []byte) int {
+	if len(bin) > 0 && bin[0]&0x3 != 0x3 {
+		return 2
+	}
+	return 4
+}
+
+func (c *rvcDesc) getImm(h uint16) int64 {
+	var imm int64
+	var top uint
+	for i, pos := range rvcImmPos[c.format] {
+		if c.bits[i] > top {
+			top = c.bits[i]
+		}
+		if h&(1<<pos) != 0 {
+			imm |= 1 << c.bits[i]
+		}
+	}
+	if c.signed && imm&(1<<top) != 0 {
+		imm -= 1 << (top + 1)
+	}
+	return imm
+}
+
+func (c *rvcDesc) getReg(r byte, h uint16) (uint32, bool) {
+	switch r {
+	case 'd':
+		return uint32(h >> 7 & 0x1f), true
+	case 't':
+		return uint32(h >> 2 & 0x1f), true
+	case 'D':
+		return uint32(h>>7&0x7) + 8, true
+	case 'T':
+		return uint32(h>>2&0x7) + 8, true
+	case '0', '1', '2':
+		return uint32(r - '0'), true
+	}
+	return 0, false
+}
+
+func lookupRVC(h uint16, isa *ISA) *rvcDesc {
+	if !isa.Has("c") {
+		return nil
+	}
+	for i := range rvcTable {
+		c := &rvcTable[i]
+		if h&c.mask != c.match || c.xlen != 0 && c.xlen != isa.XLEN {
+			continue
+		}
+		valid := true
+		for _, z := range c.nz {
+			switch z {
+			case 'i':
+				valid = valid && c.getImm(h) != 0
+			case 'd':
+				valid = valid && h>>7&0x1f != 0
+			case 't':
+				valid = valid && h>>2&0x1f != 0
+			}
+		}
+		// the instruction it stands for has to exist in the ISA, which
+		// also rules out shift amounts wider than XLEN
+		if valid && lookupBits(c.expand(h), isa) != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// expand returns the 32-bit instruction the compressed one stands for
+func (c *rvcDesc) expand(h uint16) uint32 {
+	d := mnem2inst[c.inst][0]
+	bits := d.match
+	for i, shift := range []uint{7, 15, 20} {
+		if r, ok := c.getReg(c.regs[i], h); ok {
+			bits |= r << shift
+		}
+	}
+	for _, a := range d.args {
+		if strings.ContainsRune("joqpau><", a) {
+			bits |= putImm(a, c.getImm(h))
+		}
+	}
+	return bits
+}
+
+// Expand returns the 32-bit equivalent of a compressed instruction, or nil
+// if bin does not hold a valid one.
+func Expand(bin []byte) []byte {
+	if len(bin) < 2 || InstLen(bin) != 2 {
+		return nil
+	}
+	h := binary.LittleEndian.Uint16(bin)
+	c := lookupRVC(h, current)
+	if c == nil {
+		return nil
+	}
+	ret := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ret, c.expand(h))
+	return ret
+}
+
+// Compress returns the compressed form of a 32-bit instruction, or bin itself
+// if it has none.
+func Compress(bin []byte) []byte {
+	return compress(bin, current)
+}
+
+func compress(bin []byte, isa *ISA) []byte {
+	if len(bin) != 4 {
+		return bin
+	}
+	bits := binary.LittleEndian.Uint32(bin)
+	d := lookupBits(bits, isa)
+	if d == nil {
+		return bin
+	}
+
+	var imm int64
+	for _, a := range d.args {
+		if strings.ContainsRune("joqpau><", a) {
+			imm = getImm(a, bits)
+		}
+	}
+
+	for _, c := range inst2rvc[d.mnem] {
+		h := c.match
+		for i, shift := range []uint{7, 15, 20} {
+			r := uint16(bits >> shift & 0x1f)
+			switch c.regs[i] {
+			case 'd':
+				h |= r << 7
+			case 't':
+				h |= r << 2
+			case 'D':
+				h |= (r & 0x7) << 7
+			case 'T':
+				h |= (r & 0x7) << 2
+			}
+		}
+		for i, pos := range rvcImmPos[c.format] {
+			if imm&(1<<c.bits[i]) != 0 {
+				h |= 1 << pos
+			}
+		}
+
+		// whatever did not fit shows up as a difference here
+		if found := lookupRVC(h, isa); found != nil && found.mnem == c.mnem && c.expand(h) == bits {
+			ret := make([]byte, 2)
+			binary.LittleEndian.PutUint16(ret, h)
+			return ret
+		}
+	}
+	return bin
+}
@@ -0,0 +1,103 @@
+package rvgc
+
+import (
+	"strconv"
+)
+
+// csr.go: names of the control and status registers
+
+var csr2bits = map[string]uint32{
+	"fflags":        0x001,
+	"frm":           0x002,
+	"fcsr":          0x003,
+	"vstart":        0x008,
+	"vxsat":         0x009,
+	"vxrm":          0x00a,
+	"vcsr":          0x00f,
+	"cycle":         0xc00,
+	"time":          0xc01,
+	"instret":       0xc02,
+	"vl":            0xc20,
+	"vtype":         0xc21,
+	"vlenb":         0xc22,
+	"cycleh":        0xc80,
+	"timeh":         0xc81,
+	"instreth":      0xc82,
+	"sstatus":       0x100,
+	"sie":           0x104,
+	"stvec":         0x105,
+	"scounteren":    0x106,
+	"senvcfg":       0x10a,
+	"sscratch":      0x140,
+	"sepc":          0x141,
+	"scause":        0x142,
+	"stval":         0x143,
+	"sip":           0x144,
+	"satp":          0x180,
+	"mvendorid":     0xf11,
+	"marchid":       0xf12,
+	"mimpid":        0xf13,
+	"mhartid":       0xf14,
+	"mconfigptr":    0xf15,
+	"mstatus":       0x300,
+	"misa":          0x301,
+	"medeleg":       0x302,
+	"mideleg":       0x303,
+	"mie":           0x304,
+	"mtvec":         0x305,
+	"mcounteren":    0x306,
+	"menvcfg":       0x30a,
+	"mstatush":      0x310,
+	"menvcfgh":      0x31a,
+	"mcountinhibit": 0x320,
+	"mscratch":      0x340,
+	"mepc":          0x341,
+	"mcause":        0x342,
+	"mtval":         0x343,
+	"mip":           0x344,
+	"mtinst":        0x34a,
+	"mtval2":        0x34b,
+	"mcycle":        0xb00,
+	"minstret":      0xb02,
+	"mcycleh":       0xb80,
+	"minstreth":     0xb82,
+	"tselect":       0x7a0,
+	"tdata1":        0x7a1,
+	"tdata2":        0x7a2,
+	"tdata3":        0x7a3,
+	"dcsr":          0x7b0,
+	"dpc":           0x7b1,
+	"dscratch0":     0x7b2,
+	"dscratch1":     0x7b3,
+}
+
+var bits2csr = make(map[uint32]string)
+
+func init() {
+	// the numbered families
+	for i := 3; i < 32; i++ {
+		n := strconv.Itoa(i)
+		csr2bits["hpmcounter"+n] = 0xc00 + uint32(i)
+		csr2bits["hpmcounter"+n+"h"] = 0xc80 + uint32(i)
+		csr2bits["mhpmcounter"+n] = 0xb00 + uint32(i)
+		csr2bits["mhpmcounter"+n+"h"] = 0xb80 + uint32(i)
+		csr2bits["mhpmevent"+n] = 0x320 + uint32(i)
+	}
+	for i := 0; i < 16; i++ {
+		csr2bits["pmpcfg"+strconv.Itoa(i)] = 0x3a0 + uint32(i)
+	}
+	for i := 0; i < 64; i++ {
+		csr2bits["pmpaddr"+strconv.Itoa(i)] = 0x3b0 + uint32(i)
+	}
+
+	for name, bits := range csr2bits {
+		bits2csr[bits] = name
+	}
+}
+
+func csrName(bits uint32) string {
+	if name, ok := bits2csr[bits]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(bits), 16)
+}
@@ -0,0 +1,155 @@
+package rvgc
+
+import (
+	"debug/elf"
+	"errors"
+	"strconv"
+)
+
+// imm.go: immediate operands
+
+// Imm is an evaluated immediate operand.  Unless it is Constant, its value
+// is left to a relocation; Op is the relocation operator it was written
+// with, such as "hi" for %hi(sym), or "" for a bare symbol.
+type Imm struct {
+	Value    int64
+	Constant bool
+	Op       string
+}
+
+// An Evaluator turns an immediate operand into an Imm
+type Evaluator func(op string) (Imm, error)
+
+// the Evaluator of InstToBin; without one, immediates are plain numbers
+// written the way BinToInst writes them
+var evaluate Evaluator
+
+// SetEvaluator has InstToBin evaluate its immediate operands with ev, as an
+// assembler does for expressions and symbols
+func SetEvaluator(ev Evaluator) {
+	evaluate = ev
+}
+
+// the range of each immediate operand, and the alignment it needs
+var immRange = map[rune]struct{ min, max, align int64 }{
+	'j': {-1 << 11, 1<<11 - 1, 1},
+	'o': {-1 << 11, 1<<11 - 1, 1},
+	'q': {-1 << 11, 1<<11 - 1, 1},
+	'p': {-1 << 12, 1<<12 - 2, 2},
+	'a': {-1 << 20, 1<<20 - 2, 2},
+	'u': {0, 1<<20 - 1, 1},
+	'>': {0, 63, 1},
+	'<': {0, 31, 1},
+	'Z': {0, 31, 1},
+	'i': {-1 << 4, 1<<4 - 1, 1},
+	'k': {0, 31, 1},
+	'E': {0, 1<<12 - 1, 1},
+}
+
+// the relocations for each operator, by the operand letters it may be used
+// with
+var opRelocs = map[string]map[rune]elf.R_RISCV{
+	"": {
+		'p': elf.R_RISCV_BRANCH,
+		'a': elf.R_RISCV_JAL,
+	},
+	"hi": {
+		'u': elf.R_RISCV_HI20,
+	},
+	"lo": {
+		'j': elf.R_RISCV_LO12_I,
+		'o': elf.R_RISCV_LO12_I,
+		'q': elf.R_RISCV_LO12_S,
+	},
+	"pcrel_hi": {
+		'u': elf.R_RISCV_PCREL_HI20,
+	},
+	"pcrel_lo": {
+		'j': elf.R_RISCV_PCREL_LO12_I,
+		'o': elf.R_RISCV_PCREL_LO12_I,
+		'q': elf.R_RISCV_PCREL_LO12_S,
+	},
+	"tprel_hi": {
+		'u': elf.R_RISCV_TPREL_HI20,
+	},
+	"tprel_lo": {
+		'j': elf.R_RISCV_TPREL_LO12_I,
+		'o': elf.R_RISCV_TPREL_LO12_I,
+		'q': elf.R_RISCV_TPREL_LO12_S,
+	},
+}
+
+// immediate returns the value of the immediate operand op of letter c, or
+// the relocation that fills it in.  Branch and jump offsets are in bytes.
+func immediate(c rune, op string, ev Evaluator) (int64, elf.R_RISCV, error) {
+	if ev == nil {
+		return literal(c, op)
+	}
+
+	imm, err := ev(op)
+	if err != nil {
+		return 0, elf.R_RISCV_NONE, err
+	}
+	if !imm.Constant {
+		r, ok := opRelocs[imm.Op][c]
+		if !ok {
+			if imm.Op == "" {
+				return 0, elf.R_RISCV_NONE, errors.New("Operand " + op + " must be a constant")
+			}
+			return 0, elf.R_RISCV_NONE, errors.New("Cannot use %" + imm.Op + " in " + op + " here")
+		}
+		return 0, r, nil
+	}
+
+	rg := immRange[c]
+	if imm.Value < rg.min || imm.Value > rg.max {
+		return 0, elf.R_RISCV_NONE, errors.New("Operand " + op + " out of range")
+	}
+	if imm.Value%rg.align != 0 {
+		return 0, elf.R_RISCV_NONE, errors.New("Operand " + op + " is misaligned")
+	}
+	return imm.Value, elf.R_RISCV_NONE, nil
+}
+
+// literal parses an immediate in the notation of BinToInst.  A symbol may
+// stand for a branch or jump target.
+func literal(c rune, op string) (int64, elf.R_RISCV, error) {
+	switch c {
+	case 'j', 'o', 'q':
+		imm, err := strconv.ParseInt(op, 10, 12)
+		return imm, elf.R_RISCV_NONE, err
+	case 'p', 'a':
+		size, r := uint(12), elf.R_RISCV_BRANCH
+		if c == 'a' {
+			size, r = 20, elf.R_RISCV_JAL
+		}
+		imm, err := strconv.ParseUint(op, 16, int(size))
+		if err != nil {
+			if !IsSymbol(op) {
+				return 0, elf.R_RISCV_NONE, err
+			}
+			return 0, r, nil
+		}
+		return signExtend(uint32(imm), size) << 1, elf.R_RISCV_NONE, nil
+	case 'u':
+		imm, err := strconv.ParseUint(op, 16, 20)
+		return int64(imm), elf.R_RISCV_NONE, err
+	case '>', '<':
+		size := 6
+		if c == '<' {
+			size = 5
+		}
+		imm, err := strconv.ParseUint(op, 16, size)
+		return int64(imm), elf.R_RISCV_NONE, err
+	case 'E':
+		imm, err := strconv.ParseUint(op, 16, 12)
+		return int64(imm), elf.R_RISCV_NONE, err
+	case 'Z', 'k':
+		imm, err := strconv.ParseUint(op, 10, 5)
+		return int64(imm), elf.R_RISCV_NONE, err
+	case 'i':
+		imm, err := strconv.ParseInt(op, 10, 5)
+		return imm, elf.R_RISCV_NONE, err
+	}
+	return 0, elf.R_RISCV_NONE, errors.New("Unknown immediate operand " + string(c))
+}
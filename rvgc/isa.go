@@ -0,0 +1,168 @@
+package rvgc
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// isa.go: ISA strings, such as "rv64imafdc_zicsr_zba"
+
+// DefaultISA is what InstToBin and BinToInst accept unless told otherwise
+const DefaultISA = "rv64gc"
+
+// ISA is a parsed ISA string: the register width and the extensions
+type ISA struct {
+	XLEN int
+	ext  map[string]bool
+}
+
+// the single-letter extensions, in canonical order
+const isaLetters = "iemafdqlcbkjtpvh"
+
+// extensions that come with another one
+var isaImplied = map[string][]string{
+	"g": {"i", "m", "a", "f", "d", "zicsr", "zifencei"},
+	"d": {"f"},
+	"f": {"zicsr"},
+	"v": {"d"},
+}
+
+// ParseISA parses an ISA string.  Version numbers, as written into
+// .riscv.attributes ("rv64i2p1_m2p0"), are accepted and ignored.
+func ParseISA(s string) (*ISA, error) {
+	isa := &ISA{ext: make(map[string]bool)}
+	s = strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(s, "rv32"):
+		isa.XLEN = 32
+	case strings.HasPrefix(s, "rv64"):
+		isa.XLEN = 64
+	default:
+		return nil, errors.New("Unsupported ISA " + s)
+	}
+
+	for i, part := range strings.Split(s[len("rv64"):], "_") {
+		if part == "" {
+			if i == 0 {
+				return nil, errors.New("No base ISA in " + s)
+			}
+			return nil, errors.New("Empty extension in " + s)
+		}
+
+		// multi-letter extensions stand alone between underscores
+		if strings.ContainsRune("zsx", rune(part[0])) {
+			isa.add(reVersion.ReplaceAllString(part, ""))
+			continue
+		}
+		for len(part) > 0 {
+			c := part[0]
+			if c != 'g' && !strings.ContainsRune(isaLetters, rune(c)) {
+				return nil, errors.New("Unknown extension " + string(c) + " in " + s)
+			}
+			isa.add(string(c))
+			part = part[1+letterVersion(part[1:]):]
+		}
+	}
+
+	if !isa.ext["i"] && !isa.ext["e"] {
+		return nil, errors.New("No base ISA in " + s)
+	}
+	return isa, nil
+}
+
+// a version number, such as "2p0", ending a multi-letter extension
+var reVersion = regexp.MustCompile(`[0-9]+(p[0-9]+)?$`)
+
+// letterVersion returns the length of the version number at the start of s
+func letterVersion(s string) int {
+	digits := func(s string) int {
+		n := 0
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		return n
+	}
+
+	n := digits(s)
+	if n > 0 && n+1 < len(s) && s[n] == 'p' && digits(s[n+1:]) > 0 {
+		n += 1 + digits(s[n+1:])
+	}
+	return n
+}
+
+func (isa *ISA) add(ext string) {
+	if isa.ext[ext] {
+		return
+	}
+	if ext != "g" {
+		isa.ext[ext] = true
+	}
+	for _, e := range isaImplied[ext] {
+		isa.add(e)
+	}
+}
+
+// With returns a copy of the ISA with one more extension
+func (isa *ISA) With(ext string) *ISA {
+	ret := &ISA{XLEN: isa.XLEN, ext: make(map[string]bool)}
+	for e := range isa.ext {
+		ret.ext[e] = true
+	}
+	ret.add(ext)
+	return ret
+}
+
+// Has reports whether the extension is part of the ISA
+func (isa *ISA) Has(ext string) bool {
+	return isa.ext[ext]
+}
+
+// String returns the ISA string in canonical order
+func (isa *ISA) String() string {
+	ret := "rv" + strconv.Itoa(isa.XLEN)
+	for _, c := range isaLetters {
+		if isa.ext[string(c)] {
+			ret += string(c)
+		}
+	}
+
+	multi := make([]string, 0)
+	for e := range isa.ext {
+		if len(e) > 1 {
+			multi = append(multi, e)
+		}
+	}
+	sort.Strings(multi)
+	for _, e := range multi {
+		ret += "_" + e
+	}
+	return ret
+}
+
+// ELF header flags for an object built for the ISA: RVC and the float ABI
+func (isa *ISA) ELFFlags() uint32 {
+	var flags uint32
+	if isa.Has("c") {
+		flags |= 0x1
+	}
+	switch {
+	case isa.Has("q"):
+		flags |= 0x6
+	case isa.Has("d"):
+		flags |= 0x4
+	case isa.Has("f"):
+		flags |= 0x2
+	}
+	return flags
+}
+
+// the ISA InstToBin and BinToInst go by
+var current *ISA
+
+// SetISA restricts InstToBin and BinToInst to the extensions of isa
+func SetISA(isa *ISA) {
+	current = isa
+}
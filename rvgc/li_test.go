@@ -0,0 +1,95 @@
+package rvgc
+
+import (
+	"strconv"
+	"testing"
+)
+
+// the values TestLiSeq loads, with the most instructions LLVM takes for
+// them on RV64
+var liTests = []struct {
+	v   int64
+	max int
+}{
+	{0, 1},
+	{1, 1},
+	{-1, 1},
+	{0x7ff, 1},
+	{0x800, 2},
+	{-0x801, 2},
+	{0x12345678, 2},
+	{0x80000000, 2},
+	{0xfffff7ff, 3},
+	{0xffffffff, 2},
+	{0x7fffffff00000000, 3},
+	{0x7fffffffffffffff, 2},
+	{0x123456789abcdef0, 8},
+	{-0x7ffffffffffff001, 5},
+	{0xaaaaaaaaa, 4},
+	{0x5283e79c00, 4},
+	{0x100000001, 3},
+	{-0xffffffff, 3},
+}
+
+// run works out what a sequence of liSeq leaves in its register
+func run(t *testing.T, seq [][]string, xlen int) int64 {
+	var r int64
+	for _, inst := range seq {
+		base := 10
+		if inst[0] != "addi" && inst[0] != "addiw" {
+			base = 16
+		}
+		imm, err := strconv.ParseInt(inst[len(inst)-1], base, 64)
+		if err != nil {
+			t.Fatal(inst, err)
+		}
+		src := r
+		if inst[2] == "zero" {
+			src = 0
+		}
+		switch inst[0] {
+		case "lui":
+			r = int64(int32(imm << 12))
+		case "addi":
+			r = src + imm
+		case "addiw":
+			r = int64(int32(src + imm))
+		case "slli":
+			r <<= uint(imm)
+		case "srli":
+			r = int64(uint64(r) >> uint(imm))
+		default:
+			t.Fatal("unexpected", inst)
+		}
+		if xlen == 32 {
+			r = int64(int32(r))
+		}
+	}
+	return r
+}
+
+func TestLiSeq(t *testing.T) {
+	isa, _ := ParseISA("rv64i")
+	for _, tt := range liTests {
+		seq := liSeq("a0", tt.v, 64)
+		if got := run(t, seq, 64); got != tt.v {
+			t.Errorf("li 0x%x: %v loads 0x%x", tt.v, seq, got)
+		}
+		if len(seq) > tt.max {
+			t.Errorf("li 0x%x: %v takes more than %d instructions", tt.v, seq, tt.max)
+		}
+		for _, inst := range seq {
+			if _, _, err := encode(inst, isa, nil); err != nil {
+				t.Errorf("li 0x%x: %v: %v", tt.v, inst, err)
+			}
+		}
+	}
+
+	// RV32 never needs more than lui and addi
+	for _, v := range []int64{0, 0x7ff, -0x801, 0x12345678, -0x80000000, 0x7fffffff} {
+		seq := liSeq("a0", v, 32)
+		if got := run(t, seq, 32); got != v || len(seq) > 2 {
+			t.Errorf("rv32 li 0x%x: %v loads 0x%x", v, seq, got)
+		}
+	}
+}
@@ -3,8 +3,10 @@ package rvgc
 import (
 	"debug/elf"
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"math/bits"
 	"strconv"
+	"strings"
 )
 
 type RV_INST_TYPE uint32
@@ -20,145 +22,33 @@ const (
 	RV_INST_PSEUDO RV_INST_TYPE = 7
 )
 
-var mnem2type = map[string]RV_INST_TYPE{
-	"add":  RV_INST_R_TYPE,
-	"sub":  RV_INST_R_TYPE,
-	"sll":  RV_INST_R_TYPE,
-	"slt":  RV_INST_R_TYPE,
-	"sltu": RV_INST_R_TYPE,
-	"xor":  RV_INST_R_TYPE,
-	"srl":  RV_INST_R_TYPE,
-	"sra":  RV_INST_R_TYPE,
-	"or":   RV_INST_R_TYPE,
-	"and":  RV_INST_R_TYPE,
-	"addw": RV_INST_R_TYPE,
-	"subw": RV_INST_R_TYPE,
-	"sllw": RV_INST_R_TYPE,
-	"srlw": RV_INST_R_TYPE,
-	"sraw": RV_INST_R_TYPE,
-
-	"lb":  RV_INST_I_TYPE,
-	"lbu": RV_INST_I_TYPE,
-	"lh":  RV_INST_I_TYPE,
-	"lhu": RV_INST_I_TYPE,
-	"lw":  RV_INST_I_TYPE,
-	"lwu": RV_INST_I_TYPE,
-	"ld":  RV_INST_I_TYPE,
-
-	"sb": RV_INST_S_TYPE,
-	"sh": RV_INST_S_TYPE,
-	"sw": RV_INST_S_TYPE,
-	"sd": RV_INST_S_TYPE,
-
-	"addi":  RV_INST_I_TYPE,
-	"slti":  RV_INST_I_TYPE,
-	"sltiu": RV_INST_I_TYPE,
-	"xori":  RV_INST_I_TYPE,
-	"ori":   RV_INST_I_TYPE,
-	"andi":  RV_INST_I_TYPE,
-	"addiw": RV_INST_I_TYPE,
-	"slli":  RV_INST_I_TYPE,
-	"srli":  RV_INST_I_TYPE,
-	"srai":  RV_INST_I_TYPE,
-	"slliw": RV_INST_I_TYPE,
-	"srliw": RV_INST_I_TYPE,
-	"sraiw": RV_INST_I_TYPE,
-
-	"beq":  RV_INST_B_TYPE,
-	"bne":  RV_INST_B_TYPE,
-	"blt":  RV_INST_B_TYPE,
-	"bgt":  RV_INST_B_TYPE,
-	"bltu": RV_INST_B_TYPE,
-	"bgtu": RV_INST_B_TYPE,
-
-	"jal":  RV_INST_J_TYPE,
-	"jalr": RV_INST_I_TYPE,
-
-	"lui":   RV_INST_U_TYPE,
-	"auipc": RV_INST_U_TYPE,
-
-	"ecall": RV_INST_NONE,
-
-	"call": RV_INST_PSEUDO,
-}
-
 type RV_OPCODE_TYPE uint32
 
 const (
 	RV_OPCODE_LOAD      RV_OPCODE_TYPE = 0x03
+	RV_OPCODE_LOAD_FP   RV_OPCODE_TYPE = 0x07
+	RV_OPCODE_MISC_MEM  RV_OPCODE_TYPE = 0x0f
 	RV_OPCODE_OP_IMM    RV_OPCODE_TYPE = 0x13
 	RV_OPCODE_AUIPC     RV_OPCODE_TYPE = 0x17
 	RV_OPCODE_OP_IMM_32 RV_OPCODE_TYPE = 0x1b
 	RV_OPCODE_STORE     RV_OPCODE_TYPE = 0x23
+	RV_OPCODE_STORE_FP  RV_OPCODE_TYPE = 0x27
+	RV_OPCODE_AMO       RV_OPCODE_TYPE = 0x2f
 	RV_OPCODE_OP        RV_OPCODE_TYPE = 0x33
 	RV_OPCODE_LUI       RV_OPCODE_TYPE = 0x37
 	RV_OPCODE_OP_32     RV_OPCODE_TYPE = 0x3b
+	RV_OPCODE_MADD      RV_OPCODE_TYPE = 0x43
+	RV_OPCODE_MSUB      RV_OPCODE_TYPE = 0x47
+	RV_OPCODE_NMSUB     RV_OPCODE_TYPE = 0x4b
+	RV_OPCODE_NMADD     RV_OPCODE_TYPE = 0x4f
+	RV_OPCODE_OP_FP     RV_OPCODE_TYPE = 0x53
+	RV_OPCODE_OP_V      RV_OPCODE_TYPE = 0x57
 	RV_OPCODE_BRANCH    RV_OPCODE_TYPE = 0x63
 	RV_OPCODE_JALR      RV_OPCODE_TYPE = 0x67
 	RV_OPCODE_JAL       RV_OPCODE_TYPE = 0x6f
 	RV_OPCODE_SYSTEM    RV_OPCODE_TYPE = 0x73
 )
 
-var mnem2opcode = map[string]RV_OPCODE_TYPE{
-	"add":  RV_OPCODE_OP,
-	"sub":  RV_OPCODE_OP,
-	"sll":  RV_OPCODE_OP,
-	"slt":  RV_OPCODE_OP,
-	"sltu": RV_OPCODE_OP,
-	"xor":  RV_OPCODE_OP,
-	"srl":  RV_OPCODE_OP,
-	"sra":  RV_OPCODE_OP,
-	"or":   RV_OPCODE_OP,
-	"and":  RV_OPCODE_OP,
-	"addw": RV_OPCODE_OP_32,
-	"subw": RV_OPCODE_OP_32,
-	"sllw": RV_OPCODE_OP_32,
-	"srlw": RV_OPCODE_OP_32,
-	"sraw": RV_OPCODE_OP_32,
-
-	"lb":  RV_OPCODE_LOAD,
-	"lbu": RV_OPCODE_LOAD,
-	"lh":  RV_OPCODE_LOAD,
-	"lhu": RV_OPCODE_LOAD,
-	"lw":  RV_OPCODE_LOAD,
-	"lwu": RV_OPCODE_LOAD,
-	"ld":  RV_OPCODE_LOAD,
-
-	"sb": RV_OPCODE_STORE,
-	"sh": RV_OPCODE_STORE,
-	"sw": RV_OPCODE_STORE,
-	"sd": RV_OPCODE_STORE,
-
-	"addi":  RV_OPCODE_OP_IMM,
-	"slti":  RV_OPCODE_OP_IMM,
-	"sltiu": RV_OPCODE_OP_IMM,
-	"xori":  RV_OPCODE_OP_IMM,
-	"ori":   RV_OPCODE_OP_IMM,
-	"andi":  RV_OPCODE_OP_IMM,
-	"slli":  RV_OPCODE_OP_IMM,
-	"srli":  RV_OPCODE_OP_IMM,
-	"srai":  RV_OPCODE_OP_IMM,
-	"addiw": RV_OPCODE_OP_IMM_32,
-	"slliw": RV_OPCODE_OP_IMM_32,
-	"srliw": RV_OPCODE_OP_IMM_32,
-	"sraiw": RV_OPCODE_OP_IMM_32,
-
-	"beq":  RV_OPCODE_BRANCH,
-	"bne":  RV_OPCODE_BRANCH,
-	"blt":  RV_OPCODE_BRANCH,
-	"bgt":  RV_OPCODE_BRANCH,
-	"bltu": RV_OPCODE_BRANCH,
-	"bgtu": RV_OPCODE_BRANCH,
-
-	"jal":  RV_OPCODE_JAL,
-	"jalr": RV_OPCODE_JALR,
-
-	"lui":   RV_OPCODE_LUI,
-	"auipc": RV_OPCODE_AUIPC,
-
-	"ecall": RV_OPCODE_SYSTEM,
-}
-
 var bits2reg = map[byte]string{
 	0x00: "zero",
 	0x01: "ra",
@@ -261,374 +151,1380 @@ var reg2bits = map[string]uint32{
 	"t6":   0x1f,
 }
 
-type RV64Inst struct {
-	Type   RV_INST_TYPE
-	Opcode RV_OPCODE_TYPE
-	Inst   interface{}
-}
-
-type RV64InstR struct {
-	funct3 uint8
-	funct7 uint8
-	rd     uint8
-	rs1    uint8
-	rs2    uint8
-}
-
-type RV64InstI struct {
-	funct3 uint8
-	rd     uint8
-	rs1    uint8
-	imm    uint16
-}
-
-type RV64InstS struct {
-	funct3 uint8
-	rs1    uint8
-	rs2    uint8
-	imm    uint16
-}
-type RV64InstB RV64InstS
-
-type RV64InstU struct {
-	funct3 uint8
-	rd     uint8
-	imm    uint32
-}
-type RV64InstJ RV64InstU
-
-var funct3 = map[string]uint32{
-	"add":   0x00,
-	"addw":  0x00,
-	"addi":  0x00,
-	"addiw": 0x00,
-	"sub":   0x00,
-	"subw":  0x00,
-	"sll":   0x01,
-	"slli":  0x01,
-	"slt":   0x02,
-	"slti":  0x02,
-	"sltu":  0x03,
-	"sltiu": 0x03,
-	"xor":   0x04,
-	"xori":  0x04,
-	"srl":   0x05,
-	"srlw":  0x05,
-	"srli":  0x05,
-	"srliw": 0x05,
-	"sra":   0x05,
-	"sraw":  0x05,
-	"srai":  0x05,
-	"sraiw": 0x05,
-	"or":    0x06,
-	"ori":   0x06,
-	"and":   0x07,
-	"andi":  0x07,
-
-	"lb":   0x00,
-	"lbu":  0x04,
-	"sb":   0x00,
-	"lh":   0x01,
-	"lhu":  0x05,
-	"sh":   0x01,
-	"lw":   0x02,
-	"lwu":  0x06,
-	"sw":   0x02,
-	"ld":   0x03,
-	"sd":   0x03,
-	"jalr": 0x00,
-
-	"beq":  0x00,
-	"bne":  0x01,
-	"blt":  0x04,
-	"bgt":  0x05,
-	"bltu": 0x06,
-	"bgtu": 0x07,
+var bits2freg = map[byte]string{
+	0x00: "ft0",
+	0x01: "ft1",
+	0x02: "ft2",
+	0x03: "ft3",
+	0x04: "ft4",
+	0x05: "ft5",
+	0x06: "ft6",
+	0x07: "ft7",
+	0x08: "fs0",
+	0x09: "fs1",
+	0x0a: "fa0",
+	0x0b: "fa1",
+	0x0c: "fa2",
+	0x0d: "fa3",
+	0x0e: "fa4",
+	0x0f: "fa5",
+	0x10: "fa6",
+	0x11: "fa7",
+	0x12: "fs2",
+	0x13: "fs3",
+	0x14: "fs4",
+	0x15: "fs5",
+	0x16: "fs6",
+	0x17: "fs7",
+	0x18: "fs8",
+	0x19: "fs9",
+	0x1a: "fs10",
+	0x1b: "fs11",
+	0x1c: "ft8",
+	0x1d: "ft9",
+	0x1e: "ft10",
+	0x1f: "ft11",
+}
+var freg2bits = map[string]uint32{
+	"f0":   0x00,
+	"ft0":  0x00,
+	"f1":   0x01,
+	"ft1":  0x01,
+	"f2":   0x02,
+	"ft2":  0x02,
+	"f3":   0x03,
+	"ft3":  0x03,
+	"f4":   0x04,
+	"ft4":  0x04,
+	"f5":   0x05,
+	"ft5":  0x05,
+	"f6":   0x06,
+	"ft6":  0x06,
+	"f7":   0x07,
+	"ft7":  0x07,
+	"f8":   0x08,
+	"fs0":  0x08,
+	"f9":   0x09,
+	"fs1":  0x09,
+	"f10":  0x0a,
+	"fa0":  0x0a,
+	"f11":  0x0b,
+	"fa1":  0x0b,
+	"f12":  0x0c,
+	"fa2":  0x0c,
+	"f13":  0x0d,
+	"fa3":  0x0d,
+	"f14":  0x0e,
+	"fa4":  0x0e,
+	"f15":  0x0f,
+	"fa5":  0x0f,
+	"f16":  0x10,
+	"fa6":  0x10,
+	"f17":  0x11,
+	"fa7":  0x11,
+	"f18":  0x12,
+	"fs2":  0x12,
+	"f19":  0x13,
+	"fs3":  0x13,
+	"f20":  0x14,
+	"fs4":  0x14,
+	"f21":  0x15,
+	"fs5":  0x15,
+	"f22":  0x16,
+	"fs6":  0x16,
+	"f23":  0x17,
+	"fs7":  0x17,
+	"f24":  0x18,
+	"fs8":  0x18,
+	"f25":  0x19,
+	"fs9":  0x19,
+	"f26":  0x1a,
+	"fs10": 0x1a,
+	"f27":  0x1b,
+	"fs11": 0x1b,
+	"f28":  0x1c,
+	"ft8":  0x1c,
+	"f29":  0x1d,
+	"ft9":  0x1d,
+	"f30":  0x1e,
+	"ft10": 0x1e,
+	"f31":  0x1f,
+	"ft11": 0x1f,
+}
+
+// rounding modes of the F and D extensions; dyn is the default when the
+// operand is omitted
+var bits2rm = map[uint32]string{
+	0x0: "rne",
+	0x1: "rtz",
+	0x2: "rdn",
+	0x3: "rup",
+	0x4: "rmm",
+	0x7: "dyn",
+}
+var rm2bits = map[string]uint32{
+	"rne": 0x0,
+	"rtz": 0x1,
+	"rdn": 0x2,
+	"rup": 0x3,
+	"rmm": 0x4,
+	"dyn": 0x7,
+}
+
+// instDesc describes one instruction.  match holds the bits that identify it
+// and mask tells which of them are fixed; everything else is filled in from
+// the operands listed in args.  The operand letters are:
+//
+//	d	rd
+//	s	rs1
+//	t	rs2
+//	j	12-bit signed immediate of I-type, decimal
+//	o	same as j, but written as the offset of o(s)
+//	q	12-bit signed store offset of S-type, decimal
+//	p	branch offset of B-type, in halfwords, hex
+//	a	jump offset of J-type, in halfwords, hex
+//	u	20-bit upper immediate of U-type, hex
+//	>	6-bit shift amount, hex
+//	<	5-bit shift amount, hex
+//	E	CSR, by name or by its 12-bit number in hex
+//	Z	5-bit unsigned immediate of the CSR instructions, decimal
+//	P	predecessor set of fence, some of "iorw"
+//	Q	successor set of fence, some of "iorw"
+//	D	floating-point rd
+//	S	floating-point rs1
+//	T	floating-point rs2
+//	R	floating-point rs3
+//	m	rounding mode, optional and dyn by default
+//
+// Any other character in args is punctuation, printed as is by BinToInst.
+// The bases given for immediates are those of BinToInst; with an Evaluator
+// set, InstToBin leaves them to it instead.
+type instDesc struct {
+	mnem  string
+	typ   RV_INST_TYPE
+	args  string
+	match uint32
+	mask  uint32
+	ext   string
+	xlen  int
+	nz    string // the registers of args an alias takes that may not be x0
+}
+
+func desc(mnem string, typ RV_INST_TYPE, args string, match, mask uint32) instDesc {
+	return instDesc{mnem: mnem, typ: typ, args: args, match: match, mask: mask}
+}
+
+// rv64 and rv32 mark an instruction as existing only for that XLEN
+func rv64(d instDesc) instDesc {
+	d.xlen = 64
+	return d
+}
+
+func rv32(d instDesc) instDesc {
+	d.xlen = 32
+	return d
+}
+
+func rType(mnem string, op RV_OPCODE_TYPE, f3, f7 uint32) instDesc {
+	return desc(mnem, RV_INST_R_TYPE, "d,s,t", f7<<25|f3<<12|uint32(op), 0xfe00707f)
+}
+
+func iType(mnem string, op RV_OPCODE_TYPE, f3 uint32) instDesc {
+	return desc(mnem, RV_INST_I_TYPE, "d,s,j", f3<<12|uint32(op), 0x0000707f)
+}
+
+func load(mnem string, f3 uint32) instDesc {
+	return desc(mnem, RV_INST_I_TYPE, "d,o(s)", f3<<12|uint32(RV_OPCODE_LOAD), 0x0000707f)
+}
+
+func shift(mnem string, f3, f6 uint32) instDesc {
+	return desc(mnem, RV_INST_I_TYPE, "d,s,>", f6<<26|f3<<12|uint32(RV_OPCODE_OP_IMM), 0xfc00707f)
+}
+
+func shiftW(mnem string, f3, f7 uint32) instDesc {
+	return desc(mnem, RV_INST_I_TYPE, "d,s,<", f7<<25|f3<<12|uint32(RV_OPCODE_OP_IMM_32), 0xfe00707f)
+}
+
+func sType(mnem string, f3 uint32) instDesc {
+	return desc(mnem, RV_INST_S_TYPE, "t,q(s)", f3<<12|uint32(RV_OPCODE_STORE), 0x0000707f)
+}
+
+func bType(mnem string, f3 uint32) instDesc {
+	return desc(mnem, RV_INST_B_TYPE, "s,t,p", f3<<12|uint32(RV_OPCODE_BRANCH), 0x0000707f)
+}
+
+func uType(mnem string, op RV_OPCODE_TYPE) instDesc {
+	return desc(mnem, RV_INST_U_TYPE, "d,u", uint32(op), 0x0000007f)
+}
+
+func csr(mnem string, f3 uint32) instDesc {
+	args := "d,E,s"
+	if f3&0x4 != 0 {
+		args = "d,E,Z"
+	}
+	return desc(mnem, RV_INST_I_TYPE, args, f3<<12|uint32(RV_OPCODE_SYSTEM), 0x0000707f)
+}
+
+// unary returns an instruction taking rd and rs1 only, with rs2 fixed
+func unary(mnem string, bits uint32) instDesc {
+	return desc(mnem, RV_INST_I_TYPE, "d,s", bits, 0xfff0707f)
+}
+
+// system returns an instruction of the SYSTEM opcode without operands, which
+// is identified by its whole 32 bits.
+func system(mnem string, bits uint32) instDesc {
+	return desc(mnem, RV_INST_NONE, "", bits, 0xffffffff)
+}
+
+// RV32I and RV64I
+var baseTable = []instDesc{
+	rType("add", RV_OPCODE_OP, 0x0, 0x00),
+	rType("sub", RV_OPCODE_OP, 0x0, 0x20),
+	rType("sll", RV_OPCODE_OP, 0x1, 0x00),
+	rType("slt", RV_OPCODE_OP, 0x2, 0x00),
+	rType("sltu", RV_OPCODE_OP, 0x3, 0x00),
+	rType("xor", RV_OPCODE_OP, 0x4, 0x00),
+	rType("srl", RV_OPCODE_OP, 0x5, 0x00),
+	rType("sra", RV_OPCODE_OP, 0x5, 0x20),
+	rType("or", RV_OPCODE_OP, 0x6, 0x00),
+	rType("and", RV_OPCODE_OP, 0x7, 0x00),
+	rv64(rType("addw", RV_OPCODE_OP_32, 0x0, 0x00)),
+	rv64(rType("subw", RV_OPCODE_OP_32, 0x0, 0x20)),
+	rv64(rType("sllw", RV_OPCODE_OP_32, 0x1, 0x00)),
+	rv64(rType("srlw", RV_OPCODE_OP_32, 0x5, 0x00)),
+	rv64(rType("sraw", RV_OPCODE_OP_32, 0x5, 0x20)),
+
+	load("lb", 0x0),
+	load("lh", 0x1),
+	load("lw", 0x2),
+	rv64(load("ld", 0x3)),
+	load("lbu", 0x4),
+	load("lhu", 0x5),
+	rv64(load("lwu", 0x6)),
+
+	sType("sb", 0x0),
+	sType("sh", 0x1),
+	sType("sw", 0x2),
+	rv64(sType("sd", 0x3)),
+
+	iType("addi", RV_OPCODE_OP_IMM, 0x0),
+	iType("slti", RV_OPCODE_OP_IMM, 0x2),
+	iType("sltiu", RV_OPCODE_OP_IMM, 0x3),
+	iType("xori", RV_OPCODE_OP_IMM, 0x4),
+	iType("ori", RV_OPCODE_OP_IMM, 0x6),
+	iType("andi", RV_OPCODE_OP_IMM, 0x7),
+	shift("slli", 0x1, 0x00),
+	shift("srli", 0x5, 0x00),
+	shift("srai", 0x5, 0x10),
+	rv64(iType("addiw", RV_OPCODE_OP_IMM_32, 0x0)),
+	rv64(shiftW("slliw", 0x1, 0x00)),
+	rv64(shiftW("srliw", 0x5, 0x00)),
+	rv64(shiftW("sraiw", 0x5, 0x20)),
+
+	bType("beq", 0x0),
+	bType("bne", 0x1),
+	bType("blt", 0x4),
+	bType("bge", 0x5),
+	bType("bltu", 0x6),
+	bType("bgeu", 0x7),
+
+	desc("jal", RV_INST_J_TYPE, "d,a", uint32(RV_OPCODE_JAL), 0x0000007f),
+	desc("jalr", RV_INST_I_TYPE, "d,o(s)", uint32(RV_OPCODE_JALR), 0x0000707f),
+
+	uType("lui", RV_OPCODE_LUI),
+	uType("auipc", RV_OPCODE_AUIPC),
+
+	desc("fence.tso", RV_INST_NONE, "", 0x8330000f, 0xffffffff),
+	desc("fence", RV_INST_I_TYPE, "P,Q", uint32(RV_OPCODE_MISC_MEM), 0xf00fffff),
+
+	system("ecall", 0x00000073),
+	system("ebreak", 0x00100073),
+}
+
+// privileged instructions
+var privTable = []instDesc{
+	system("sret", 0x10200073),
+	system("mret", 0x30200073),
+	system("wfi", 0x10500073),
+	desc("sfence.vma", RV_INST_R_TYPE, "s,t", 0x12000073, 0xfe007fff),
+}
+
+var zifenceiTable = []instDesc{
+	desc("fence.i", RV_INST_NONE, "", 0x1000|uint32(RV_OPCODE_MISC_MEM), 0xffffffff),
+}
+
+var zicsrTable = []instDesc{
+	csr("csrrw", 0x1),
+	csr("csrrs", 0x2),
+	csr("csrrc", 0x3),
+	csr("csrrwi", 0x5),
+	csr("csrrsi", 0x6),
+	csr("csrrci", 0x7),
+}
+
+var mTable = []instDesc{
+	rType("mul", RV_OPCODE_OP, 0x0, 0x01),
+	rType("mulh", RV_OPCODE_OP, 0x1, 0x01),
+	rType("mulhsu", RV_OPCODE_OP, 0x2, 0x01),
+	rType("mulhu", RV_OPCODE_OP, 0x3, 0x01),
+	rType("div", RV_OPCODE_OP, 0x4, 0x01),
+	rType("divu", RV_OPCODE_OP, 0x5, 0x01),
+	rType("rem", RV_OPCODE_OP, 0x6, 0x01),
+	rType("remu", RV_OPCODE_OP, 0x7, 0x01),
+	rv64(rType("mulw", RV_OPCODE_OP_32, 0x0, 0x01)),
+	rv64(rType("divw", RV_OPCODE_OP_32, 0x4, 0x01)),
+	rv64(rType("divuw", RV_OPCODE_OP_32, 0x5, 0x01)),
+	rv64(rType("remw", RV_OPCODE_OP_32, 0x6, 0x01)),
+	rv64(rType("remuw", RV_OPCODE_OP_32, 0x7, 0x01)),
+}
+
+// "F" and "D" extensions, besides the ones in fpTable
+var fTable = []instDesc{
+	desc("flw", RV_INST_I_TYPE, "D,o(s)", 0x2<<12|uint32(RV_OPCODE_LOAD_FP), 0x0000707f),
+	desc("fsw", RV_INST_S_TYPE, "T,q(s)", 0x2<<12|uint32(RV_OPCODE_STORE_FP), 0x0000707f),
+	fp("fmv.x.w", "d,S", 0x70, 0x0, 0xfff0707f),
+	fp("fmv.w.x", "D,s", 0x78, 0x0, 0xfff0707f),
+	fcvt("fcvt.s.w", "D,s,m", 0x68, 0x0),
+	fcvt("fcvt.s.wu", "D,s,m", 0x68, 0x1),
+}
+
+var dTable = []instDesc{
+	desc("fld", RV_INST_I_TYPE, "D,o(s)", 0x3<<12|uint32(RV_OPCODE_LOAD_FP), 0x0000707f),
+	desc("fsd", RV_INST_S_TYPE, "T,q(s)", 0x3<<12|uint32(RV_OPCODE_STORE_FP), 0x0000707f),
+	rv64(fp("fmv.x.d", "d,S", 0x71, 0x0, 0xfff0707f)),
+	rv64(fp("fmv.d.x", "D,s", 0x79, 0x0, 0xfff0707f)),
+	fcvt("fcvt.s.d", "D,S,m", 0x20, 0x1),
+	// exact conversions, encoded with rne
+	fcvt("fcvt.d.w", "D,s", 0x69, 0x0),
+	fcvt("fcvt.d.wu", "D,s", 0x69, 0x1),
+	fcvt("fcvt.d.s", "D,S", 0x21, 0x0),
+}
+
+// bit-manipulation extensions
+var zbaTable = []instDesc{
+	rType("sh1add", RV_OPCODE_OP, 0x2, 0x10),
+	rType("sh2add", RV_OPCODE_OP, 0x4, 0x10),
+	rType("sh3add", RV_OPCODE_OP, 0x6, 0x10),
+	rv64(rType("add.uw", RV_OPCODE_OP_32, 0x0, 0x04)),
+	rv64(rType("sh1add.uw", RV_OPCODE_OP_32, 0x2, 0x10)),
+	rv64(rType("sh2add.uw", RV_OPCODE_OP_32, 0x4, 0x10)),
+	rv64(rType("sh3add.uw", RV_OPCODE_OP_32, 0x6, 0x10)),
+	rv64(desc("slli.uw", RV_INST_I_TYPE, "d,s,>", 0x02<<26|0x1<<12|uint32(RV_OPCODE_OP_IMM_32), 0xfc00707f)),
+}
+
+var zbbTable = []instDesc{
+	rType("andn", RV_OPCODE_OP, 0x7, 0x20),
+	rType("orn", RV_OPCODE_OP, 0x6, 0x20),
+	rType("xnor", RV_OPCODE_OP, 0x4, 0x20),
+	unary("clz", 0x60001013),
+	unary("ctz", 0x60101013),
+	unary("cpop", 0x60201013),
+	rv64(unary("clzw", 0x6000101b)),
+	rv64(unary("ctzw", 0x6010101b)),
+	rv64(unary("cpopw", 0x6020101b)),
+	rType("max", RV_OPCODE_OP, 0x6, 0x05),
+	rType("maxu", RV_OPCODE_OP, 0x7, 0x05),
+	rType("min", RV_OPCODE_OP, 0x4, 0x05),
+	rType("minu", RV_OPCODE_OP, 0x5, 0x05),
+	unary("sext.b", 0x60401013),
+	unary("sext.h", 0x60501013),
+	rv64(unary("zext.h", 0x0800403b)),
+	rv32(unary("zext.h", 0x08004033)),
+	rType("rol", RV_OPCODE_OP, 0x1, 0x30),
+	rType("ror", RV_OPCODE_OP, 0x5, 0x30),
+	shift("rori", 0x5, 0x18),
+	rv64(rType("rolw", RV_OPCODE_OP_32, 0x1, 0x30)),
+	rv64(rType("rorw", RV_OPCODE_OP_32, 0x5, 0x30)),
+	rv64(shiftW("roriw", 0x5, 0x30)),
+	unary("orc.b", 0x28705013),
+	rv64(unary("rev8", 0x6b805013)),
+	rv32(unary("rev8", 0x69805013)),
+}
+
+var zbsTable = []instDesc{
+	rType("bclr", RV_OPCODE_OP, 0x1, 0x24),
+	shift("bclri", 0x1, 0x12),
+	rType("bext", RV_OPCODE_OP, 0x5, 0x24),
+	shift("bexti", 0x5, 0x12),
+	rType("binv", RV_OPCODE_OP, 0x1, 0x34),
+	shift("binvi", 0x1, 0x1a),
+	rType("bset", RV_OPCODE_OP, 0x1, 0x14),
+	shift("bseti", 0x1, 0x0a),
+}
+
+// the tables above, in the order they are searched.  init tags every entry
+// with the name of its extension and gathers them into instTable; the
+// privileged instructions belong to no extension and are always accepted.
+var extTables = []struct {
+	ext   string
+	table []instDesc
+}{
+	{"i", baseTable},
+	{"", privTable},
+	{"zifencei", zifenceiTable},
+	{"zicsr", zicsrTable},
+	{"m", mTable},
+	{"f", fTable},
+	{"d", dTable},
+	{"zba", zbaTable},
+	{"zbb", zbbTable},
+	{"zbs", zbsTable},
+	{"v", vTable},
+}
+
+var instTable = make([]instDesc, 0)
+
+// "F" and "D" extensions.  The mnemonics here carry a %s for the format,
+// which init fills in with "s" and "d", setting the fmt field accordingly.
+var fpTable = []instDesc{
+	desc("fmadd.%s", RV_INST_R_TYPE, "D,S,T,R,m", uint32(RV_OPCODE_MADD), 0x0600007f),
+	desc("fmsub.%s", RV_INST_R_TYPE, "D,S,T,R,m", uint32(RV_OPCODE_MSUB), 0x0600007f),
+	desc("fnmsub.%s", RV_INST_R_TYPE, "D,S,T,R,m", uint32(RV_OPCODE_NMSUB), 0x0600007f),
+	desc("fnmadd.%s", RV_INST_R_TYPE, "D,S,T,R,m", uint32(RV_OPCODE_NMADD), 0x0600007f),
+
+	fp("fadd.%s", "D,S,T,m", 0x00, 0x0, 0xfe00007f),
+	fp("fsub.%s", "D,S,T,m", 0x04, 0x0, 0xfe00007f),
+	fp("fmul.%s", "D,S,T,m", 0x08, 0x0, 0xfe00007f),
+	fp("fdiv.%s", "D,S,T,m", 0x0c, 0x0, 0xfe00007f),
+	fp("fsqrt.%s", "D,S,m", 0x2c, 0x0, 0xfff0007f),
+	fp("fsgnj.%s", "D,S,T", 0x10, 0x0, 0xfe00707f),
+	fp("fsgnjn.%s", "D,S,T", 0x10, 0x1, 0xfe00707f),
+	fp("fsgnjx.%s", "D,S,T", 0x10, 0x2, 0xfe00707f),
+	fp("fmin.%s", "D,S,T", 0x14, 0x0, 0xfe00707f),
+	fp("fmax.%s", "D,S,T", 0x14, 0x1, 0xfe00707f),
+	fp("feq.%s", "d,S,T", 0x50, 0x2, 0xfe00707f),
+	fp("flt.%s", "d,S,T", 0x50, 0x1, 0xfe00707f),
+	fp("fle.%s", "d,S,T", 0x50, 0x0, 0xfe00707f),
+	fp("fclass.%s", "d,S", 0x70, 0x1, 0xfff0707f),
+
+	fcvt("fcvt.w.%s", "d,S,m", 0x60, 0x0),
+	fcvt("fcvt.wu.%s", "d,S,m", 0x60, 0x1),
+	rv64(fcvt("fcvt.l.%s", "d,S,m", 0x60, 0x2)),
+	rv64(fcvt("fcvt.lu.%s", "d,S,m", 0x60, 0x3)),
+	rv64(fcvt("fcvt.%s.l", "D,s,m", 0x68, 0x2)),
+	rv64(fcvt("fcvt.%s.lu", "D,s,m", 0x68, 0x3)),
+}
+
+func fp(mnem, args string, f7, f3, mask uint32) instDesc {
+	return desc(mnem, RV_INST_R_TYPE, args, f7<<25|f3<<12|uint32(RV_OPCODE_OP_FP), mask)
+}
+
+// fcvt returns a conversion; one without a rounding mode has rm fixed
+func fcvt(mnem, args string, f7, rs2 uint32) instDesc {
+	mask := uint32(0xfff0007f)
+	if !strings.Contains(args, "m") {
+		mask |= 0x7 << 12
+	}
+	return desc(mnem, RV_INST_R_TYPE, args, f7<<25|rs2<<20|uint32(RV_OPCODE_OP_FP), mask)
+}
+
+// "A" extension, without the width and ordering suffixes; init expands every
+// entry into .w and .d forms, each with .aq, .rl and .aqrl variants.
+var amoTable = []struct {
+	mnem   string
+	funct5 uint32
+}{
+	{"lr", 0x02},
+	{"sc", 0x03},
+	{"amoswap", 0x01},
+	{"amoadd", 0x00},
+	{"amoxor", 0x04},
+	{"amoand", 0x0c},
+	{"amoor", 0x08},
+	{"amomin", 0x10},
+	{"amomax", 0x14},
+	{"amominu", 0x18},
+	{"amomaxu", 0x1c},
+}
+
+var amoOrdering = []string{"", ".rl", ".aq", ".aqrl"}
+
+func amo(mnem string, f5, f3, aqrl uint32) instDesc {
+	args := "d,t,(s)"
+	var mask uint32 = 0xfe00707f
+	if f5 == 0x02 {
+		args = "d,(s)"
+		mask = 0xfff0707f
+	}
+	return desc(mnem, RV_INST_R_TYPE, args, f5<<27|aqrl<<25|f3<<12|uint32(RV_OPCODE_AMO), mask)
+}
+
+// aliasTable holds the instructions that are special cases of another one
+// in instTable.  InstToBin accepts them, and BinToInst prints them in place
+// of the instruction they stand for; where two match, the first wins.
+var aliasTable = []instDesc{
+	desc("nop", RV_INST_I_TYPE, "", 0x00000013, 0xffffffff),
+	desc("li", RV_INST_I_TYPE, "d,j", 0x00000013, 0x000ff07f),
+	desc("mv", RV_INST_I_TYPE, "d,s", 0x00000013, 0xfff0707f),
+	nonzero(desc("mv", RV_INST_R_TYPE, "d,t", 0x00000033, 0xfe0ff07f), "t"),
+	desc("not", RV_INST_I_TYPE, "d,s", 0xfff04013, 0xfff0707f),
+	desc("sext.w", RV_INST_I_TYPE, "d,s", 0x0000001b, 0xfff0707f),
+	desc("seqz", RV_INST_I_TYPE, "d,s", 0x00103013, 0xfff0707f),
+	desc("neg", RV_INST_R_TYPE, "d,t", 0x40000033, 0xfe0ff07f),
+	desc("negw", RV_INST_R_TYPE, "d,t", 0x4000003b, 0xfe0ff07f),
+	desc("snez", RV_INST_R_TYPE, "d,t", 0x00003033, 0xfe0ff07f),
+	desc("sltz", RV_INST_R_TYPE, "d,s", 0x00002033, 0xfff0707f),
+	desc("sgtz", RV_INST_R_TYPE, "d,t", 0x00002033, 0xfe0ff07f),
+	desc("beqz", RV_INST_B_TYPE, "s,p", 0x00000063, 0x01f0707f),
+	desc("bnez", RV_INST_B_TYPE, "s,p", 0x00001063, 0x01f0707f),
+	desc("blez", RV_INST_B_TYPE, "t,p", 0x00005063, 0x000ff07f),
+	desc("bgez", RV_INST_B_TYPE, "s,p", 0x00005063, 0x01f0707f),
+	desc("bltz", RV_INST_B_TYPE, "s,p", 0x00004063, 0x01f0707f),
+	desc("bgtz", RV_INST_B_TYPE, "t,p", 0x00004063, 0x000ff07f),
+	desc("j", RV_INST_J_TYPE, "a", 0x0000006f, 0x00000fff),
+	desc("jal", RV_INST_J_TYPE, "a", 0x000000ef, 0x00000fff),
+	desc("ret", RV_INST_I_TYPE, "", 0x00008067, 0xffffffff),
+	desc("jr", RV_INST_I_TYPE, "s", 0x00000067, 0xfff07fff),
+	desc("jalr", RV_INST_I_TYPE, "s", 0x000000e7, 0xfff07fff),
+
+	csrAlias("rdcycle", "d", 0x2, 0xc00),
+	csrAlias("rdtime", "d", 0x2, 0xc01),
+	csrAlias("rdinstret", "d", 0x2, 0xc02),
+	csrAlias("frcsr", "d", 0x2, 0x003),
+	csrAlias("fscsr", "s", 0x1, 0x003),
+	csrAlias("fscsr", "d,s", 0x1, 0x003),
+	csrAlias("frrm", "d", 0x2, 0x002),
+	csrAlias("fsrm", "s", 0x1, 0x002),
+	csrAlias("fsrm", "d,s", 0x1, 0x002),
+	csrAlias("frflags", "d", 0x2, 0x001),
+	csrAlias("fsflags", "s", 0x1, 0x001),
+	csrAlias("fsflags", "d,s", 0x1, 0x001),
+	desc("csrr", RV_INST_I_TYPE, "d,E", 0x2<<12|uint32(RV_OPCODE_SYSTEM), 0x000ff07f),
+	desc("csrw", RV_INST_I_TYPE, "E,s", 0x1<<12|uint32(RV_OPCODE_SYSTEM), 0x00007fff),
+	desc("csrs", RV_INST_I_TYPE, "E,s", 0x2<<12|uint32(RV_OPCODE_SYSTEM), 0x00007fff),
+	desc("csrc", RV_INST_I_TYPE, "E,s", 0x3<<12|uint32(RV_OPCODE_SYSTEM), 0x00007fff),
+	desc("csrwi", RV_INST_I_TYPE, "E,Z", 0x5<<12|uint32(RV_OPCODE_SYSTEM), 0x00007fff),
+	desc("csrsi", RV_INST_I_TYPE, "E,Z", 0x6<<12|uint32(RV_OPCODE_SYSTEM), 0x00007fff),
+	desc("csrci", RV_INST_I_TYPE, "E,Z", 0x7<<12|uint32(RV_OPCODE_SYSTEM), 0x00007fff),
+}
+
+// pseudo-instructions that only swap the operands of another one; they
+// are never printed
+var pseudoTable = []instDesc{
+	desc("bgt", RV_INST_B_TYPE, "t,s,p", 0x00004063, 0x0000707f),
+	desc("ble", RV_INST_B_TYPE, "t,s,p", 0x00005063, 0x0000707f),
+	desc("bgtu", RV_INST_B_TYPE, "t,s,p", 0x00006063, 0x0000707f),
+	desc("bleu", RV_INST_B_TYPE, "t,s,p", 0x00007063, 0x0000707f),
+}
+
+// nonzero marks the registers of an alias that may not be x0 for it to
+// stand for the instruction, as for the mv that c.mv expands to
+func nonzero(d instDesc, nz string) instDesc {
+	d.nz = nz
+	return d
+}
+
+// csrAlias returns an alias of a CSR instruction on a fixed CSR; the
+// registers missing from args are x0.
+func csrAlias(mnem, args string, f3, csr uint32) instDesc {
+	mask := uint32(0xfff0707f)
+	if !strings.Contains(args, "d") {
+		mask |= 0x1f << 7
+	}
+	if !strings.Contains(args, "s") {
+		mask |= 0x1f << 15
+	}
+	return desc(mnem, RV_INST_I_TYPE, args, csr<<20|f3<<12|uint32(RV_OPCODE_SYSTEM), mask)
+}
+
+var mnem2inst = make(map[string][]*instDesc)
+var opcode2inst = make(map[RV_OPCODE_TYPE][]*instDesc)
+
+func init() {
+	for _, t := range extTables {
+		for _, d := range t.table {
+			d.ext = t.ext
+			if d.xlen != 0 || !strings.ContainsRune(d.args, '>') {
+				instTable = append(instTable, d)
+				continue
+			}
+			// a shift amount takes 6 bits on RV64 but only 5 on RV32,
+			// where the 6th must be zero
+			d.xlen = 64
+			instTable = append(instTable, d)
+			d.xlen = 32
+			d.args = strings.Replace(d.args, ">", "<", 1)
+			d.mask |= 1 << 25
+			instTable = append(instTable, d)
+		}
+	}
+	for _, f := range fpTable {
+		for fmt, name := range []string{"s", "d"} {
+			d := f
+			d.mnem = strings.Replace(f.mnem, "%s", name, 1)
+			d.match |= uint32(fmt) << 25
+			d.ext = []string{"f", "d"}[fmt]
+			instTable = append(instTable, d)
+		}
+	}
+	for _, a := range amoTable {
+		for f3, width := range []string{0x2: ".w", 0x3: ".d"} {
+			if width == "" {
+				continue
+			}
+			for aqrl, order := range amoOrdering {
+				d := amo(a.mnem+width+order, a.funct5, uint32(f3), uint32(aqrl))
+				d.ext = "a"
+				if width == ".d" {
+					d = rv64(d)
+				}
+				instTable = append(instTable, d)
+			}
+		}
+	}
+
+	for i := range instTable {
+		d := &instTable[i]
+		mnem2inst[d.mnem] = append(mnem2inst[d.mnem], d)
+		op := RV_OPCODE_TYPE(d.match & 0x7f)
+		opcode2inst[op] = append(opcode2inst[op], d)
+	}
+	for _, table := range [][]instDesc{aliasTable, pseudoTable} {
+		for i := range table {
+			d := &table[i]
+			// an alias needs whatever the instruction it stands for needs
+			for _, i := range opcode2inst[RV_OPCODE_TYPE(d.match&0x7f)] {
+				if d.match&i.mask == i.match {
+					d.ext, d.xlen = i.ext, i.xlen
+					break
+				}
+			}
+			mnem2inst[d.mnem] = append(mnem2inst[d.mnem], d)
+		}
+	}
+
+	isa, _ := ParseISA(DefaultISA)
+	SetISA(isa)
+}
+
+func (d *instDesc) enabled(isa *ISA) bool {
+	return (d.xlen == 0 || d.xlen == isa.XLEN) && (d.ext == "" || isa.Has(d.ext))
+}
+
+// unavailable tells why d is not enabled for isa
+func (d *instDesc) unavailable(isa *ISA) error {
+	if d.ext != "" && !isa.Has(d.ext) {
+		return errors.New("Instruction " + d.mnem + " requires extension " + d.ext)
+	}
+	return errors.New("Instruction " + d.mnem + " requires RV" + strconv.Itoa(d.xlen))
+}
+
+// whether BinToInst prints aliases
+var aliases = true
+
+// SetAliases tells whether BinToInst prints aliases such as "mv" and "ret"
+// rather than the instructions they stand for
+func SetAliases(on bool) {
+	aliases = on
+}
+
+func lookupAlias(bits uint32) *instDesc {
+	if !aliases {
+		return nil
+	}
+	for i := range aliasTable {
+		d := &aliasTable[i]
+		if bits&d.mask == d.match && d.enabled(current) && !d.zero(bits) {
+			return d
+		}
+	}
+	return nil
+}
+
+// zero tells if a register of d.nz is x0 in bits
+func (d *instDesc) zero(bits uint32) bool {
+	for _, r := range d.nz {
+		shift := map[rune]uint{'d': 7, 's': 15, 't': 20}[r]
+		if bits>>shift&0x1f == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupBits(bits uint32, isa *ISA) *instDesc {
+	for _, d := range opcode2inst[RV_OPCODE_TYPE(bits&0x7f)] {
+		if bits&d.mask == d.match && d.enabled(isa) {
+			return d
+		}
+	}
+	return nil
+}
+
+func isOperand(c rune) bool {
+	switch c {
+	case ',', '(', ')':
+		return false
+	}
+	return true
+}
+
+func signExtend(v uint32, width uint) int64 {
+	return int64(int32(v<<(32-width)) >> (32 - width))
+}
+
+// getImm extracts the immediate operand c from an instruction.  Branch and
+// jump offsets are returned in bytes and the upper immediate of U-type with
+// its low 12 bits cleared, so all of them are plain values.
+func getImm(c rune, bits uint32) int64 {
+	switch c {
+	case 'j', 'o':
+		return signExtend(bits>>20, 12)
+	case 'q':
+		return signExtend(bits>>25<<5|bits>>7&0x1f, 12)
+	case 'p':
+		return signExtend(bits>>31<<12|bits>>7&0x1<<11|bits>>25&0x3f<<5|bits>>8&0xf<<1, 13)
+	case 'a':
+		return signExtend(bits>>31<<20|bits>>21&0x3ff<<1|bits>>20&0x1<<11|bits>>12&0xff<<12, 21)
+	case 'u':
+		return int64(int32(bits & 0xfffff000))
+	case '>':
+		return int64(bits >> 20 & 0x3f)
+	case '<':
+		return int64(bits >> 20 & 0x1f)
+	}
+	return 0
+}
+
+// putImm is the reverse of getImm; bits of imm that do not fit are dropped.
+func putImm(c rune, imm int64) uint32 {
+	v := uint32(imm)
+	switch c {
+	case 'j', 'o':
+		return (v & 0xfff) << 20
+	case 'q':
+		return (v>>5&0x7f)<<25 | (v&0x1f)<<7
+	case 'p':
+		return (v>>12&0x1)<<31 | (v>>5&0x3f)<<25 | (v>>1&0xf)<<8 | (v>>11&0x1)<<7
+	case 'a':
+		return (v>>20&0x1)<<31 | (v>>1&0x3ff)<<21 | (v>>11&0x1)<<20 | (v>>12&0xff)<<12
+	case 'u':
+		return v & 0xfffff000
+	case '>':
+		return (v & 0x3f) << 20
+	case '<':
+		return (v & 0x1f) << 20
+	}
+	return 0
 }
 
 func BinToInst(bin []byte) string {
 
-	nm, t := instType(bin)
-	if nm == "noimp" {
+	if InstLen(bin) == 2 {
+		bin = Expand(bin)
+	}
+	if len(bin) < 4 {
 		return "noimp"
 	}
-	rd := bits2reg[(bin[1]&0x0f)<<1+bin[0]>>7]
-	rs1 := bits2reg[(bin[2]&0x0f)<<1+bin[1]>>7]
-	rs2 := bits2reg[(bin[2]&0xf0)>>4+(bin[3]&0x01)<<4]
-
-	switch t {
-	case RV_INST_R_TYPE:
-		return nm + " " + rd + "," + rs1 + "," + rs2
-	case RV_INST_I_TYPE:
-		imm := bin[2]>>4 + bin[3]<<4
-		return nm + " " + rd + "," + rs1 + "," + strconv.FormatUint(uint64(imm), 16)
-	case RV_INST_S_TYPE:
-		imm := (bin[3]&0xfe)<<5 + (bin[1]&0x0f)<<1 + bin[0]>>7
-		return nm + " " + rs2 + "," + rs1 + "," + strconv.FormatUint(uint64(imm), 16)
-	case RV_INST_B_TYPE:
-		imm := ((bin[3]&0x80)<<4 + (bin[0]&0x80)<<3 + (bin[3]&0x7e)<<3 + (bin[1] & 0x0f)) << 1
-		return nm + " " + rs1 + "," + rs2 + "," + strconv.FormatUint(uint64(imm), 16)
-	case RV_INST_U_TYPE:
-		imm := uint32(bin[3])<<24 + uint32(bin[2])<<16 + uint32(bin[1]&0xf0)<<8
-		return nm + " " + rd + "," + strconv.FormatUint(uint64(imm), 16)
-	case RV_INST_J_TYPE:
-	}
-
-	return nm
-}
-
-func instType(bin []byte) (string, RV_INST_TYPE) {
-	var nm string
-	var t RV_INST_TYPE
-
-	switch RV_OPCODE_TYPE(bin[0] & 0x7f) {
-	case RV_OPCODE_LOAD:
-		t = RV_INST_R_TYPE
-		switch (bin[1] & 0x70) >> 4 {
-		case 0:
-			nm = "lb"
-		case 1:
-			nm = "lh"
-		case 2:
-			nm = "lw"
-		case 3:
-			nm = "ld"
-		case 4:
-			nm = "lbu"
-		case 5:
-			nm = "lhu"
-		case 6:
-			nm = "lwu"
-		}
-		return nm, t
-	case RV_OPCODE_OP_IMM:
-		t = RV_INST_I_TYPE
-		switch (bin[1] & 0x70) >> 4 {
-		case 0:
-			nm = "addi"
-		case 1:
-			nm = "slli"
-		case 2:
-			nm = "slti"
-		case 3:
-			nm = "sltiu"
-		case 4:
-			nm = "ori"
-		case 5:
-			if bin[3]&0x40 == 0 {
-				nm = "srli"
+	bits := binary.LittleEndian.Uint32(bin)
+	d := lookupAlias(bits)
+	if d == nil {
+		d = lookupBits(bits, current)
+	}
+	if d == nil {
+		return "noimp"
+	}
+	if d.args == "" {
+		return d.mnem
+	}
+
+	rd := bits2reg[byte(bits>>7&0x1f)]
+	rs1 := bits2reg[byte(bits>>15&0x1f)]
+	rs2 := bits2reg[byte(bits>>20&0x1f)]
+
+	ret := d.mnem + " "
+	for _, c := range d.args {
+		switch c {
+		case 'd':
+			ret += rd
+		case 's':
+			ret += rs1
+		case 't':
+			ret += rs2
+		case 'D':
+			ret += bits2freg[byte(bits>>7&0x1f)]
+		case 'S':
+			ret += bits2freg[byte(bits>>15&0x1f)]
+		case 'T':
+			ret += bits2freg[byte(bits>>20&0x1f)]
+		case 'R':
+			ret += bits2freg[byte(bits>>27&0x1f)]
+		case 'm':
+			rm, ok := bits2rm[bits>>12&0x7]
+			if !ok {
+				return "noimp"
+			}
+			if rm == "dyn" {
+				ret = strings.TrimSuffix(ret, ",")
 			} else {
-				nm = "srai"
+				ret += rm
 			}
-		case 6:
-			nm = "xori"
-		case 7:
-			nm = "andi"
-		}
-		return nm, t
-	case RV_OPCODE_AUIPC:
-		return "auipc", RV_INST_U_TYPE
-	case RV_OPCODE_OP_IMM_32:
-		t = RV_INST_I_TYPE
-		switch (bin[1] & 0x70) >> 4 {
-		case 0:
-			nm = "addiw"
-		case 1:
-			nm = "slliw"
-		case 5:
-			if bin[3]&0x40 == 0 {
-				nm = "srliw"
+		case 'j', 'o', 'q':
+			ret += strconv.FormatInt(getImm(c, bits), 10)
+		case 'p':
+			ret += strconv.FormatUint(uint64(getImm(c, bits)>>1&0xfff), 16)
+		case 'a':
+			ret += strconv.FormatUint(uint64(getImm(c, bits)>>1&0xfffff), 16)
+		case 'u':
+			ret += strconv.FormatUint(uint64(bits>>12), 16)
+		case 'E':
+			ret += csrName(bits >> 20)
+		case 'Z':
+			ret += strconv.FormatUint(uint64(bits>>15&0x1f), 10)
+		case 'P':
+			ret += fenceSet(bits >> 24 & 0xf)
+		case 'Q':
+			ret += fenceSet(bits >> 20 & 0xf)
+		case '>', '<':
+			ret += strconv.FormatUint(uint64(getImm(c, bits)), 16)
+		case 'v':
+			ret += bits2vreg[byte(bits>>7&0x1f)]
+		case 'V':
+			ret += bits2vreg[byte(bits>>15&0x1f)]
+		case 'W':
+			ret += bits2vreg[byte(bits>>20&0x1f)]
+		case 'i':
+			ret += strconv.FormatInt(signExtend(bits>>15&0x1f, 5), 10)
+		case 'k':
+			ret += strconv.FormatUint(uint64(bits>>15&0x1f), 10)
+		case 'g':
+			ret += vtypeName(bits >> 20 & 0x7ff)
+		case 'h':
+			ret += vtypeName(bits >> 20 & 0x3ff)
+		case 'M':
+			if bits&(1<<25) != 0 {
+				ret = strings.TrimSuffix(ret, ",")
 			} else {
-				nm = "sraiw"
+				ret += "v0.t"
 			}
+		case '0':
+			ret += "v0"
+		default:
+			ret += string(c)
 		}
-		return nm, t
-	case RV_OPCODE_STORE:
-		t = RV_INST_S_TYPE
-		switch (bin[1] & 0x70) >> 4 {
-		case 0:
-			nm = "sb"
-		case 1:
-			nm = "sh"
-		case 2:
-			nm = "sw"
-		case 3:
-			nm = "sd"
-		}
-		return nm, t
-	case RV_OPCODE_OP:
-		t = RV_INST_R_TYPE
-		switch (bin[1] & 0x70) >> 4 {
-		case 0:
-			if bin[3]&0x40 == 0 {
-				nm = "add"
-			} else {
-				nm = "sub"
+	}
+
+	return ret
+}
+
+// fence sets are written as a subset of "iorw", from bit 3 down to bit 0
+func fenceSet(set uint32) string {
+	if set == 0 {
+		return "0"
+	}
+	ret := ""
+	for i, c := range "iorw" {
+		if set&(0x8>>uint(i)) != 0 {
+			ret += string(c)
+		}
+	}
+	return ret
+}
+
+func fenceBits(set string) (uint32, error) {
+	if set == "0" {
+		return 0, nil
+	}
+	var ret uint32
+	for _, c := range set {
+		i := strings.IndexRune("iorw", c)
+		if i < 0 || ret&(0x8>>uint(i)) != 0 {
+			return 0, errors.New("Invalid fence set " + set)
+		}
+		ret |= 0x8 >> uint(i)
+	}
+	return ret, nil
+}
+
+func regBits(reg string) (uint32, error) {
+	r, ok := reg2bits[reg]
+	if !ok {
+		return 0, errors.New("Unknown register " + reg)
+	}
+	return r, nil
+}
+
+// OperandError is an error in the operand of the given index
+type OperandError struct {
+	Index int
+	Err   error
+}
+
+func (e *OperandError) Error() string {
+	return e.Err.Error()
+}
+
+// encodeArgs fills the operands into the instruction.  A branch or jump
+// target that is a symbol rather than an offset is left zero, and the
+// relocation it needs is returned.
+func encodeArgs(d *instDesc, ops []string, ev Evaluator) (uint32, elf.R_RISCV, error) {
+	ops, at := defaultOffset(d, ops)
+	bits := d.match
+	reloc := elf.R_RISCV_NONE
+	n := 0
+	for _, c := range d.args {
+		if !isOperand(c) {
+			continue
+		}
+		if n >= len(ops) {
+			if c == 'm' {
+				bits |= rm2bits["dyn"] << 12
+				continue
 			}
-		case 1:
-			nm = "sll"
-		case 2:
-			nm = "slt"
-		case 3:
-			nm = "sltu"
-		case 4:
-			nm = "or"
-		case 5:
-			if bin[3]&0x40 == 0 {
-				nm = "srl"
-			} else {
-				nm = "sra"
+			if c == 'M' {
+				bits |= 1 << 25
+				continue
 			}
-		case 6:
-			nm = "xor"
-		case 7:
-			nm = "and"
-		}
-		return nm, t
-	case RV_OPCODE_LUI:
-		return "lui", RV_INST_U_TYPE
-	case RV_OPCODE_OP_32:
-		t = RV_INST_R_TYPE
-		switch (bin[1] & 0x70) >> 4 {
-		case 0:
-			if bin[3]&0x40 == 0 {
-				nm = "addw"
-			} else {
-				nm = "subw"
+			return 0, reloc, errors.New("Too few operands for " + d.mnem)
+		}
+		n++
+
+		b, r, err := encodeOperand(d, c, ops[n-1:], ev)
+		if err != nil {
+			// the index is that of the operands as given
+			i := n - 1
+			if at >= 0 && i > at {
+				i--
 			}
-		case 1:
-			nm = "sllw"
-		case 5:
-			if bin[3]&0x40 == 0 {
-				nm = "srlw"
-			} else {
-				nm = "sraw"
+			return 0, reloc, &OperandError{Index: i, Err: err}
+		}
+		bits |= b
+		if r != elf.R_RISCV_NONE {
+			reloc = r
+		}
+		if c == 'g' || c == 'h' {
+			// vtype runs to the end of the operands
+			n = len(ops)
+		}
+	}
+	if n != len(ops) {
+		return 0, reloc, errors.New("Too many operands for " + d.mnem)
+	}
+	return bits, reloc, nil
+}
+
+// encodeOperand returns the bits of the operand ops[0], of letter c, or the
+// relocation that fills them in
+func encodeOperand(d *instDesc, c rune, ops []string, ev Evaluator) (uint32, elf.R_RISCV, error) {
+	op := ops[0]
+	switch c {
+	case 'd', 's', 't':
+		r, err := regBits(op)
+		if err != nil {
+			return 0, elf.R_RISCV_NONE, err
+		}
+		switch c {
+		case 'd':
+			return r << 7, elf.R_RISCV_NONE, nil
+		case 's':
+			return r << 15, elf.R_RISCV_NONE, nil
+		}
+		return r << 20, elf.R_RISCV_NONE, nil
+	case 'D', 'S', 'T', 'R':
+		r, ok := freg2bits[op]
+		if !ok {
+			return 0, elf.R_RISCV_NONE, errors.New("Unknown floating-point register " + op)
+		}
+		switch c {
+		case 'D':
+			return r << 7, elf.R_RISCV_NONE, nil
+		case 'S':
+			return r << 15, elf.R_RISCV_NONE, nil
+		case 'T':
+			return r << 20, elf.R_RISCV_NONE, nil
+		}
+		return r << 27, elf.R_RISCV_NONE, nil
+	case 'm':
+		rm, ok := rm2bits[op]
+		if !ok {
+			return 0, elf.R_RISCV_NONE, errors.New("Unknown rounding mode " + op)
+		}
+		return rm << 12, elf.R_RISCV_NONE, nil
+	case 'j', 'o', 'q', 'p', 'a', 'u', '>', '<':
+		imm, r, err := immediate(c, op, ev)
+		if err != nil || r != elf.R_RISCV_NONE {
+			return 0, r, err
+		}
+		if c == 'u' {
+			imm <<= 12
+		}
+		return putImm(c, imm), elf.R_RISCV_NONE, nil
+	case 'E':
+		if csr, ok := csr2bits[op]; ok {
+			return csr << 20, elf.R_RISCV_NONE, nil
+		}
+		csr, _, err := immediate(c, op, ev)
+		if err != nil {
+			return 0, elf.R_RISCV_NONE, errors.New("Unknown CSR " + op)
+		}
+		return uint32(csr) << 20, elf.R_RISCV_NONE, nil
+	case 'Z', 'i', 'k':
+		imm, _, err := immediate(c, op, ev)
+		if err != nil {
+			return 0, elf.R_RISCV_NONE, err
+		}
+		return uint32(imm) & 0x1f << 15, elf.R_RISCV_NONE, nil
+	case 'P', 'Q':
+		set, err := fenceBits(op)
+		if err != nil {
+			return 0, elf.R_RISCV_NONE, err
+		}
+		if c == 'P' {
+			return set << 24, elf.R_RISCV_NONE, nil
+		}
+		return set << 20, elf.R_RISCV_NONE, nil
+	case 'v', 'V', 'W':
+		r, ok := vreg2bits[op]
+		if !ok {
+			return 0, elf.R_RISCV_NONE, errors.New("Unknown vector register " + op)
+		}
+		switch c {
+		case 'v':
+			return r << 7, elf.R_RISCV_NONE, nil
+		case 'V':
+			return r << 15, elf.R_RISCV_NONE, nil
+		}
+		return r << 20, elf.R_RISCV_NONE, nil
+	case 'g', 'h':
+		vtype, err := vtypeBits(strings.Split(strings.Join(ops, ","), ","))
+		if err != nil {
+			return 0, elf.R_RISCV_NONE, err
+		}
+		if c == 'h' && vtype > 0x3ff {
+			return 0, elf.R_RISCV_NONE, errors.New("vtype out of range for " + d.mnem)
+		}
+		return vtype << 20, elf.R_RISCV_NONE, nil
+	case 'M':
+		if op != "v0.t" {
+			return 0, elf.R_RISCV_NONE, errors.New("Unknown mask operand " + op)
+		}
+	case '0':
+		if op != "v0" {
+			return 0, elf.R_RISCV_NONE, errors.New(d.mnem + " takes v0, not " + op)
+		}
+	}
+	return 0, elf.R_RISCV_NONE, nil
+}
+
+// defaultOffset puts in the zero offset left out of o(s) or q(s), as in
+// "lw a0, (a1)", and tells where it went, or -1
+func defaultOffset(d *instDesc, ops []string) ([]string, int) {
+	n, at := 0, -1
+	for i, c := range d.args {
+		if !isOperand(c) {
+			continue
+		}
+		if (c == 'o' || c == 'q') && strings.HasPrefix(d.args[i+1:], "(s)") {
+			at = n
+		}
+		n++
+	}
+	if at < 0 || len(ops) != n-1 {
+		return ops, -1
+	}
+	return append(append(append([]string{}, ops[:at]...), "0"), ops[at:]...), at
+}
+
+// InstToBin encodes an instruction, given as its mnemonic and operands.
+// When an operand is left to a relocation, the type of the relocation is
+// returned with the encoding.
+func InstToBin(inst []string) ([]byte, elf.R_RISCV, error) {
+	return encode(inst, current, evaluate)
+}
+
+// An Encoder encodes instructions for an ISA of its own, evaluating their
+// immediates with Eval, if set; unlike InstToBin, it does not go by
+// SetISA and SetEvaluator, so that several may be used at once.
+type Encoder struct {
+	ISA  *ISA
+	Eval Evaluator
+}
+
+// InstToBin is InstToBin for the ISA of e
+func (e *Encoder) InstToBin(inst []string) ([]byte, elf.R_RISCV, error) {
+	return encode(inst, e.ISA, e.Eval)
+}
+
+// Compress is Compress for the ISA of e
+func (e *Encoder) Compress(bin []byte) []byte {
+	return compress(bin, e.ISA)
+}
+
+func encode(inst []string, isa *ISA, ev Evaluator) ([]byte, elf.R_RISCV, error) {
+
+	switch inst[0] {
+	case "call", "tail":
+		if len(inst) != 2 || !relocatable(inst[1], ev) {
+			return nil, elf.R_RISCV_NONE, errors.New("Syntax error: " + inst[0] + " takes a symbol")
+		}
+		if inst[0] == "call" {
+			return sequence([][]string{{"auipc", "ra", "0"}, {"jalr", "ra", "0", "ra"}}, isa, elf.R_RISCV_CALL)
+		}
+		return sequence([][]string{{"auipc", "t1", "0"}, {"jalr", "zero", "0", "t1"}}, isa, elf.R_RISCV_CALL)
+
+	case "la", "lla":
+		// the auipc takes R_RISCV_PCREL_HI20, the addi R_RISCV_PCREL_LO12_I
+		if len(inst) != 3 || !relocatable(inst[2], ev) {
+			return nil, elf.R_RISCV_NONE, errors.New("Syntax error: " + inst[0] + " takes a register and a symbol")
+		}
+		rd := inst[1]
+		return sequence([][]string{{"auipc", rd, "0"}, {"addi", rd, rd, "0"}}, isa, elf.R_RISCV_PCREL_HI20)
+
+	case "li":
+		if len(inst) != 3 {
+			return nil, elf.R_RISCV_NONE, errors.New("Syntax error: li takes a register and a number")
+		}
+		v, err := constant(inst[2], ev)
+		if err != nil {
+			return nil, elf.R_RISCV_NONE, &OperandError{Index: 1, Err: err}
+		}
+		if isa.XLEN == 32 {
+			// either signed or unsigned 32 bits
+			if v != int64(int32(v)) && v != int64(uint32(v)) {
+				return nil, elf.R_RISCV_NONE, &OperandError{Index: 1, Err: errors.New("Value " + inst[2] + " does not fit in 32 bits")}
 			}
+			v = int64(int32(v))
 		}
-		return nm, t
-	case RV_OPCODE_BRANCH:
-		t = RV_INST_B_TYPE
-		switch (bin[1] & 0x70) >> 4 {
-		case 0:
-			nm = "beq"
-		case 1:
-			nm = "bne"
-		case 4:
-			nm = "blt"
-		case 5:
-			nm = "bgt"
-		case 6:
-			nm = "bltu"
-		case 7:
-			nm = "bgtu"
-		}
-		return nm, t
-	case RV_OPCODE_JALR:
-		return "jalr", RV_INST_I_TYPE
-	case RV_OPCODE_JAL:
-		return "jal", RV_INST_J_TYPE
-	case RV_OPCODE_SYSTEM:
-		return "ecall", RV_INST_NONE
-	}
-	return "noimp", RV_INST_NONE
-}
-
-func InstToBin(inst []string) ([]byte, elf.R_RISCV) {
-
-	t := mnem2type[inst[0]]
-	var op RV_OPCODE_TYPE
-	if t != RV_INST_PSEUDO {
-		op = mnem2opcode[inst[0]]
+		return sequence(liSeq(inst[1], v, isa.XLEN), isa, elf.R_RISCV_NONE)
 	}
 
+	ds := mnem2inst[inst[0]]
+	if len(ds) == 0 {
+		return nil, elf.R_RISCV_NONE, errors.New("Unknown instruction " + inst[0])
+	}
+
+	// the first form that takes the operands wins; if none does, the error
+	// of the first one enabled is reported, or else why the first is not
 	var bits uint32
-	switch t {
-	case RV_INST_R_TYPE:
-		rd := reg2bits[inst[1]]
-		rs1 := reg2bits[inst[2]]
-		rs2 := reg2bits[inst[3]]
-		f3 := funct3[inst[0]]
+	var r elf.R_RISCV
+	var err error
+	tried := false
+	for _, d := range ds {
+		if !d.enabled(isa) {
+			if err == nil {
+				err = d.unavailable(isa)
+			}
+			continue
+		}
+		var e error
+		bits, r, e = encodeArgs(d, inst[1:], ev)
+		if e == nil {
+			err = nil
+			break
+		}
+		if !tried {
+			err, tried = e, true
+		}
+	}
+	if err != nil {
+		return nil, elf.R_RISCV_NONE, err
+	}
+
+	ret := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ret, bits)
+	return ret, r, nil
+}
 
-		var f7 uint32
-		if inst[0] == "sub" || inst[0] == "sra" || inst[0] == "sraw" {
-			f7 = 0x20
+// relocatable reports whether op is a symbol, possibly with an addend, for
+// the linker to fill in
+func relocatable(op string, ev Evaluator) bool {
+	if ev == nil {
+		return IsSymbol(op)
+	}
+	imm, err := ev(op)
+	return err == nil && !imm.Constant && imm.Op == ""
+}
+
+// constant returns the value of op, which must not need a relocation
+func constant(op string, ev Evaluator) (int64, error) {
+	if ev == nil {
+		v, err := strconv.ParseInt(op, 0, 64)
+		if err != nil {
+			u, uerr := strconv.ParseUint(op, 0, 64)
+			if uerr != nil {
+				return 0, err
+			}
+			v = int64(u)
 		}
+		return v, nil
+	}
+	imm, err := ev(op)
+	if err != nil {
+		return 0, err
+	}
+	if !imm.Constant {
+		return 0, errors.New("Operand " + op + " must be a constant")
+	}
+	return imm.Value, nil
+}
 
-		bits = f7<<25 | rs2<<20 | rs1<<15 | f3<<12 | rd<<7 | uint32(op)
+// sequence encodes the instructions of a pseudo-instruction one after
+// another.  Their operands are all in the notation of BinToInst.
+func sequence(insts [][]string, isa *ISA, r elf.R_RISCV) ([]byte, elf.R_RISCV, error) {
+	ret := make([]byte, 0)
+	for _, inst := range insts {
+		b, _, err := encode(inst, isa, nil)
+		if err != nil {
+			return nil, elf.R_RISCV_NONE, err
+		}
+		ret = append(ret, b...)
+	}
+	return ret, r, nil
+}
 
-	case RV_INST_I_TYPE:
-		var isop int
-		if (op == RV_OPCODE_OP_IMM) || (op == RV_OPCODE_OP_IMM_32) {
-			isop = 1
+// liSeq returns the shortest of a few sequences loading v into rd, the
+// ones LLVM tries.  A value with trailing zeroes may be cheaper to build
+// without them and shift up with slli; a positive value with leading
+// zeroes may be cheaper to build shifted up, with ones or zeroes below,
+// and then shifted back with srli.  On RV32, v is taken to fit in 32 bits
+// and never needs more than lui and addi.
+func liSeq(rd string, v int64, xlen int) [][]string {
+	seq := liShifted(rd, v, xlen)
+	if len(seq) <= 2 {
+		return seq
+	}
+
+	if tz := uint(bits.TrailingZeros64(uint64(v))); v&0xfff != 0 && tz > 0 {
+		try := append(liShifted(rd, v>>tz, xlen),
+			[]string{"slli", rd, rd, strconv.FormatUint(uint64(tz), 16)})
+		if len(try) < len(seq) {
+			seq = try
 		}
+	}
+	if v <= 0 {
+		return seq
+	}
 
-		f3 := funct3[inst[0]]
-		var issh bool
-		if f3 == 0x01 || f3 == 0x05 {
-			issh = true
+	lz := uint(bits.LeadingZeros64(uint64(v)))
+	for _, fill := range []uint64{1<<lz - 1, 0} {
+		try := append(liShifted(rd, int64(uint64(v)<<lz|fill), xlen),
+			[]string{"srli", rd, rd, strconv.FormatUint(uint64(lz), 16)})
+		if len(try) < len(seq) {
+			seq = try
 		}
+	}
+	return seq
+}
 
-		rd := reg2bits[inst[1]]
-		rs1 := reg2bits[inst[3-isop]]
-		if issh {
-			shamt, _ := strconv.ParseUint(inst[2+isop], 16, 6)
+// liShifted returns a lui/addi(w)/slli sequence loading v into rd.  A
+// 32-bit value takes lui and addiw, or addi on RV32; a wider one is built
+// from the value without its low 12 bits, shifted into place and topped up
+// with addi.
+func liShifted(rd string, v int64, xlen int) [][]string {
+	lo12 := signExtend(uint32(v)&0xfff, 12)
 
-			var f6 uint32
-			if inst[0] == "srai" || inst[0] == "sraiw" {
-				f6 = 0x10
-			} else {
-				f6 = 0
+	if v == int64(int32(v)) {
+		hi20 := (v + 0x800) >> 12 & 0xfffff
+		seq := make([][]string, 0)
+		src := "zero"
+		if hi20 != 0 {
+			seq = append(seq, []string{"lui", rd, strconv.FormatInt(hi20, 16)})
+			src = rd
+		}
+		if lo12 != 0 || hi20 == 0 {
+			op := "addi"
+			if hi20 != 0 && xlen == 64 {
+				op = "addiw"
 			}
+			seq = append(seq, []string{op, rd, src, strconv.FormatInt(lo12, 10)})
+		}
+		return seq
+	}
 
-			bits = f6<<26 | uint32(shamt)<<20 | rs1<<15 | f3<<12 | rd<<7 | uint32(op)
-		} else {
-			imm, _ := strconv.ParseInt(inst[2+isop], 10, 12)
-			bits = uint32(imm)<<20 | rs1<<15 | f3<<12 | rd<<7 | uint32(op)
-		}
-
-	case RV_INST_S_TYPE:
-		f3 := funct3[inst[0]]
-		rs1 := reg2bits[inst[3]]
-		imm, _ := strconv.ParseInt(inst[2], 10, 12)
-		rs2 := reg2bits[inst[1]]
-
-		bits = uint32(imm) << 20
-		bits &= 0xfe000000
-		bits |= (rs2<<20 | rs1<<15 | f3<<12 | (uint32(imm)&0x1f)<<7 | uint32(op))
-
-	case RV_INST_B_TYPE:
-		f3 := funct3[inst[0]]
-		rs1 := reg2bits[inst[1]]
-		rs2 := reg2bits[inst[2]]
-		imm, _ := strconv.ParseUint(inst[3], 16, 12)
-
-		fmt.Println(imm)
-		fmt.Println(imm & 0x800)
-		imm12 := uint32((imm & 0x800) >> 11)
-		imm11 := uint32((imm & 0x400) >> 10)
-		imm10_5 := uint32((imm & 0x3f0) >> 4)
-		imm4_1 := uint32(imm & 0x00f)
-		fmt.Println(imm12, imm11, imm10_5, imm4_1)
-
-		bits = imm12<<31 | imm10_5<<25 | rs2<<20 | rs1<<15 | f3<<12 | imm4_1<<8 | imm11<<7 | uint32(op)
-
-	case RV_INST_U_TYPE:
-		rd := reg2bits[inst[1]]
-		imm, _ := strconv.ParseUint(inst[2], 16, 20)
-		bits = uint32(imm)<<12 | rd<<7 | uint32(op)
-
-	case RV_INST_J_TYPE:
-	case RV_INST_NONE:
-		bits |= uint32(op)
-	case RV_INST_PSEUDO:
-		if inst[0] == "call" {
-			ra, _ := InstToBin([]string{"auipc", "ra", "0"})
-			rb, _ := InstToBin([]string{"jalr", "ra", "0", "ra"})
-			return append(ra, rb...), elf.R_RISCV_CALL
+	hi52 := (uint64(v) + 0x800) >> 12
+	shift := uint(12 + bits.TrailingZeros64(hi52))
+	hi := int64(hi52>>(shift-12)<<shift) >> shift
+
+	// what lui loads alone takes fewer than a smaller value topped up
+	// with addi
+	if shift > 12 && (hi < -0x800 || hi >= 0x800) && hi<<12 == int64(int32(hi<<12)) {
+		hi <<= 12
+		shift -= 12
+	}
+
+	seq := append(liShifted(rd, hi, xlen), []string{"slli", rd, rd, strconv.FormatUint(uint64(shift), 16)})
+	if lo12 != 0 {
+		seq = append(seq, []string{"addi", rd, rd, strconv.FormatInt(lo12, 10)})
+	}
+	return seq
+}
+
+// IsRegister reports whether s names an integer, floating-point or vector
+// register
+func IsRegister(s string) bool {
+	_, i := reg2bits[s]
+	_, f := freg2bits[s]
+	_, v := vreg2bits[s]
+	return i || f || v
+}
+
+// IsSymbol reports whether s can name a symbol
+func IsSymbol(s string) bool {
+	for i, c := range s {
+		switch {
+		case c == '_' || c == '.' || c == '$':
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
 		}
 	}
+	return s != ""
+}
 
+// Fixup returns a copy of bin, the instruction or instructions a
+// relocation of type r points at, with their target set to v: the offset
+// of a branch, a jump or a call, or the value that a hi20 and a lo12 split.
+// A call is an auipc and a jalr, 8 bytes; the rest are a single instruction.
+func Fixup(bin []byte, r elf.R_RISCV, v int64) ([]byte, error) {
+	var c rune
+	var bits uint
+	switch r {
+	case elf.R_RISCV_BRANCH:
+		c, bits = 'p', 13
+	case elf.R_RISCV_JAL:
+		c, bits = 'a', 21
+	case elf.R_RISCV_CALL, elf.R_RISCV_CALL_PLT:
+		if len(bin) < 8 {
+			return nil, errors.New("Truncated call for " + r.String())
+		}
+		hi, err := Fixup(bin[:4], elf.R_RISCV_PCREL_HI20, v)
+		if err != nil {
+			return nil, err
+		}
+		lo, err := Fixup(bin[4:8], elf.R_RISCV_PCREL_LO12_I, v)
+		if err != nil {
+			return nil, err
+		}
+		return append(hi, lo...), nil
+	case elf.R_RISCV_HI20, elf.R_RISCV_PCREL_HI20:
+		// the lo12 adds its sign to what is left here
+		if v < -1<<31-0x800 || v >= 1<<31-0x800 {
+			return nil, errors.New("Value out of range for " + r.String())
+		}
+		return setImm(bin, 'u', (v+0x800)&^0xfff), nil
+	case elf.R_RISCV_LO12_I, elf.R_RISCV_PCREL_LO12_I:
+		return setImm(bin, 'j', v<<52>>52), nil
+	case elf.R_RISCV_LO12_S, elf.R_RISCV_PCREL_LO12_S:
+		return setImm(bin, 'q', v<<52>>52), nil
+	default:
+		return nil, errors.New("Cannot fix up " + r.String())
+	}
+	if v&1 != 0 {
+		return nil, errors.New("Misaligned target for " + r.String())
+	}
+	if v < -1<<(bits-1) || v >= 1<<(bits-1) {
+		return nil, errors.New("Target out of range for " + r.String())
+	}
+	return setImm(bin, c, v), nil
+}
+
+// setImm returns a copy of the instruction with the immediate of format c
+// replaced
+func setImm(bin []byte, c rune, imm int64) []byte {
+	inst := binary.LittleEndian.Uint32(bin)
+	inst = inst&^putImm(c, -1) | putImm(c, imm)
 	ret := make([]byte, 4)
-	binary.LittleEndian.PutUint32(ret, bits)
-	return ret, elf.R_RISCV_NONE
+	binary.LittleEndian.PutUint32(ret, inst)
+	return ret
 }
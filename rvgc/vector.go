@@ -0,0 +1,447 @@
+package rvgc
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// vector.go: the "V" extension, version 1.0
+//
+// Vector instructions use a few more operand letters in instDesc.args:
+//
+//	v	vd, or vs3 of a store
+//	V	vs1
+//	W	vs2
+//	i	5-bit signed immediate in the vs1 field, decimal
+//	k	5-bit unsigned immediate in the vs1 field, decimal
+//	g	vtype of vsetvli, as in "e32,m1,ta,ma"
+//	h	vtype of vsetivli
+//	M	optional mask, "v0.t"; omitted on print when unmasked
+//	0	v0, the carry or merge mask of an instruction with vm clear
+
+var bits2vreg = make(map[byte]string)
+var vreg2bits = make(map[string]uint32)
+
+var bits2sew = []string{"e8", "e16", "e32", "e64"}
+var bits2lmul = []string{0: "m1", 1: "m2", 2: "m4", 3: "m8", 5: "mf8", 6: "mf4", 7: "mf2"}
+
+// funct3 of the OP-V major opcode, for the vector-vector, vector-scalar
+// and vector-immediate forms of each family
+type vFamily struct {
+	vv, vs uint32
+}
+
+var (
+	opi = vFamily{0x0, 0x4}
+	opf = vFamily{0x1, 0x5}
+	opm = vFamily{0x2, 0x6}
+)
+
+const opivi = 0x3
+
+// forms an arithmetic instruction comes in, named after the suffix of its
+// mnemonic.  The upper-case ones read the operands the other way round, as
+// the multiply-add instructions do, or take an unsigned immediate; the
+// all upper-case ones have no mask, as those of vmadc without a carry.
+var vForms = map[string]struct {
+	kind byte
+	args string
+}{
+	"vv":  {'v', "v,W,V,M"},
+	"wv":  {'v', "v,W,V,M"},
+	"vs":  {'v', "v,W,V,M"},
+	"mm":  {'m', "v,W,V"},
+	"vm":  {'m', "v,W,V"},
+	"Vv":  {'v', "v,V,W,M"},
+	"vx":  {'s', "v,W,s,M"},
+	"wx":  {'s', "v,W,s,M"},
+	"Vx":  {'s', "v,s,W,M"},
+	"vf":  {'s', "v,W,S,M"},
+	"wf":  {'s', "v,W,S,M"},
+	"Vf":  {'s', "v,S,W,M"},
+	"vi":  {'i', "v,W,i,M"},
+	"vI":  {'i', "v,W,k,M"},
+	"wI":  {'i', "v,W,k,M"},
+	"vvm": {'v', "v,W,V,0"},
+	"vxm": {'s', "v,W,s,0"},
+	"vfm": {'s', "v,W,S,0"},
+	"vim": {'i', "v,W,i,0"},
+	"VV":  {'v', "v,W,V"},
+	"VX":  {'s', "v,W,s"},
+	"VI":  {'i', "v,W,i"},
+}
+
+// arithmetic instructions by funct6, with the forms they come in
+var vArithTable = []struct {
+	family vFamily
+	mnem   string
+	funct6 uint32
+	forms  string
+}{
+	{opi, "vadd", 0x00, "vv vx vi"},
+	{opi, "vsub", 0x02, "vv vx"},
+	{opi, "vrsub", 0x03, "vx vi"},
+	{opi, "vminu", 0x04, "vv vx"},
+	{opi, "vmin", 0x05, "vv vx"},
+	{opi, "vmaxu", 0x06, "vv vx"},
+	{opi, "vmax", 0x07, "vv vx"},
+	{opi, "vand", 0x09, "vv vx vi"},
+	{opi, "vor", 0x0a, "vv vx vi"},
+	{opi, "vxor", 0x0b, "vv vx vi"},
+	{opi, "vrgather", 0x0c, "vv vx vI"},
+	{opi, "vrgatherei16", 0x0e, "vv"},
+	{opi, "vslideup", 0x0e, "vx vI"},
+	{opi, "vslidedown", 0x0f, "vx vI"},
+	{opi, "vadc", 0x10, "vvm vxm vim"},
+	{opi, "vmadc", 0x11, "vvm vxm vim VV VX VI"},
+	{opi, "vsbc", 0x12, "vvm vxm"},
+	{opi, "vmsbc", 0x13, "vvm vxm VV VX"},
+	{opi, "vmerge", 0x17, "vvm vxm vim"},
+	{opi, "vmseq", 0x18, "vv vx vi"},
+	{opi, "vmsne", 0x19, "vv vx vi"},
+	{opi, "vmsltu", 0x1a, "vv vx"},
+	{opi, "vmslt", 0x1b, "vv vx"},
+	{opi, "vmsleu", 0x1c, "vv vx vi"},
+	{opi, "vmsle", 0x1d, "vv vx vi"},
+	{opi, "vmsgtu", 0x1e, "vx vi"},
+	{opi, "vmsgt", 0x1f, "vx vi"},
+	{opi, "vsaddu", 0x20, "vv vx vi"},
+	{opi, "vsadd", 0x21, "vv vx vi"},
+	{opi, "vssubu", 0x22, "vv vx"},
+	{opi, "vssub", 0x23, "vv vx"},
+	{opi, "vsll", 0x25, "vv vx vI"},
+	{opi, "vsmul", 0x27, "vv vx"},
+	{opi, "vsrl", 0x28, "vv vx vI"},
+	{opi, "vsra", 0x29, "vv vx vI"},
+	{opi, "vssrl", 0x2a, "vv vx vI"},
+	{opi, "vssra", 0x2b, "vv vx vI"},
+	{opi, "vnsrl", 0x2c, "wv wx wI"},
+	{opi, "vnsra", 0x2d, "wv wx wI"},
+	{opi, "vnclipu", 0x2e, "wv wx wI"},
+	{opi, "vnclip", 0x2f, "wv wx wI"},
+	{opi, "vwredsumu", 0x30, "vs"},
+	{opi, "vwredsum", 0x31, "vs"},
+
+	{opm, "vredsum", 0x00, "vs"},
+	{opm, "vredand", 0x01, "vs"},
+	{opm, "vredor", 0x02, "vs"},
+	{opm, "vredxor", 0x03, "vs"},
+	{opm, "vredminu", 0x04, "vs"},
+	{opm, "vredmin", 0x05, "vs"},
+	{opm, "vredmaxu", 0x06, "vs"},
+	{opm, "vredmax", 0x07, "vs"},
+	{opm, "vaaddu", 0x08, "vv vx"},
+	{opm, "vaadd", 0x09, "vv vx"},
+	{opm, "vasubu", 0x0a, "vv vx"},
+	{opm, "vasub", 0x0b, "vv vx"},
+	{opm, "vslide1up", 0x0e, "vx"},
+	{opm, "vslide1down", 0x0f, "vx"},
+	{opm, "vcompress", 0x17, "vm"},
+	{opm, "vmandn", 0x18, "mm"},
+	{opm, "vmand", 0x19, "mm"},
+	{opm, "vmor", 0x1a, "mm"},
+	{opm, "vmxor", 0x1b, "mm"},
+	{opm, "vmorn", 0x1c, "mm"},
+	{opm, "vmnand", 0x1d, "mm"},
+	{opm, "vmnor", 0x1e, "mm"},
+	{opm, "vmxnor", 0x1f, "mm"},
+	{opm, "vdivu", 0x20, "vv vx"},
+	{opm, "vdiv", 0x21, "vv vx"},
+	{opm, "vremu", 0x22, "vv vx"},
+	{opm, "vrem", 0x23, "vv vx"},
+	{opm, "vmulhu", 0x24, "vv vx"},
+	{opm, "vmul", 0x25, "vv vx"},
+	{opm, "vmulhsu", 0x26, "vv vx"},
+	{opm, "vmulh", 0x27, "vv vx"},
+	{opm, "vmadd", 0x29, "Vv Vx"},
+	{opm, "vnmsub", 0x2b, "Vv Vx"},
+	{opm, "vmacc", 0x2d, "Vv Vx"},
+	{opm, "vnmsac", 0x2f, "Vv Vx"},
+	{opm, "vwaddu", 0x30, "vv vx"},
+	{opm, "vwadd", 0x31, "vv vx"},
+	{opm, "vwsubu", 0x32, "vv vx"},
+	{opm, "vwsub", 0x33, "vv vx"},
+	{opm, "vwaddu", 0x34, "wv wx"},
+	{opm, "vwadd", 0x35, "wv wx"},
+	{opm, "vwsubu", 0x36, "wv wx"},
+	{opm, "vwsub", 0x37, "wv wx"},
+	{opm, "vwmulu", 0x38, "vv vx"},
+	{opm, "vwmulsu", 0x3a, "vv vx"},
+	{opm, "vwmul", 0x3b, "vv vx"},
+	{opm, "vwmaccu", 0x3c, "Vv Vx"},
+	{opm, "vwmacc", 0x3d, "Vv Vx"},
+	{opm, "vwmaccus", 0x3e, "Vx"},
+	{opm, "vwmaccsu", 0x3f, "Vv Vx"},
+
+	{opf, "vfadd", 0x00, "vv vf"},
+	{opf, "vfredusum", 0x01, "vs"},
+	{opf, "vfsub", 0x02, "vv vf"},
+	{opf, "vfredosum", 0x03, "vs"},
+	{opf, "vfmin", 0x04, "vv vf"},
+	{opf, "vfredmin", 0x05, "vs"},
+	{opf, "vfmax", 0x06, "vv vf"},
+	{opf, "vfredmax", 0x07, "vs"},
+	{opf, "vfsgnj", 0x08, "vv vf"},
+	{opf, "vfsgnjn", 0x09, "vv vf"},
+	{opf, "vfsgnjx", 0x0a, "vv vf"},
+	{opf, "vfslide1up", 0x0e, "vf"},
+	{opf, "vfslide1down", 0x0f, "vf"},
+	{opf, "vfmerge", 0x17, "vfm"},
+	{opf, "vmfeq", 0x18, "vv vf"},
+	{opf, "vmfle", 0x19, "vv vf"},
+	{opf, "vmflt", 0x1b, "vv vf"},
+	{opf, "vmfne", 0x1c, "vv vf"},
+	{opf, "vmfgt", 0x1d, "vf"},
+	{opf, "vmfge", 0x1f, "vf"},
+	{opf, "vfdiv", 0x20, "vv vf"},
+	{opf, "vfrdiv", 0x21, "vf"},
+	{opf, "vfmul", 0x24, "vv vf"},
+	{opf, "vfrsub", 0x27, "vf"},
+	{opf, "vfmadd", 0x28, "Vv Vf"},
+	{opf, "vfnmadd", 0x29, "Vv Vf"},
+	{opf, "vfmsub", 0x2a, "Vv Vf"},
+	{opf, "vfnmsub", 0x2b, "Vv Vf"},
+	{opf, "vfmacc", 0x2c, "Vv Vf"},
+	{opf, "vfnmacc", 0x2d, "Vv Vf"},
+	{opf, "vfmsac", 0x2e, "Vv Vf"},
+	{opf, "vfnmsac", 0x2f, "Vv Vf"},
+	{opf, "vfwadd", 0x30, "vv vf"},
+	{opf, "vfwredusum", 0x31, "vs"},
+	{opf, "vfwsub", 0x32, "vv vf"},
+	{opf, "vfwredosum", 0x33, "vs"},
+	{opf, "vfwadd", 0x34, "wv wf"},
+	{opf, "vfwsub", 0x36, "wv wf"},
+	{opf, "vfwmul", 0x38, "vv vf"},
+	{opf, "vfwmacc", 0x3c, "Vv Vf"},
+	{opf, "vfwnmacc", 0x3d, "Vv Vf"},
+	{opf, "vfwmsac", 0x3e, "Vv Vf"},
+	{opf, "vfwnmsac", 0x3f, "Vv Vf"},
+}
+
+// vDesc returns a vector instruction; one without a mask operand is
+// encoded with vm set, unless it reads v0 all the same, with vm clear.
+func vDesc(mnem, args string, match, mask uint32) instDesc {
+	switch {
+	case strings.ContainsRune(args, '0'):
+		mask |= 1 << 25
+	case !strings.ContainsRune(args, 'M'):
+		match |= 1 << 25
+		mask |= 1 << 25
+	}
+	return desc(mnem, RV_INST_R_TYPE, args, match, mask)
+}
+
+// vArith returns an OP-V instruction identified by funct6 and funct3
+func vArith(mnem, args string, f6, f3 uint32) instDesc {
+	return vDesc(mnem, args, f6<<26|f3<<12|uint32(RV_OPCODE_OP_V), 0xfc00707f)
+}
+
+// vUnary returns an OP-V instruction with a fixed vs1 field
+func vUnary(mnem, args string, f6, f3, vs1 uint32) instDesc {
+	return vDesc(mnem, args, f6<<26|vs1<<15|f3<<12|uint32(RV_OPCODE_OP_V), 0xfc0ff07f)
+}
+
+// vMove returns an OP-V instruction with a fixed vs2 field
+func vMove(mnem, args string, f6, f3 uint32) instDesc {
+	return vDesc(mnem, args, f6<<26|f3<<12|uint32(RV_OPCODE_OP_V), 0xfdf0707f)
+}
+
+// vTable is vMiscTable, plus the arithmetic and the memory instructions
+var vTable = vInsts()
+
+var vMiscTable = []instDesc{
+	desc("vsetvli", RV_INST_I_TYPE, "d,s,g", 0x7<<12|uint32(RV_OPCODE_OP_V), 0x8000707f),
+	desc("vsetivli", RV_INST_I_TYPE, "d,k,h", 0xc0000000|0x7<<12|uint32(RV_OPCODE_OP_V), 0xc000707f),
+	desc("vsetvl", RV_INST_R_TYPE, "d,s,t", 0x80000000|0x7<<12|uint32(RV_OPCODE_OP_V), 0xfe00707f),
+
+	vMove("vmv.v.v", "v,V", 0x17, opi.vv),
+	vMove("vmv.v.x", "v,s", 0x17, opi.vs),
+	vMove("vmv.v.i", "v,i", 0x17, opivi),
+	vMove("vfmv.v.f", "v,S", 0x17, opf.vs),
+	vUnary("vmv.x.s", "d,W", 0x10, opm.vv, 0x00),
+	vMove("vmv.s.x", "v,s", 0x10, opm.vs),
+	vUnary("vfmv.f.s", "D,W", 0x10, opf.vv, 0x00),
+	vMove("vfmv.s.f", "v,S", 0x10, opf.vs),
+	vUnary("vmv1r.v", "v,W", 0x27, opivi, 0x0),
+	vUnary("vmv2r.v", "v,W", 0x27, opivi, 0x1),
+	vUnary("vmv4r.v", "v,W", 0x27, opivi, 0x3),
+	vUnary("vmv8r.v", "v,W", 0x27, opivi, 0x7),
+
+	vUnary("vcpop.m", "d,W,M", 0x10, opm.vv, 0x10),
+	vUnary("vfirst.m", "d,W,M", 0x10, opm.vv, 0x11),
+	vUnary("vmsbf.m", "v,W,M", 0x14, opm.vv, 0x01),
+	vUnary("vmsof.m", "v,W,M", 0x14, opm.vv, 0x02),
+	vUnary("vmsif.m", "v,W,M", 0x14, opm.vv, 0x03),
+	vUnary("viota.m", "v,W,M", 0x14, opm.vv, 0x10),
+	vDesc("vid.v", "v,M", 0x14<<26|0x11<<15|opm.vv<<12|uint32(RV_OPCODE_OP_V), 0xfdfff07f),
+
+	vUnary("vzext.vf8", "v,W,M", 0x12, opm.vv, 0x02),
+	vUnary("vsext.vf8", "v,W,M", 0x12, opm.vv, 0x03),
+	vUnary("vzext.vf4", "v,W,M", 0x12, opm.vv, 0x04),
+	vUnary("vsext.vf4", "v,W,M", 0x12, opm.vv, 0x05),
+	vUnary("vzext.vf2", "v,W,M", 0x12, opm.vv, 0x06),
+	vUnary("vsext.vf2", "v,W,M", 0x12, opm.vv, 0x07),
+
+	vUnary("vfcvt.xu.f.v", "v,W,M", 0x12, opf.vv, 0x00),
+	vUnary("vfcvt.x.f.v", "v,W,M", 0x12, opf.vv, 0x01),
+	vUnary("vfcvt.f.xu.v", "v,W,M", 0x12, opf.vv, 0x02),
+	vUnary("vfcvt.f.x.v", "v,W,M", 0x12, opf.vv, 0x03),
+	vUnary("vfcvt.rtz.xu.f.v", "v,W,M", 0x12, opf.vv, 0x06),
+	vUnary("vfcvt.rtz.x.f.v", "v,W,M", 0x12, opf.vv, 0x07),
+	vUnary("vfwcvt.xu.f.v", "v,W,M", 0x12, opf.vv, 0x08),
+	vUnary("vfwcvt.x.f.v", "v,W,M", 0x12, opf.vv, 0x09),
+	vUnary("vfwcvt.f.xu.v", "v,W,M", 0x12, opf.vv, 0x0a),
+	vUnary("vfwcvt.f.x.v", "v,W,M", 0x12, opf.vv, 0x0b),
+	vUnary("vfwcvt.f.f.v", "v,W,M", 0x12, opf.vv, 0x0c),
+	vUnary("vfwcvt.rtz.xu.f.v", "v,W,M", 0x12, opf.vv, 0x0e),
+	vUnary("vfwcvt.rtz.x.f.v", "v,W,M", 0x12, opf.vv, 0x0f),
+	vUnary("vfncvt.xu.f.w", "v,W,M", 0x12, opf.vv, 0x10),
+	vUnary("vfncvt.x.f.w", "v,W,M", 0x12, opf.vv, 0x11),
+	vUnary("vfncvt.f.xu.w", "v,W,M", 0x12, opf.vv, 0x12),
+	vUnary("vfncvt.f.x.w", "v,W,M", 0x12, opf.vv, 0x13),
+	vUnary("vfncvt.f.f.w", "v,W,M", 0x12, opf.vv, 0x14),
+	vUnary("vfncvt.rod.f.f.w", "v,W,M", 0x12, opf.vv, 0x15),
+	vUnary("vfncvt.rtz.xu.f.w", "v,W,M", 0x12, opf.vv, 0x16),
+	vUnary("vfncvt.rtz.x.f.w", "v,W,M", 0x12, opf.vv, 0x17),
+	vUnary("vfsqrt.v", "v,W,M", 0x13, opf.vv, 0x00),
+	vUnary("vfrsqrt7.v", "v,W,M", 0x13, opf.vv, 0x04),
+	vUnary("vfrec7.v", "v,W,M", 0x13, opf.vv, 0x05),
+	vUnary("vfclass.v", "v,W,M", 0x13, opf.vv, 0x10),
+
+	vDesc("vlm.v", "v,(s)", 0x0b<<20|uint32(RV_OPCODE_LOAD_FP), 0xfdf0707f),
+	vDesc("vsm.v", "v,(s)", 0x0b<<20|uint32(RV_OPCODE_STORE_FP), 0xfdf0707f),
+}
+
+// element widths of the loads and stores, by their width field
+var vWidth = map[uint32]string{0x0: "8", 0x5: "16", 0x6: "32", 0x7: "64"}
+
+// vMem returns the loads and stores of every element width.  mnem has a
+// "%s" where the width goes.
+func vMem(mnem, args string, mop, lumop, mask uint32) []instDesc {
+	ret := make([]instDesc, 0)
+	for _, w := range []uint32{0x0, 0x5, 0x6, 0x7} {
+		m := strings.Replace(mnem, "%s", vWidth[w], 1)
+		bits := mop<<26 | lumop<<20 | w<<12
+		ret = append(ret,
+			vDesc("vl"+m, args, bits|uint32(RV_OPCODE_LOAD_FP), mask),
+			vDesc("vs"+m, args, bits|uint32(RV_OPCODE_STORE_FP), mask))
+	}
+	return ret
+}
+
+func init() {
+	for i := 0; i < 32; i++ {
+		name := "v" + strconv.Itoa(i)
+		bits2vreg[byte(i)] = name
+		vreg2bits[name] = uint32(i)
+	}
+}
+
+func vInsts() []instDesc {
+	vTable := append([]instDesc{}, vMiscTable...)
+	for _, a := range vArithTable {
+		for _, form := range strings.Fields(a.forms) {
+			f := vForms[form]
+			f3 := uint32(opivi)
+			switch f.kind {
+			case 'v', 'm':
+				f3 = a.family.vv
+			case 's':
+				f3 = a.family.vs
+			}
+			vTable = append(vTable, vArith(a.mnem+"."+strings.ToLower(form), f.args, a.funct6, f3))
+		}
+	}
+
+	vTable = append(vTable, vMem("e%s.v", "v,(s),M", 0x0, 0x00, 0xfdf0707f)...)
+	vTable = append(vTable, vMem("se%s.v", "v,(s),t,M", 0x2, 0x00, 0xfc00707f)...)
+	vTable = append(vTable, vMem("uxei%s.v", "v,(s),W,M", 0x1, 0x00, 0xfc00707f)...)
+	vTable = append(vTable, vMem("oxei%s.v", "v,(s),W,M", 0x3, 0x00, 0xfc00707f)...)
+	for _, d := range vMem("e%sff.v", "v,(s),M", 0x0, 0x10, 0xfdf0707f) {
+		// there is no fault-only-first store
+		if strings.HasPrefix(d.mnem, "vl") {
+			vTable = append(vTable, d)
+		}
+	}
+
+	// whole register loads and stores
+	for _, nf := range []uint32{1, 2, 4, 8} {
+		n := strconv.Itoa(int(nf))
+		for _, d := range vMem(n+"re%s.v", "v,(s)", 0x0, 0x08, 0xfff0707f) {
+			d.match |= (nf - 1) << 29
+			if strings.HasPrefix(d.mnem, "vl") {
+				vTable = append(vTable, d)
+			} else if strings.HasSuffix(d.mnem, "re8.v") {
+				d.mnem = "vs" + n + "r.v"
+				vTable = append(vTable, d)
+			}
+		}
+	}
+	return vTable
+}
+
+// vtypeName returns the text of the vtype immediate of vsetvli
+func vtypeName(vtype uint32) string {
+	sew := vtype >> 3 & 0x7
+	lmul := vtype & 0x7
+	if vtype>>8 != 0 || sew >= uint32(len(bits2sew)) || bits2lmul[lmul] == "" {
+		return strconv.FormatUint(uint64(vtype), 10)
+	}
+
+	ret := bits2sew[sew] + "," + bits2lmul[lmul]
+	if vtype&0x40 != 0 {
+		ret += ",ta"
+	} else {
+		ret += ",tu"
+	}
+	if vtype&0x80 != 0 {
+		ret += ",ma"
+	} else {
+		ret += ",mu"
+	}
+	return ret
+}
+
+// vtypeBits parses the vtype operands of vsetvli, which the tokenizer has
+// split up.  A bare number is taken as it is.
+func vtypeBits(ops []string) (uint32, error) {
+	if len(ops) == 1 {
+		if v, err := strconv.ParseUint(ops[0], 10, 11); err == nil {
+			return uint32(v), nil
+		}
+	}
+
+	var vtype uint32
+	sew := false
+	for _, op := range ops {
+		switch op {
+		case "ta":
+			vtype |= 0x40
+		case "ma":
+			vtype |= 0x80
+		case "tu", "mu":
+		default:
+			found := false
+			for i, s := range bits2sew {
+				if op == s {
+					vtype |= uint32(i) << 3
+					sew, found = true, true
+				}
+			}
+			for i, l := range bits2lmul {
+				if op == l && l != "" {
+					vtype |= uint32(i)
+					found = true
+				}
+			}
+			if !found {
+				return 0, errors.New("Unknown vtype operand " + op)
+			}
+		}
+	}
+	if !sew {
+		return 0, errors.New("No element width in vtype")
+	}
+	return vtype, nil
+}
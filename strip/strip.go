@@ -18,305 +18,204 @@
 package strip
 
 import (
-	"bufio"
-	"bytes"
 	"debug/elf"
-	"encoding/binary"
 	"errors"
 	"flag"
-	"io"
 	"os"
-	"regexp"
 	"strings"
-)
-
-type stripUtil struct {
-	src     *elf.FILE
-	objFile *os.File
-	obj     *elf64
-	symtab  []*elf.Sym64
-	shOrder []string
-}
 
-func New() *asUtil {
-	return &asUtil{
-		src:     nil,
-		objFile: nil,
-		obj: &elf64{
-			sections: make(map[string]*sec64),
-		},
-		symtab:  make([]*elf.Sym64, 0),
-		shOrder: make([]string, 0),
-	}
-}
+	"github.com/NonerKao/go-binutils/common"
+)
 
-var currentOffsetShStr uint32
-var currentOffsetStr uint32
-var currentSection string
+// strip.go: remove symbols, debugging sections and other sections from an
+// ELF file, in place or into another
 
-var internalSection = []string{
-	"",
-	".shstrtab",
-	".strtab",
-	".symtab",
+type stripUtil struct {
+	filename string
+	obj      *common.Object
+	mode     os.FileMode
 }
 
-func (asu *asUtil) addSection(sec string) error {
-	if asu.obj.sections[sec] != nil {
-		return errors.New("Section " + sec + " already exists!")
-	} else {
-		asu.obj.sections[sec] = new(sec64)
-		asu.obj.sections[sec].content = make([]string, 0)
-	}
-
-	asu.shOrder = append(asu.shOrder, sec)
-
-	thisSec := asu.obj.sections[sec]
-	thisSec.header.Name = currentOffsetShStr
-	switch sec {
-	case "":
-		thisSec.header.Type = uint32(elf.SHT_NULL)
-		asu.symtab = append(asu.symtab, &elf.Sym64{
-			Name:  0,
-			Info:  elf.ST_INFO(elf.STB_LOCAL, elf.STT_NOTYPE),
-			Shndx: 0,
-		})
-	case ".shstrtab":
-		thisSec.header.Type = uint32(elf.SHT_STRTAB)
-		thisSec.header.Addralign = 0x1
-		thisSec.content = append(thisSec.content, "")
-		currentOffsetShStr = 1
-	case ".strtab":
-		thisSec.header.Type = uint32(elf.SHT_STRTAB)
-		thisSec.header.Addralign = 0x1
-		thisSec.content = append(thisSec.content, "")
-		currentOffsetStr = 1
-	case ".symtab":
-		thisSec.header.Type = uint32(elf.SHT_SYMTAB)
-		thisSec.header.Addralign = 0x8
-		thisSec.header.Entsize = 0x18
-	case ".bss":
-		thisSec.header.Type = uint32(elf.SHT_NOBITS)
-		thisSec.header.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
-		thisSec.header.Addralign = 0x1
-	case ".data":
-		thisSec.header.Type = uint32(elf.SHT_PROGBITS)
-		thisSec.header.Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
-		thisSec.header.Addralign = 0x1
-	case ".text":
-		thisSec.header.Type = uint32(elf.SHT_PROGBITS)
-		thisSec.header.Flags = uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR)
-		thisSec.header.Addralign = 0x4
-		asu.symtab = append(asu.symtab, &elf.Sym64{
-			Info:  elf.ST_INFO(elf.STB_LOCAL, elf.STT_SECTION),
-			Shndx: asu.obj.header.Shnum,
-		})
-	}
-
-	if sec != "" {
-		asu.obj.sections[".shstrtab"].content = append(asu.obj.sections[".shstrtab"].content, sec)
-	}
-	currentOffsetShStr += uint32(len(sec) + 1)
-	currentSection = sec
-	asu.obj.header.Shnum += 1
-
-	return nil
+func New() *stripUtil {
+	return &stripUtil{filename: "", obj: nil}
 }
 
-func (asu *asUtil) Init(filename string) error {
+func (stu *stripUtil) Init(filename string) error {
 
-	var err error
-	asu.src, err = os.Open(filename)
+	info, err := os.Stat(filename)
 	if err != nil {
 		return err
 	}
-
-	asu.obj.header.Ident[0] = '\x7f'
-	asu.obj.header.Ident[1] = 'E'
-	asu.obj.header.Ident[2] = 'L'
-	asu.obj.header.Ident[3] = 'F'
-	asu.obj.header.Ident[4] = byte(elf.ELFCLASS64)
-	asu.obj.header.Ident[5] = byte(elf.ELFDATA2LSB)
-	asu.obj.header.Ident[6] = byte(elf.EV_CURRENT)
-	asu.obj.header.Type = uint16(elf.ET_REL)
-	asu.obj.header.Machine = 243 //elf.EM_RISCV
-	asu.obj.header.Version = uint32(elf.EV_CURRENT)
-	asu.obj.header.Ehsize = 64
-	asu.obj.header.Flags = uint32(0x0005)
-
-	asu.obj.header.Shentsize = 64
-	asu.obj.header.Shnum = 0
-	asu.obj.header.Shstrndx = 1
-
-	for _, sec := range internalSection {
-		err := asu.addSection(sec)
-		if err != nil {
-			return err
-		}
+	stu.obj, err = common.Open(filename)
+	if err != nil {
+		return err
 	}
+	stu.filename, stu.mode = filename, info.Mode().Perm()
 
 	return nil
 }
 
-func (asu *asUtil) DefineFlags() map[string]interface{} {
+func (stu *stripUtil) DefineFlags() map[string]interface{} {
 
 	args := map[string]interface{}{
-		"o": flag.String("o", "a.out", "Output file name"),
+		"o":              flag.String("o", "", "Output file name, instead of replacing the input"),
+		"s":              flag.Bool("s", false, "Remove all symbols and debugging sections"),
+		"g":              flag.Bool("g", false, "Remove debugging sections"),
+		"strip-unneeded": flag.Bool("strip-unneeded", false, "Remove the local and undefined symbols no relocation needs, and debugging sections"),
+		"K":              new(common.Names),
+		"N":              new(common.Names),
+		"R":              new(common.Names),
 	}
+	flag.BoolVar(args["s"].(*bool), "strip-all", false, "Same as -s")
+	flag.BoolVar(args["g"].(*bool), "strip-debug", false, "Same as -g")
+	flag.Var(args["K"].(*common.Names), "K", "Keep the symbol of the name")
+	flag.Var(args["K"].(*common.Names), "keep-symbol", "Same as -K")
+	flag.Var(args["N"].(*common.Names), "N", "Remove the symbol of the name")
+	flag.Var(args["N"].(*common.Names), "strip-symbol", "Same as -N")
+	flag.Var(args["R"].(*common.Names), "R", "Remove the section of the name")
+	flag.Var(args["R"].(*common.Names), "remove-section", "Same as -R")
 
 	return args
 }
 
-func (asu *asUtil) addLabel(lab string) {
-	asu.obj.sections[".strtab"].content = append(asu.obj.sections[".strtab"].content, lab)
-	asu.symtab = append(asu.symtab, &elf.Sym64{
-		Name:  currentOffsetStr,
-		Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC),
-		Shndx: asu.obj.header.Shnum - 1,
-	})
-
-	currentOffsetStr += uint32(len(lab) + 1)
+// debugPrefixes are the names of debugging sections, as GNU strip tells
+// them
+var debugPrefixes = []string{
+	".debug",
+	".zdebug",
+	".gnu.debuglto_",
+	".gnu.linkonce.wi.",
+	".line",
+	".stab",
+	".gdb_index",
 }
 
-func preProcessLine(line string) []string {
-
-	rePunc := regexp.MustCompile(`[,()]`)
-	reSpace := regexp.MustCompile(`[[:space:]]+`)
-	line = rePunc.ReplaceAllString(line, " ")
-	line = reSpace.ReplaceAllString(line, " ")
-	sa := strings.Split(strings.TrimSpace(string(line)), " ")
-
-	return sa
+func isDebug(s *common.Section) bool {
+	for _, p := range debugPrefixes {
+		if strings.HasPrefix(s.Name, p) {
+			return true
+		}
+	}
+	return false
 }
 
-func (asu *asUtil) Run(args map[string]interface{}) error {
-
-	r := bufio.NewReaderSize(asu.src, 1024)
-	line, _, err := r.ReadLine()
-	end := false
-	for err == nil {
-		sa := preProcessLine(string(line))
-
-		if sa[0][0] == '.' {
-			end, err = asu.dire(sa)
-			if end {
-				break
+// needed returns the symbols the object cannot do without: those of the
+// relocations and the signatures of the section groups
+func needed(o *common.Object) map[*common.Symbol]bool {
+	ret := make(map[*common.Symbol]bool)
+	for _, s := range o.Sections {
+		for _, r := range s.Relocs {
+			if r.Sym != nil {
+				ret[r.Sym] = true
 			}
-		} else if sa[0][len(sa[0])-1] == ':' {
-			asu.addLabel(sa[0][0 : len(sa[0])-1])
-		} else {
-			asu.inst(sa)
 		}
-
-		line, _, err = r.ReadLine()
+		if s.Signature != nil {
+			ret[s.Signature] = true
+		}
 	}
+	return ret
+}
 
-	if end == false && err != io.EOF {
-		return err
+// removeSection takes s out, and the members of a group out of it
+func (stu *stripUtil) removeSection(s *common.Section) {
+	for _, m := range s.Members {
+		m.Flags &^= elf.SHF_GROUP
 	}
-
-	asu.src.Close()
-	return nil
+	stu.obj.RemoveSection(s)
 }
 
-func (asu *asUtil) dire(d []string) (bool, error) {
-	var err error
-	switch d[0] {
-	case ".section":
-		if len(d) != 2 {
-			return false, errors.New("Syntax error: section not specified!")
-		}
-		for _, sec := range internalSection {
-			if d[1] == sec {
-				return false, errors.New("Syntax error: not allowed section " + d[1])
-			}
-		}
-		err = asu.addSection(d[1])
-		return false, err
+func (stu *stripUtil) Run(args map[string]interface{}) error {
 
-	case ".global":
-		if len(d) != 2 {
-			return false, errors.New("Syntax error: label not specified!")
-		}
-		//asu.symtab["add"].Info = byte(elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE))
+	all := *args["s"].(*bool)
+	debug := *args["g"].(*bool)
+	unneeded := *args["strip-unneeded"].(*bool)
+	keep := args["K"].(*common.Names)
+	drop := args["N"].(*common.Names)
+	remove := args["R"].(*common.Names)
 
-	case ".end":
-		return true, nil
+	// as GNU strip does, strip everything unless told what to strip
+	if !all && !debug && !unneeded && len(*drop) == 0 {
+		all = true
 	}
-	return false, nil
-}
-
-func (asu *asUtil) inst(d []string) {
-	asu.obj.sections[currentSection].content = append(asu.obj.sections[currentSection].content, string(rvgc.InstToBin(d)))
-}
 
-func (asu *asUtil) write(secname string, align uint64) uint64 {
-	var size uint64
-	switch secname {
-	case ".shstrtab", ".strtab":
-		for _, str := range asu.obj.sections[secname].content {
-			temp, _ := asu.objFile.WriteString(str)
-			asu.objFile.WriteString("\x00")
-			size = size + uint64(temp) + 1
-		}
-	case ".symtab":
-		for _, syment := range asu.symtab {
-			var binbuf bytes.Buffer
-			binary.Write(&binbuf, binary.LittleEndian, syment)
-			temp, _ := asu.objFile.Write(binbuf.Bytes())
-			size = size + uint64(temp)
+	// with all symbols go the relocations against them, which have no
+	// use in a file that is no longer to be linked
+	o := stu.obj
+	count := len(o.Symbols)
+	for _, s := range append([]*common.Section(nil), o.Sections...) {
+		switch {
+		case remove.Has(s.Name):
+		case (all || debug || unneeded) && isDebug(s):
+		case all && s.Relocs != nil && s.Flags&elf.SHF_ALLOC == 0:
+		default:
+			continue
 		}
-	case ".data":
-		for _, data := range asu.obj.sections[secname].content {
-			temp, _ := asu.objFile.WriteString(data)
-			sizeAlign := uint64(temp) / align * align
-			asu.objFile.WriteString(strings.Repeat(" ", int(sizeAlign-size)))
-			size += sizeAlign
-		}
-	case ".text":
-		for _, text := range asu.obj.sections[secname].content {
-			temp, _ := asu.objFile.WriteString(text)
-			size += uint64(temp)
+		stu.removeSection(s)
+	}
+	// a group that has lost all its members goes as well
+	for _, s := range append([]*common.Section(nil), o.Sections...) {
+		if s.Type == elf.SHT_GROUP && s.Signature != nil && len(s.Members) == 0 {
+			o.RemoveSection(s)
 		}
 	}
-	return size
-}
-
-func (asu *asUtil) Output(args map[string]interface{}) error {
 
-	var err error
-	asu.objFile, err = os.Create(*args["o"].(*string))
-	if err != nil {
-		return err
+	alive := make(map[*common.Section]bool)
+	for _, s := range o.Sections {
+		alive[s] = true
+	}
+	need := needed(o)
+	for _, sym := range o.Symbols {
+		if drop.Has(sym.Name) && need[sym] {
+			return errors.New("Cannot strip symbol " + sym.Name + ": a relocation or a section group needs it")
+		}
 	}
 
-	asu.obj.header.Shoff = uint64(asu.obj.header.Ehsize)
-	var binbuf bytes.Buffer
-	binary.Write(&binbuf, binary.LittleEndian, &asu.obj.header)
-	asu.objFile.Write(binbuf.Bytes())
-
-	var contentOffset uint64 = uint64(asu.obj.header.Shnum*asu.obj.header.Shentsize + asu.obj.header.Ehsize)
-	var headerOffset uint64 = uint64(asu.obj.header.Ehsize)
-	for i, name := range asu.shOrder {
-		sec := asu.obj.sections[name]
-
-		asu.objFile.Seek(int64(contentOffset), 0)
-		sec.header.Size += asu.write(name, sec.header.Addralign)
-		sec.header.Off = uint64(contentOffset)
-		contentOffset += sec.header.Size
-
-		if name == ".strtab" {
-			asu.obj.sections[".symtab"].header.Link = uint32(i)
-			asu.obj.sections[".symtab"].header.Info = 2
+	o.RemoveSymbols(func(sym *common.Symbol) bool {
+		switch {
+		case sym.Section != nil && !alive[sym.Section]:
+			return true
+		case need[sym] || keep.Has(sym.Name):
+			return false
+		case drop.Has(sym.Name) || all:
+			return true
+		case unneeded:
+			// only a relocatable file needs global symbols
+			return o.Type != elf.ET_REL || sym.Bind == elf.STB_LOCAL || (sym.Section == nil && sym.Shndx == elf.SHN_UNDEF)
+		case debug:
+			// the source file names are debugging symbols
+			return sym.Type == elf.STT_FILE
 		}
+		return false
+	})
+	if o.SymTab == nil || len(o.Symbols) == count {
+		return nil
+	}
 
-		asu.objFile.Seek(int64(headerOffset), 0)
-		var binbuf bytes.Buffer
-		binary.Write(&binbuf, binary.LittleEndian, &sec.header)
-		asu.objFile.Write(binbuf.Bytes())
-		headerOffset += uint64(asu.obj.header.Shentsize)
+	// the relocations and groups are rebuilt against the new indexes, but
+	// no other section can be
+	for _, s := range o.Sections {
+		if s.Link == o.SymTab && s.Relocs == nil && s.Type != elf.SHT_GROUP {
+			return errors.New("Cannot strip symbols: section " + s.Name + " refers to them by index")
+		}
 	}
 
-	asu.objFile.Close()
+	// with no symbols left, which no relocation can need then, the symbol
+	// table goes too
+	if len(o.Symbols) == 0 {
+		strtab := o.StrTab
+		o.RemoveSection(o.SymTab)
+		if strtab != nil && strtab != o.ShStrTab {
+			o.RemoveSection(strtab)
+		}
+	}
 	return nil
 }
+
+func (stu *stripUtil) Output(args map[string]interface{}) error {
+
+	out := *args["o"].(*string)
+	if out == "" {
+		out = stu.filename
+	}
+	return stu.obj.WriteFile(out, stu.mode)
+}
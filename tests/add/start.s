@@ -0,0 +1,21 @@
+.section .text
+.globl _start
+_start:
+	addi a0, zero, 1
+	addi a1, zero, 2
+	call add
+	addi a0, a0, 48
+	la t0, buf
+	sb a0, 0(t0)
+	addi a0, zero, 1
+	add a1, zero, t0
+	addi a2, zero, 2
+	addi a7, zero, 64
+	ecall
+	addi a0, zero, 0
+	addi a7, zero, 93
+	ecall
+.section .data
+buf:
+	.byte 0, 10
+.end
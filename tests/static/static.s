@@ -1,4 +1,5 @@
 .section .text
+.globl _start
 _start:
 	addi sp, sp, -16
 	addi t0, zero, 72
@@ -10,14 +11,15 @@ _start:
 	addi t0, zero, 10
 	sb t0, 3(sp)
         addi t1, zero, 4
+print:
 		addi a0, zero, 1
 		add a1, zero, sp
 		addi a2, zero, 4
 		addi a7, zero, 64
 		ecall
 		addi t1, t1, -1
-	bne t1, zero, ff4
-	lui t2, 44434
+	bne t1, zero, print
+	lui t2, 0x44434
 	addi t2, t2, 577
 	sw t2, 0(sp)
 		addi a0, zero, 1